@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/s3fake"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/google/uuid"
+)
+
+const testBucket = "tubely-test"
+
+// testAPI is the server on an in-memory database, with thumbnails on disk
+// and videos in a fake S3 bucket.
+type testAPI struct {
+	cfg *apiConfig
+	mux *http.ServeMux
+	db  *database.MemoryStore
+	// s3 is the fake S3 server's URL.
+	s3 string
+}
+
+func newTestAPI(t *testing.T) *testAPI {
+	t.Helper()
+	fake := httptest.NewServer(s3fake.New())
+	t.Cleanup(fake.Close)
+
+	client := s3.New(s3.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(fake.URL),
+		UsePathStyle: true,
+		Credentials:  credentials.NewStaticCredentialsProvider("test", "test", ""),
+	})
+	videoStore, err := storage.NewS3Store(client, testBucket, storage.S3Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assetsRoot := t.TempDir()
+	thumbnailStore, err := storage.NewLocalStore(assetsRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	urls := storage.NewURLBuilder()
+	if err := urls.SetBase(thumbnailStoreName, "http://localhost:8091/assets"); err != nil {
+		t.Fatal(err)
+	}
+	if err := urls.SetBase(videoStoreName, fake.URL+"/"+testBucket); err != nil {
+		t.Fatal(err)
+	}
+
+	db := database.NewMemoryStore()
+	cfg := &apiConfig{
+		db:                    db,
+		jwtSecret:             "test-secret",
+		platform:              "dev",
+		filepathRoot:          t.TempDir(),
+		assetsRoot:            assetsRoot,
+		uploadsRoot:           t.TempDir(),
+		uploadExpiry:          24 * time.Hour,
+		directUploadExpiry:    time.Hour,
+		videoStore:            videoStore,
+		thumbnailStore:        thumbnailStore,
+		urls:                  urls,
+		renditionLadder:       defaultRenditionLadder,
+		allowedVideoTypes:     []string{"video/mp4", "video/quicktime", "video/webm", "video/x-matroska"},
+		thumbnailFrameOffset:  3 * time.Second,
+		thumbnailWidths:       defaultThumbnailWidths,
+		videoVersionRetention: 7 * 24 * time.Hour,
+		presignExpiry:         15 * time.Minute,
+		cloudfront:            cloudfrontConfig{urlExpiry: time.Hour},
+		// No workers: jobs stay queued for the test to look at.
+		jobs: jobQueueConfig{
+			maxAttempts:  3,
+			retryBackoff: 30 * time.Second,
+			wake:         make(chan struct{}, 1),
+		},
+	}
+	return &testAPI{cfg: cfg, mux: cfg.routes(), db: db, s3: fake.URL}
+}
+
+// createUser adds a user and returns it with an access token.
+func (api *testAPI) createUser(t *testing.T, email string) (*database.User, string) {
+	t.Helper()
+	hash, err := auth.HashPassword("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := api.db.CreateUser(database.CreateUserParams{Email: email, Password: hash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := auth.MakeJWT(user.ID, api.cfg.jwtSecret, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user, token
+}
+
+func (api *testAPI) createVideo(t *testing.T, userID uuid.UUID) database.Video {
+	t.Helper()
+	video, err := api.db.CreateVideo(database.CreateVideoParams{Title: "Boots", Description: "A video", UserID: userID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return video
+}
+
+// do serves a request with token as its bearer token, if any.
+func (api *testAPI) do(method, target, token string, body io.Reader, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, body)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	api.mux.ServeHTTP(w, req)
+	return w
+}
+
+// wantStatus fails the test unless the response has the status.
+func wantStatus(t *testing.T, w *httptest.ResponseRecorder, status int) {
+	t.Helper()
+	if w.Code != status {
+		t.Fatalf("status = %d, want %d; body: %s", w.Code, status, w.Body)
+	}
+}
+
+func decodeResponse[T any](t *testing.T, w *httptest.ResponseRecorder) T {
+	t.Helper()
+	var v T
+	if err := json.Unmarshal(w.Body.Bytes(), &v); err != nil {
+		t.Fatalf("decoding %s: %v", w.Body, err)
+	}
+	return v
+}
+
+// requireFFmpeg skips tests that process media when ffmpeg isn't installed.
+func requireFFmpeg(t *testing.T) {
+	t.Helper()
+	for _, name := range []string{"ffmpeg", "ffprobe"} {
+		if _, err := exec.LookPath(name); err != nil {
+			t.Skipf("%s isn't installed", name)
+		}
+	}
+}
+
+// multipartFile is a form with a single file, as browsers send it.
+func multipartFile(t *testing.T, field, contentType string, data []byte) (io.Reader, http.Header) {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	partHeader := textproto.MIMEHeader{}
+	partHeader.Set("Content-Disposition", `form-data; name="`+field+`"; filename="upload"`)
+	partHeader.Set("Content-Type", contentType)
+	part, err := form.CreatePart(partHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(data)
+	if err := form.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &body, http.Header{"Content-Type": {form.FormDataContentType()}}
+}
+
+// testVideoFile makes a second long H.264/AAC MP4 with ffmpeg.
+func testVideoFile(t *testing.T) []byte {
+	t.Helper()
+	requireFFmpeg(t)
+	path := filepath.Join(t.TempDir(), "test.mp4")
+	out, err := exec.Command("ffmpeg", "-v", "error",
+		"-f", "lavfi", "-i", "testsrc=duration=1:size=320x240:rate=30",
+		"-f", "lavfi", "-i", "sine=duration=1",
+		"-c:v", "libx264", "-pix_fmt", "yuv420p", "-c:a", "aac",
+		"-movflags", "faststart", path,
+	).CombinedOutput()
+	if err != nil {
+		t.Fatalf("ffmpeg: %v: %s", err, out)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// runJobs runs the queued jobs that are due, as a worker would, and returns
+// how many there were.
+func (api *testAPI) runJobs(t *testing.T) int {
+	t.Helper()
+	for n := 0; ; n++ {
+		now := time.Now()
+		job, err := api.db.ClaimJob(now, now.Add(jobLease))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job == nil {
+			return n
+		}
+		api.cfg.runJob(context.Background(), *job)
+	}
+}
+
+// wantEmptyDir fails the test if anything was left behind in dir.
+func wantEmptyDir(t *testing.T, dir string) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		t.Errorf("%s was left in %s", e.Name(), dir)
+	}
+}
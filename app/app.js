@@ -161,12 +161,32 @@ async function uploadVideoFile(videoID) {
     }
 
     console.log("Video uploaded!");
-    await getVideo(videoID);
+    // The upload is only queued for processing: wait for the outcome.
+    const video = await waitForVideo(videoID);
+    if (video.status === "failed") {
+      throw new Error("Failed to process video file.");
+    }
   } catch (error) {
     alert(`Error: ${error.message}`);
   }
 }
 
+const videoPollInterval = 2000;
+
+// waitForVideo shows the video until it's ready or failed, and returns it.
+async function waitForVideo(videoID) {
+  for (;;) {
+    const video = await fetchVideo(videoID);
+    if (currentVideo?.id === videoID) {
+      viewVideo(video);
+    }
+    if (video.status === "ready" || video.status === "failed") {
+      return video;
+    }
+    await new Promise((resolve) => setTimeout(resolve, videoPollInterval));
+  }
+}
+
 async function getVideos() {
   try {
     const res = await fetch("/api/videos", {
@@ -194,20 +214,22 @@ async function getVideos() {
   }
 }
 
+async function fetchVideo(videoID) {
+  const res = await fetch(`/api/videos/${videoID}`, {
+    method: "GET",
+    headers: {
+      Authorization: `Bearer ${localStorage.getItem("token")}`,
+    },
+  });
+  if (!res.ok) {
+    throw new Error("Failed to get video.");
+  }
+  return res.json();
+}
+
 async function getVideo(videoID) {
   try {
-    const res = await fetch(`/api/videos/${videoID}`, {
-      method: "GET",
-      headers: {
-        Authorization: `Bearer ${localStorage.getItem("token")}`,
-      },
-    });
-    if (!res.ok) {
-      throw new Error("Failed to get video.");
-    }
-
-    const video = await res.json();
-    viewVideo(video);
+    viewVideo(await fetchVideo(videoID));
   } catch (error) {
     alert(`Error: ${error.message}`);
   }
@@ -222,12 +244,25 @@ function viewVideo(video) {
   document.getElementById("video-description-display").textContent =
     video.description;
 
+  const statusText = {
+    created: "No video file uploaded yet.",
+    uploaded: "Waiting to be processed...",
+    processing: "Processing...",
+    failed: "Processing failed, please upload the video file again.",
+  };
+  document.getElementById("video-status").textContent =
+    statusText[video.status] || "";
+
   const thumbnailImg = document.getElementById("thumbnail-image");
   if (!video.thumbnail_url) {
     thumbnailImg.style.display = "none";
   } else {
     thumbnailImg.style.display = "block";
     thumbnailImg.src = video.thumbnail_url;
+    thumbnailImg.srcset = (video.thumbnails || [])
+      .filter((t) => t.media_type === "image/jpeg")
+      .map((t) => `${t.url} ${t.width}w`)
+      .join(", ");
   }
 
   const downloadButton = document.getElementById("download-button");
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// storeBlob stores a processed video, and its streaming packages, under a key
+// derived from its SHA-256 and takes a reference to it. When the same content
+// is already stored, nothing is uploaded and the existing objects are shared.
+// While an earlier copy is still being deleted it fails with
+// database.ErrBlobReleased, and has to be retried later.
+func (cfg *apiConfig) storeBlob(ctx context.Context, processedFilePath string, probe mediaProbe) (database.Blob, error) {
+	f, err := os.Open(processedFilePath)
+	if err != nil {
+		return database.Blob{}, fmt.Errorf("unable to read processed file: %w", err)
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return database.Blob{}, fmt.Errorf("couldn't hash video: %w", err)
+	}
+	blob := database.Blob{
+		Key:        aspectRatioPrefix(probe) + "/" + hex.EncodeToString(hash.Sum(nil)) + ".mp4",
+		Encryption: cfg.videoEncryption(),
+	}
+
+	// The blob is recorded before anything is uploaded, so a delete of the
+	// same content can't be in flight while we upload it.
+	blob, err = cfg.db.AcquireBlob(blob)
+	if err != nil {
+		return database.Blob{}, err
+	}
+	if blob.Stored {
+		return blob, nil
+	}
+	// Another upload of the same file may be storing it right now too.
+	// Both upload identical objects, and whichever is left holding the
+	// reference keeps them.
+	err = cfg.uploadBlob(ctx, &blob, f, processedFilePath, probe)
+	if err == nil {
+		err = cfg.db.MarkBlobStored(blob)
+	}
+	if err != nil {
+		cfg.releaseBlob(ctx, blob)
+		return database.Blob{}, err
+	}
+	return blob, nil
+}
+
+// uploadBlob uploads the MP4 in f and packages it.
+func (cfg *apiConfig) uploadBlob(ctx context.Context, blob *database.Blob, f *os.File, processedFilePath string, probe mediaProbe) error {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	err := cfg.videoStore.Put(ctx, blob.Key, f, "video/mp4")
+	if err != nil {
+		return fmt.Errorf("couldn't save video: %w", err)
+	}
+	return cfg.packageBlob(ctx, blob, processedFilePath, probe)
+}
+
+// packageBlob makes the configured streaming packages of a stored blob next
+// to its MP4.
+func (cfg *apiConfig) packageBlob(ctx context.Context, blob *database.Blob, processedFilePath string, probe mediaProbe) error {
+	baseKey := strings.TrimSuffix(blob.Key, ".mp4")
+	if cfg.streamingFormats.HLS {
+		hlsKey, err := cfg.packageHLS(ctx, processedFilePath, probe, baseKey+"/hls")
+		if err != nil {
+			return fmt.Errorf("couldn't package HLS: %w", err)
+		}
+		blob.HLSKey = &hlsKey
+	}
+	if cfg.streamingFormats.DASH {
+		dashKey, err := cfg.packageDASH(ctx, processedFilePath, probe, baseKey+"/dash")
+		if err != nil {
+			return fmt.Errorf("couldn't package DASH: %w", err)
+		}
+		blob.DASHKey = &dashKey
+	}
+	return nil
+}
+
+// blobObjects lists a blob's objects: its MP4 and everything next to it,
+// including packages that were only partly uploaded.
+func (cfg *apiConfig) blobObjects(blob database.Blob) []storedObject {
+	return []storedObject{
+		{Store: videoStoreName, Key: blob.Key, Encryption: blob.Encryption, Blob: blob.Key},
+		{Store: videoStoreName, Key: strings.TrimSuffix(blob.Key, ".mp4") + "/", Prefix: true, Encryption: blob.Encryption, Blob: blob.Key},
+	}
+}
+
+// releaseBlob drops a reference to a blob that no video version took over,
+// deleting its objects if nothing else uses them.
+func (cfg *apiConfig) releaseBlob(ctx context.Context, blob database.Blob) {
+	unreferenced, err := cfg.db.ReleaseBlob(blob.Key)
+	if err != nil {
+		log.Printf("Couldn't release blob %s: %v", blob.Key, err)
+		return
+	}
+	if unreferenced {
+		cfg.deleteVideoObjects(ctx, cfg.blobObjects(blob))
+	}
+}
+
+// forgetDeletedBlob forgets a released blob once none of its objects are
+// left, so its content can be stored again.
+func (cfg *apiConfig) forgetDeletedBlob(ctx context.Context, key, encryption string) error {
+	for _, obj := range cfg.blobObjects(database.Blob{Key: key, Encryption: encryption}) {
+		store, err := cfg.objectStore(obj)
+		if err != nil {
+			return err
+		}
+		exists, err := objectExists(ctx, store, obj)
+		if err != nil || exists {
+			return err
+		}
+	}
+	return cfg.db.ForgetBlob(key)
+}
+
+func aspectRatioPrefix(probe mediaProbe) string {
+	switch probe.aspectRatio() {
+	case "16:9":
+		return "landscape"
+	case "9:16":
+		return "portrait"
+	}
+	return "other"
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+)
+
+const (
+	jobKindDeleteObject = "delete_object"
+
+	videoStoreName     = "video"
+	thumbnailStoreName = "thumbnail"
+
+	// deleteAttempts is how often a delete is tried inline before it's
+	// handed to the job queue.
+	deleteAttempts   = 3
+	deleteRetryDelay = 200 * time.Millisecond
+)
+
+// storedObject is something a video owns in one of the stores. A prefix
+// covers every object under it, e.g. all the segments of an HLS package.
+type storedObject struct {
+	Store  string `json:"store"`
+	Key    string `json:"key"`
+	Prefix bool   `json:"prefix,omitempty"`
+	// Encryption is what a video's media was stored with, which reading
+	// it may depend on.
+	Encryption string `json:"encryption,omitempty"`
+	// Blob is the key of the released blob the object belongs to, which is
+	// forgotten once all its objects are deleted.
+	Blob string `json:"blob,omitempty"`
+}
+
+func (cfg *apiConfig) blobStore(name string) (storage.BlobStore, error) {
+	switch name {
+	case videoStoreName:
+		return cfg.videoStore, nil
+	case thumbnailStoreName:
+		return cfg.thumbnailStore, nil
+	}
+	return nil, fmt.Errorf("unknown store %q", name)
+}
+
+// objectStore is the store to read obj from. Encrypted videos may need to be
+// read with the settings they were stored with.
+func (cfg *apiConfig) objectStore(obj storedObject) (storage.BlobStore, error) {
+	if obj.Store == videoStoreName {
+		return cfg.encryptedVideoStore(obj.Encryption)
+	}
+	return cfg.blobStore(obj.Store)
+}
+
+// encryptedVideoStore returns the video store set up for objects stored with
+// the given encryption, as recorded on every video.
+func (cfg *apiConfig) encryptedVideoStore(encryption string) (storage.BlobStore, error) {
+	encrypter, ok := cfg.videoStore.(storage.Encrypter)
+	if !ok {
+		if encryption != "" {
+			return nil, fmt.Errorf("video store doesn't support %s encryption", encryption)
+		}
+		return cfg.videoStore, nil
+	}
+	return encrypter.WithEncryption(storage.SSEMode(encryption))
+}
+
+// videoEncryption is the encryption new videos are stored with.
+func (cfg *apiConfig) videoEncryption() string {
+	if encrypter, ok := cfg.videoStore.(storage.Encrypter); ok {
+		return string(encrypter.Encryption())
+	}
+	return ""
+}
+
+// videoObjects lists everything video owns: the MP4, the streaming packages
+// next to it and every thumbnail variant. References that don't belong to
+// our stores are skipped, there's nothing we can delete there.
+func (cfg *apiConfig) videoObjects(video database.Video) []storedObject {
+	objects := cfg.mediaObjects(video.Encryption, video.VideoURL, video.HLSURL, video.DASHURL)
+	return appendObjects(objects, cfg.thumbnailObjects(video)...)
+}
+
+func (cfg *apiConfig) thumbnailObjects(video database.Video) []storedObject {
+	objects := []storedObject{}
+	thumbnailRefs := []string{}
+	if video.ThumbnailURL != nil {
+		thumbnailRefs = append(thumbnailRefs, *video.ThumbnailURL)
+	}
+	for _, t := range video.Thumbnails {
+		thumbnailRefs = append(thumbnailRefs, t.URL)
+	}
+	for _, ref := range thumbnailRefs {
+		if key, ok := cfg.urls.Key(thumbnailStoreName, ref); ok {
+			objects = appendObjects(objects, storedObject{Store: thumbnailStoreName, Key: key})
+		}
+	}
+	return objects
+}
+
+// mediaObjects lists the objects behind one upload of a video, which are
+// one blob's.
+func (cfg *apiConfig) mediaObjects(encryption string, videoURL, hlsURL, dashURL *string) []storedObject {
+	objects := []storedObject{}
+	blob := ""
+	if videoURL != nil {
+		if key, ok := cfg.urls.Key(videoStoreName, *videoURL); ok {
+			blob = key
+			objects = appendObjects(objects, storedObject{Store: videoStoreName, Key: key, Encryption: encryption, Blob: blob})
+		}
+	}
+	// Streaming packages are directories of playlists and segments; the
+	// manifest points at one file inside.
+	for _, ref := range []*string{hlsURL, dashURL} {
+		if ref == nil {
+			continue
+		}
+		if key, ok := cfg.urls.Key(videoStoreName, *ref); ok {
+			objects = appendObjects(objects, storedObject{Store: videoStoreName, Key: path.Dir(key) + "/", Prefix: true, Encryption: encryption, Blob: blob})
+		}
+	}
+	return objects
+}
+
+// appendObjects appends the objects that aren't in objects yet.
+func appendObjects(objects []storedObject, more ...storedObject) []storedObject {
+	for _, obj := range more {
+		if !slices.Contains(objects, obj) {
+			objects = append(objects, obj)
+		}
+	}
+	return objects
+}
+
+// deleteObject removes obj, or everything under it for a prefix. Deleting
+// something that's already gone succeeds.
+func (cfg *apiConfig) deleteObject(ctx context.Context, obj storedObject) error {
+	store, err := cfg.blobStore(obj.Store)
+	if err != nil {
+		return err
+	}
+	if !obj.Prefix {
+		return store.Delete(ctx, obj.Key)
+	}
+	if !strings.HasSuffix(obj.Key, "/") || obj.Key == "/" {
+		// A bare prefix like "landscape" would take other videos with it.
+		return fmt.Errorf("refusing to delete prefix %q", obj.Key)
+	}
+	objects, err := store.List(ctx, obj.Key)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, o := range objects {
+		if err := store.Delete(ctx, o.Key); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", o.Key, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// deleteVideoObjects deletes everything in objects, retrying each a few times.
+// Whatever still fails is queued for the workers to keep retrying. It returns
+// the objects that were queued and those that couldn't even be queued.
+// Released blobs whose objects are all deleted are forgotten, the others are
+// once the workers are done with them, or by gc.
+func (cfg *apiConfig) deleteVideoObjects(ctx context.Context, objects []storedObject) (scheduled, failed []storedObject) {
+	scheduled, failed = []storedObject{}, []storedObject{}
+	defer func() {
+		pending := map[string]bool{}
+		for _, obj := range slices.Concat(scheduled, failed) {
+			pending[obj.Blob] = true
+		}
+		for _, obj := range objects {
+			if obj.Blob == "" || pending[obj.Blob] {
+				continue
+			}
+			pending[obj.Blob] = true
+			if err := cfg.db.ForgetBlob(obj.Blob); err != nil {
+				log.Printf("Couldn't forget deleted blob %s: %v", obj.Blob, err)
+			}
+		}
+	}()
+	for _, obj := range objects {
+		var err error
+		for attempt := 1; attempt <= deleteAttempts; attempt++ {
+			err = cfg.deleteObject(ctx, obj)
+			if err == nil || attempt == deleteAttempts {
+				break
+			}
+			select {
+			case <-ctx.Done():
+			case <-time.After(deleteRetryDelay << (attempt - 1)):
+			}
+		}
+		if err == nil {
+			continue
+		}
+		log.Printf("Couldn't delete %s object %s, scheduling a retry: %v", obj.Store, obj.Key, err)
+		if err := cfg.enqueueObjectDeletion(obj); err != nil {
+			log.Printf("Couldn't schedule deletion of %s object %s: %v", obj.Store, obj.Key, err)
+			failed = append(failed, obj)
+			continue
+		}
+		scheduled = append(scheduled, obj)
+	}
+	return scheduled, failed
+}
+
+func (cfg *apiConfig) enqueueObjectDeletion(obj storedObject) error {
+	payload, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	return cfg.enqueueJob(jobKindDeleteObject, nil, string(payload), time.Now().Add(cfg.jobs.retryBackoff))
+}
+
+func (cfg *apiConfig) deleteObjectJob(ctx context.Context, job database.Job) error {
+	var obj storedObject
+	if err := json.Unmarshal([]byte(job.Payload), &obj); err != nil {
+		return err
+	}
+	if err := cfg.deleteObject(ctx, obj); err != nil {
+		return err
+	}
+	if obj.Blob == "" {
+		return nil
+	}
+	return cfg.forgetDeletedBlob(ctx, obj.Blob, obj.Encryption)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"mime"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	mime.AddExtensionType(".mpd", "application/dash+xml")
+	mime.AddExtensionType(".m4s", "video/iso.segment")
+}
+
+// packageDASH transcodes filePath into every rendition of the ladder as a
+// single MPEG-DASH presentation with fMP4 segments and stores it under
+// keyPrefix. It returns the key of the manifest.
+func (cfg *apiConfig) packageDASH(ctx context.Context, filePath string, probe mediaProbe, keyPrefix string) (string, error) {
+	src, ok := probe.videoStream()
+	if !ok {
+		return "", errNoVideoStream
+	}
+	_, hasAudio := probe.audioStream()
+	width, height := src.displaySize()
+	renditions := planRenditions(cfg.renditionLadder, width, height, probe.frameRate())
+
+	outDir, err := os.MkdirTemp("", "tubely-dash-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(outDir)
+
+	cmd := exec.CommandContext(ctx, "ffmpeg", dashArgs(filePath, outDir, renditions, hasAudio)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("couldn't transcode DASH: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	if err := cfg.putTree(ctx, outDir, keyPrefix); err != nil {
+		return "", err
+	}
+	return path.Join(keyPrefix, "manifest.mpd"), nil
+}
+
+// dashArgs builds one ffmpeg invocation that scales the source once per
+// rendition and muxes all of them, plus a single audio track, into one
+// manifest.
+func dashArgs(filePath, outDir string, renditions []rendition, hasAudio bool) []string {
+	var filter strings.Builder
+	fmt.Fprintf(&filter, "[0:v]split=%d", len(renditions))
+	for i := range renditions {
+		fmt.Fprintf(&filter, "[s%d]", i)
+	}
+	for i, r := range renditions {
+		fmt.Fprintf(&filter, ";[s%d]scale=%d:%d[v%d]", i, r.Width, r.Height, i)
+	}
+
+	args := []string{"-v", "error", "-i", filePath, "-filter_complex", filter.String()}
+	for i, r := range renditions {
+		args = append(args,
+			"-map", fmt.Sprintf("[v%d]", i),
+			fmt.Sprintf("-c:v:%d", i), "libx264",
+			fmt.Sprintf("-level:v:%d", i), fmt.Sprintf("%d.%d", r.Level/10, r.Level%10),
+			fmt.Sprintf("-b:v:%d", i), fmt.Sprintf("%dk", r.VideoBitrate),
+			fmt.Sprintf("-maxrate:v:%d", i), fmt.Sprintf("%dk", r.VideoBitrate*107/100),
+			fmt.Sprintf("-bufsize:v:%d", i), fmt.Sprintf("%dk", r.VideoBitrate*3/2),
+		)
+	}
+	adaptationSets := "id=0,streams=v"
+	if hasAudio {
+		args = append(args, "-map", "0:a:0", "-c:a", "aac", "-b:a", "128k", "-ac", "2")
+		adaptationSets += " id=1,streams=a"
+	}
+	args = append(args,
+		"-preset", "veryfast",
+		"-profile:v", "high",
+		"-force_key_frames", fmt.Sprintf("expr:gte(t,n_forced*%d)", segmentSeconds),
+		"-sc_threshold", "0",
+		"-f", "dash",
+		"-seg_duration", strconv.Itoa(segmentSeconds),
+		"-use_template", "1",
+		"-use_timeline", "1",
+		"-adaptation_sets", adaptationSets,
+		"-init_seg_name", "init-$RepresentationID$.m4s",
+		"-media_seg_name", "chunk-$RepresentationID$-$Number%05d$.m4s",
+		filepath.Join(outDir, "manifest.mpd"),
+	)
+	return args
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/s3fake"
+)
+
+// runFakeS3 implements `tubely fakes3`, an in-memory S3 to develop against
+// without AWS. Point the server at it with S3_ENDPOINT and
+// S3_FORCE_PATH_STYLE=true.
+func runFakeS3(args []string) error {
+	flags := flag.NewFlagSet("fakes3", flag.ContinueOnError)
+	addr := flags.String("addr", "localhost:9000", "address to listen on")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	log.Printf("Fake S3 listening on http://%s, nothing is persisted", *addr)
+	return http.ListenAndServe(*addr, s3fake.New())
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+const (
+	// Frames with an average luma (0-255) below this count as black, e.g.
+	// fade-ins and title cards.
+	blackFrameLuma = 24
+	// maxFrameAttempts bounds how many frames are decoded looking for one
+	// that isn't black.
+	maxFrameAttempts = 6
+)
+
+var errNoFrame = errors.New("no frame at that timestamp")
+
+// extractFrame grabs the frame at t seconds as a JPEG.
+func extractFrame(ctx context.Context, filePath string, t float64) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "ffmpeg",
+		"-v", "error",
+		"-ss", strconv.FormatFloat(t, 'f', 3, 64),
+		"-i", filePath,
+		"-frames:v", "1",
+		"-f", "image2pipe",
+		"-c:v", "mjpeg",
+		"-q:v", "2",
+		"pipe:1",
+	)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	if stdout.Len() == 0 {
+		return nil, errNoFrame
+	}
+	return stdout.Bytes(), nil
+}
+
+// pickThumbnailFrame looks for a representative frame, starting at offset and
+// stepping through the video until it finds one that isn't black. If every
+// candidate is dark it settles for the brightest.
+func pickThumbnailFrame(ctx context.Context, filePath string, offset time.Duration) ([]byte, error) {
+	probe, err := probeMedia(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't probe video: %w", err)
+	}
+	duration := probe.duration()
+	start := offset.Seconds()
+	if start >= duration {
+		start = duration / 3
+	}
+	step := max(1, duration/10)
+
+	var best []byte
+	bestLuma := -1.0
+	for i := 0; i < maxFrameAttempts; i++ {
+		t := start + float64(i)*step
+		if t >= duration {
+			break
+		}
+		frame, err := extractFrame(ctx, filePath, t)
+		if errors.Is(err, errNoFrame) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		img, err := jpeg.Decode(bytes.NewReader(frame))
+		if err != nil {
+			return nil, err
+		}
+		luma := averageLuma(img)
+		if luma >= blackFrameLuma {
+			return frame, nil
+		}
+		if luma > bestLuma {
+			best, bestLuma = frame, luma
+		}
+	}
+	if best == nil {
+		return nil, errNoFrame
+	}
+	return best, nil
+}
+
+// averageLuma estimates the brightness of img from a grid of samples.
+func averageLuma(img image.Image) float64 {
+	const grid = 32
+	b := img.Bounds()
+	if b.Empty() {
+		return 0
+	}
+	var total float64
+	var n int
+	for y := b.Min.Y; y < b.Max.Y; y += max(1, b.Dy()/grid) {
+		for x := b.Min.X; x < b.Max.X; x += max(1, b.Dx()/grid) {
+			r, g, bl, _ := img.At(x, y).RGBA()
+			total += (0.299*float64(r) + 0.587*float64(g) + 0.114*float64(bl)) / 257
+			n++
+		}
+	}
+	return total / float64(n)
+}
+
+// generateThumbnail gives a video without a thumbnail one taken from its
+// own frames.
+func (cfg *apiConfig) generateThumbnail(ctx context.Context, video database.Video, filePath string) (database.Video, error) {
+	frame, err := pickThumbnailFrame(ctx, filePath, cfg.thumbnailFrameOffset)
+	if err != nil {
+		return database.Video{}, err
+	}
+	return cfg.saveThumbnail(ctx, video, bytes.NewReader(frame), "image/jpeg")
+}
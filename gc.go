@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+)
+
+// videoKeyPrefixes are where storeVideo puts videos, by aspect ratio, and
+// where direct uploads are staged. Abandoned staged uploads are orphans.
+var videoKeyPrefixes = []string{"landscape/", "portrait/", "other/", stagingPrefix}
+
+// storeRefs is what the database references in one store.
+type storeRefs struct {
+	keys     map[string]bool
+	prefixes []string
+}
+
+func (r *storeRefs) references(key string) bool {
+	if r.keys[key] {
+		return true
+	}
+	for _, prefix := range r.prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// runGC implements `tubely gc`. It reconciles the stores with the videos
+// table: objects nothing references are orphans, references to objects that
+// don't exist are reported as missing. Orphans are only deleted with -delete,
+// and only once they're older than the grace period, so uploads that haven't
+// reached the database yet are left alone.
+func (cfg *apiConfig) runGC(ctx context.Context, out io.Writer, args []string) error {
+	flags := flag.NewFlagSet("gc", flag.ContinueOnError)
+	deleteOrphans := flags.Bool("delete", false, "delete orphaned objects instead of only reporting them")
+	grace := flags.Duration("grace", 24*time.Hour, "leave orphans younger than this alone")
+	flags.SetOutput(out)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	videos, err := cfg.db.GetAllVideos()
+	if err != nil {
+		return fmt.Errorf("couldn't get videos: %w", err)
+	}
+
+	// With the local backend both names point at the same store, so refs
+	// are kept per store rather than per name.
+	refs := map[storage.BlobStore]*storeRefs{}
+	for _, store := range []storage.BlobStore{cfg.videoStore, cfg.thumbnailStore} {
+		if refs[store] == nil {
+			refs[store] = &storeRefs{keys: map[string]bool{}}
+		}
+	}
+
+	fmt.Fprintln(out, "Missing objects:")
+	missing := 0
+	for _, video := range videos {
+		// Replaced media is still referenced until its retention ends.
+		retained, err := cfg.retainedVersionObjects(video.ID)
+		if err != nil {
+			return fmt.Errorf("couldn't get versions of video %s: %w", video.ID, err)
+		}
+		for _, obj := range appendObjects(cfg.videoObjects(video), retained...) {
+			store, err := cfg.blobStore(obj.Store)
+			if err != nil {
+				return err
+			}
+			r := refs[store]
+			if obj.Prefix {
+				r.prefixes = append(r.prefixes, obj.Key)
+			} else {
+				r.keys[obj.Key] = true
+			}
+
+			readStore, err := cfg.objectStore(obj)
+			if err != nil {
+				return err
+			}
+			exists, err := objectExists(ctx, readStore, obj)
+			if err != nil {
+				return fmt.Errorf("couldn't check %s object %s: %w", obj.Store, obj.Key, err)
+			}
+			if !exists {
+				missing++
+				fmt.Fprintf(out, "  video %s: %s object %s\n", video.ID, obj.Store, obj.Key)
+			}
+		}
+	}
+
+	fmt.Fprintln(out, "Orphaned objects:")
+	cutoff := time.Now().Add(-*grace)
+	var orphans, young, deleted int
+	var orphanBytes int64
+	listed := map[storage.BlobStore]bool{}
+	for _, source := range []struct {
+		name     string
+		store    storage.BlobStore
+		prefixes []string
+	}{
+		{videoStoreName, cfg.videoStore, videoKeyPrefixes},
+		{thumbnailStoreName, cfg.thumbnailStore, []string{""}},
+	} {
+		if listed[source.store] {
+			continue
+		}
+		if cfg.videoStore == cfg.thumbnailStore {
+			// The assets directory already holds everything.
+			source.prefixes = []string{""}
+		}
+		listed[source.store] = true
+
+		for _, prefix := range source.prefixes {
+			objects, err := source.store.List(ctx, prefix)
+			if err != nil {
+				return fmt.Errorf("couldn't list %s store: %w", source.name, err)
+			}
+			for _, o := range objects {
+				if refs[source.store].references(o.Key) {
+					continue
+				}
+				if o.LastModified.After(cutoff) {
+					young++
+					continue
+				}
+				orphans++
+				orphanBytes += o.Size
+				fmt.Fprintf(out, "  %s object %s (%d bytes, modified %s)\n", source.name, o.Key, o.Size, o.LastModified.Format(time.RFC3339))
+				if !*deleteOrphans {
+					continue
+				}
+				err := cfg.deleteObject(ctx, storedObject{Store: source.name, Key: o.Key})
+				if err != nil {
+					fmt.Fprintf(out, "    couldn't delete: %v\n", err)
+					continue
+				}
+				deleted++
+			}
+		}
+	}
+
+	// Released blobs whose deletion never finished keep their content from
+	// being stored again.
+	fmt.Fprintln(out, "Released blobs:")
+	blobs, err := cfg.db.GetReleasedBlobs()
+	if err != nil {
+		return fmt.Errorf("couldn't get released blobs: %w", err)
+	}
+	forgotten := 0
+	for _, blob := range blobs {
+		fmt.Fprintf(out, "  %s (created %s)\n", blob.Key, blob.CreatedAt.Format(time.RFC3339))
+		if !*deleteOrphans {
+			continue
+		}
+		var errs []error
+		for _, obj := range cfg.blobObjects(blob) {
+			errs = append(errs, cfg.deleteObject(ctx, obj))
+		}
+		err := errors.Join(errs...)
+		if err == nil {
+			err = cfg.db.ForgetBlob(blob.Key)
+		}
+		if err != nil {
+			fmt.Fprintf(out, "    couldn't delete: %v\n", err)
+			continue
+		}
+		forgotten++
+	}
+
+	// Resumable uploads abandoned before they were complete. Their files
+	// are in this server's uploads directory.
+	fmt.Fprintln(out, "Expired uploads:")
+	uploads, err := cfg.db.GetExpiredUploads(time.Now().Add(-cfg.uploadExpiry))
+	if err != nil {
+		return fmt.Errorf("couldn't get expired uploads: %w", err)
+	}
+	removed := 0
+	for _, upload := range uploads {
+		fmt.Fprintf(out, "  %s of video %s (%d of %d bytes, last written %s)\n",
+			upload.ID, upload.VideoID, upload.Offset, upload.Length, upload.UpdatedAt.Format(time.RFC3339))
+		if !*deleteOrphans {
+			continue
+		}
+		err := cfg.db.DeleteUpload(upload.ID)
+		if err == nil {
+			err = os.Remove(cfg.uploadPath(upload.ID))
+			if errors.Is(err, fs.ErrNotExist) {
+				err = nil
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(out, "    couldn't delete: %v\n", err)
+			continue
+		}
+		removed++
+	}
+
+	// Multipart uploads never completed nor aborted: direct uploads given
+	// up on, or our own uploads whose abort failed. S3 keeps (and bills
+	// for) their parts until they're aborted. Once the presigned URLs have
+	// expired, nobody is going to finish them.
+	fmt.Fprintln(out, "Incomplete multipart uploads:")
+	var multipartUploads []storage.MultipartUpload
+	aborted := 0
+	if uploader, ok := cfg.videoStore.(storage.DirectUploader); ok {
+		listed, err := uploader.ListMultipartUploads(ctx, "")
+		if err != nil {
+			return fmt.Errorf("couldn't list multipart uploads: %w", err)
+		}
+		cutoff := time.Now().Add(-cfg.directUploadExpiry)
+		for _, upload := range listed {
+			if upload.Initiated.After(cutoff) {
+				continue
+			}
+			multipartUploads = append(multipartUploads, upload)
+			fmt.Fprintf(out, "  %s of %s (started %s)\n", upload.UploadID, upload.Key, upload.Initiated.Format(time.RFC3339))
+			if !*deleteOrphans {
+				continue
+			}
+			err := uploader.AbortMultipartUpload(ctx, upload.Key, upload.UploadID)
+			if err != nil && !errors.Is(err, storage.ErrNotFound) {
+				fmt.Fprintf(out, "    couldn't abort: %v\n", err)
+				continue
+			}
+			aborted++
+		}
+	}
+
+	printGCSummary(out, gcSummary{
+		missing:        missing,
+		orphans:        orphans,
+		orphanBytes:    orphanBytes,
+		young:          young,
+		deleted:        deleted,
+		released:       len(blobs),
+		forgotten:      forgotten,
+		expiredUploads: len(uploads),
+		deletedUploads: removed,
+		multipart:      len(multipartUploads),
+		aborted:        aborted,
+	}, *deleteOrphans, *grace)
+	return nil
+}
+
+// gcSummary counts what runGC found and deleted.
+type gcSummary struct {
+	missing, orphans, young, deleted int
+	orphanBytes                      int64
+	released, forgotten              int
+	expiredUploads, deletedUploads   int
+	multipart, aborted               int
+}
+
+func objectExists(ctx context.Context, store storage.BlobStore, obj storedObject) (bool, error) {
+	if obj.Prefix {
+		objects, err := store.List(ctx, obj.Key)
+		return len(objects) > 0, err
+	}
+	_, err := store.Stat(ctx, obj.Key)
+	if errors.Is(err, storage.ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func printGCSummary(out io.Writer, sum gcSummary, deleteOrphans bool, grace time.Duration) {
+	fmt.Fprintf(out, "\n%d missing objects referenced by the database\n", sum.missing)
+	fmt.Fprintf(out, "%d orphaned objects (%d bytes)\n", sum.orphans, sum.orphanBytes)
+	fmt.Fprintf(out, "%d unreferenced objects younger than %s skipped\n", sum.young, grace)
+	fmt.Fprintf(out, "%d released blobs not deleted yet\n", sum.released)
+	fmt.Fprintf(out, "%d expired uploads\n", sum.expiredUploads)
+	fmt.Fprintf(out, "%d incomplete multipart uploads\n", sum.multipart)
+	if deleteOrphans {
+		fmt.Fprintf(out, "%d orphaned objects deleted\n", sum.deleted)
+		fmt.Fprintf(out, "%d released blobs deleted\n", sum.forgotten)
+		fmt.Fprintf(out, "%d expired uploads deleted\n", sum.deletedUploads)
+		fmt.Fprintf(out, "%d incomplete multipart uploads aborted\n", sum.aborted)
+	} else if sum.orphans > 0 || sum.released > 0 || sum.expiredUploads > 0 || sum.multipart > 0 {
+		fmt.Fprintln(out, "Dry run, rerun with -delete to remove the orphans")
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+// runGC runs `tubely gc` with args and returns what it printed.
+func (api *testAPI) runGC(t *testing.T, args ...string) string {
+	t.Helper()
+	var out bytes.Buffer
+	if err := api.cfg.runGC(context.Background(), &out, args); err != nil {
+		t.Fatalf("gc %v: %v\n%s", args, err, out.String())
+	}
+	return out.String()
+}
+
+func wantOutput(t *testing.T, out string, lines ...string) {
+	t.Helper()
+	for _, line := range lines {
+		if !strings.Contains(out, line) {
+			t.Errorf("gc output doesn't have %q:\n%s", line, out)
+		}
+	}
+}
+
+func TestGC(t *testing.T) {
+	api := newTestAPI(t)
+	ctx := context.Background()
+	user, _ := api.createUser(t, "owner@example.com")
+	video := storeTestVideo(t, api, api.createVideo(t, user.ID), []byte("video"))
+	broken := api.createVideo(t, user.ID)
+	missingKey := "landscape/missing.mp4"
+	broken.VideoURL = &missingKey
+	if err := api.db.UpdateVideo(broken); err != nil {
+		t.Fatal(err)
+	}
+
+	orphans := []struct {
+		store storage.BlobStore
+		key   string
+	}{
+		{api.cfg.videoStore, "landscape/orphan.mp4"},
+		{api.cfg.videoStore, stagingKeyPrefix(video.ID) + "abandoned"},
+		{api.cfg.thumbnailStore, uuid.NewString() + "/640w.jpg"},
+	}
+	for _, o := range orphans {
+		if err := o.store.Put(ctx, o.key, strings.NewReader("orphan"), "application/octet-stream"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	referenced := []struct {
+		store storage.BlobStore
+		key   string
+	}{
+		{api.cfg.videoStore, *video.VideoURL},
+		{api.cfg.videoStore, *video.HLSURL},
+		{api.cfg.thumbnailStore, *video.ThumbnailURL},
+	}
+
+	// Within the grace period nothing is an orphan yet.
+	out := api.runGC(t, "-delete")
+	wantOutput(t, out, "3 unreferenced objects younger than 24h0m0s skipped", "0 orphaned objects deleted")
+
+	out = api.runGC(t, "-grace", "0s")
+	wantOutput(t, out,
+		"video "+broken.ID.String()+": video object "+missingKey,
+		"1 missing objects",
+		"3 orphaned objects",
+		"Dry run",
+	)
+	for _, o := range orphans {
+		wantOutput(t, out, o.key)
+		wantStored(t, o.store, o.key, true)
+	}
+
+	out = api.runGC(t, "-delete", "-grace", "0s")
+	wantOutput(t, out, "3 orphaned objects deleted")
+	for _, o := range orphans {
+		wantStored(t, o.store, o.key, false)
+	}
+	for _, o := range referenced {
+		wantStored(t, o.store, o.key, true)
+	}
+}
+
+func TestGCRetainedVersions(t *testing.T) {
+	api := newTestAPI(t)
+	user, _ := api.createUser(t, "owner@example.com")
+	first := storeTestVideo(t, api, api.createVideo(t, user.ID), []byte("video"))
+	// The replaced media is kept for rollbacks until its retention ends.
+	storeTestVideo(t, api, first, []byte("newer video"))
+
+	out := api.runGC(t, "-delete", "-grace", "0s")
+	wantOutput(t, out, "0 missing objects", "0 orphaned objects")
+	wantStored(t, api.cfg.videoStore, *first.VideoURL, true)
+	wantStored(t, api.cfg.videoStore, *first.HLSURL, true)
+}
+
+func TestGCMultipartUploads(t *testing.T) {
+	api := newTestAPI(t)
+	ctx := context.Background()
+	user, token := api.createUser(t, "owner@example.com")
+	video := api.createVideo(t, user.ID)
+	uploader := api.cfg.videoStore.(storage.DirectUploader)
+
+	// One direct upload the client gave up on, and one of our own that
+	// couldn't be aborted.
+	direct := api.createDirectUpload(t, video, token, directUploadPartSize+1)
+	if _, err := uploader.CreateMultipartUpload(ctx, "landscape/leaked.mp4", "video/mp4"); err != nil {
+		t.Fatal(err)
+	}
+	wantUploads := func(n int) {
+		t.Helper()
+		uploads, err := uploader.ListMultipartUploads(ctx, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(uploads) != n {
+			t.Errorf("%d multipart uploads left, want %d: %+v", len(uploads), n, uploads)
+		}
+	}
+
+	// Their URLs haven't expired yet.
+	out := api.runGC(t, "-delete")
+	wantOutput(t, out, "0 incomplete multipart uploads aborted")
+	wantUploads(2)
+
+	api.cfg.directUploadExpiry = -time.Second
+	out = api.runGC(t)
+	wantOutput(t, out, direct.UploadID+" of "+direct.Key, "landscape/leaked.mp4", "2 incomplete multipart uploads", "Dry run")
+	wantUploads(2)
+
+	out = api.runGC(t, "-delete")
+	wantOutput(t, out, "2 incomplete multipart uploads aborted")
+	wantUploads(0)
+}
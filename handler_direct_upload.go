@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+const (
+	// stagingPrefix is where clients upload to directly. Nothing under it is
+	// served; completed uploads are processed into their final key.
+	stagingPrefix = "staging/"
+	// Uploads larger than directUploadPartSize are split into parts of
+	// this size, each with its own presigned URL.
+	directUploadPartSize = 64 << 20
+)
+
+func stagingKeyPrefix(videoID uuid.UUID) string {
+	return stagingPrefix + videoID.String() + "/"
+}
+
+func (cfg *apiConfig) handlerDirectUploadCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		MediaType string `json:"media_type"`
+		Size      int64  `json:"size"`
+	}
+	type uploadPart struct {
+		PartNumber int32 `json:"part_number"`
+		storage.PresignedRequest
+	}
+	type response struct {
+		Key       string    `json:"key"`
+		ExpiresAt time.Time `json:"expires_at"`
+		// URL is set for single request uploads: PUT the file to it with
+		// the same Content-Type and the given headers.
+		URL     string            `json:"url,omitempty"`
+		Headers map[string]string `json:"headers,omitempty"`
+		// Multipart uploads PUT each PartSize chunk to its part's URL,
+		// with its headers, and send back the ETags to upload-complete.
+		UploadID string       `json:"upload_id,omitempty"`
+		PartSize int64        `json:"part_size,omitempty"`
+		Parts    []uploadPart `json:"parts,omitempty"`
+	}
+
+	video, ok := cfg.getOwnedVideo(w, r)
+	if !ok {
+		return
+	}
+	uploader, ok := cfg.videoStore.(storage.DirectUploader)
+	if !ok {
+		respondWithError(w, http.StatusNotImplemented, "Direct uploads need the s3 storage backend", nil)
+		return
+	}
+
+	params := parameters{}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if !slices.Contains(cfg.allowedVideoTypes, params.MediaType) {
+		respondWithError(w, http.StatusBadRequest, "Unsupported video type "+params.MediaType, nil)
+		return
+	}
+	if params.Size < 1 {
+		respondWithError(w, http.StatusBadRequest, "size must be the file's size in bytes", nil)
+		return
+	}
+	if params.Size > maxVideoUploadSize {
+		respondWithError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Videos can be at most %d bytes", maxVideoUploadSize), nil)
+		return
+	}
+
+	randBytes := make([]byte, 16)
+	_, err = rand.Read(randBytes)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Something went wrong", err)
+		return
+	}
+	key := stagingKeyPrefix(video.ID) + base64.RawURLEncoding.EncodeToString(randBytes)
+	resp := response{
+		Key:       key,
+		ExpiresAt: time.Now().Add(cfg.directUploadExpiry).UTC(),
+	}
+
+	if params.Size <= directUploadPartSize {
+		req, err := uploader.PresignPut(r.Context(), key, params.MediaType, params.Size, cfg.directUploadExpiry)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't create upload URL", err)
+			return
+		}
+		resp.URL, resp.Headers = req.URL, req.Header
+		respondWithJSON(w, http.StatusCreated, resp)
+		return
+	}
+
+	resp.UploadID, err = uploader.CreateMultipartUpload(r.Context(), key, params.MediaType)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't start upload", err)
+		return
+	}
+	resp.PartSize = directUploadPartSize
+	partCount := (params.Size + directUploadPartSize - 1) / directUploadPartSize
+	for n := int32(1); int64(n) <= partCount; n++ {
+		req, err := uploader.PresignUploadPart(r.Context(), key, resp.UploadID, n, cfg.directUploadExpiry)
+		if err != nil {
+			uploader.AbortMultipartUpload(r.Context(), key, resp.UploadID)
+			respondWithError(w, http.StatusInternalServerError, "Couldn't create upload URL", err)
+			return
+		}
+		resp.Parts = append(resp.Parts, uploadPart{PartNumber: n, PresignedRequest: req})
+	}
+	respondWithJSON(w, http.StatusCreated, resp)
+}
+
+// handlerDirectUploadComplete takes over an object the client uploaded to
+// the staging area: it's downloaded, checked and queued for processing like
+// any other upload, which stores it under its final key.
+func (cfg *apiConfig) handlerDirectUploadComplete(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Key      string                  `json:"key"`
+		UploadID string                  `json:"upload_id"`
+		Parts    []storage.CompletedPart `json:"parts"`
+	}
+
+	video, ok := cfg.getOwnedVideo(w, r)
+	if !ok {
+		return
+	}
+	uploader, ok := cfg.videoStore.(storage.DirectUploader)
+	if !ok {
+		respondWithError(w, http.StatusNotImplemented, "Direct uploads need the s3 storage backend", nil)
+		return
+	}
+
+	params := parameters{}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	// Keys are scoped to the video, so one user can't claim another's
+	// upload.
+	if !strings.HasPrefix(params.Key, stagingKeyPrefix(video.ID)) {
+		respondWithError(w, http.StatusBadRequest, "Key isn't an upload for this video", nil)
+		return
+	}
+
+	if params.UploadID != "" {
+		err = uploader.CompleteMultipartUpload(r.Context(), params.Key, params.UploadID, params.Parts)
+		if errors.Is(err, storage.ErrNotFound) {
+			respondWithError(w, http.StatusBadRequest, "Upload not found", err)
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Couldn't complete the upload", err)
+			return
+		}
+	}
+
+	info, err := cfg.videoStore.Stat(r.Context(), params.Key)
+	if errors.Is(err, storage.ErrNotFound) {
+		respondWithError(w, http.StatusBadRequest, "Nothing has been uploaded to that key", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check the upload", err)
+		return
+	}
+	// The staging object is of no use after this, whatever the outcome,
+	// even if the client has gone away.
+	defer func() {
+		if err := cfg.videoStore.Delete(context.WithoutCancel(r.Context()), params.Key); err != nil {
+			log.Printf("Couldn't delete staged upload %s: %v", params.Key, err)
+		}
+	}()
+	if info.Size > maxVideoUploadSize {
+		respondWithError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Videos can be at most %d bytes", maxVideoUploadSize), nil)
+		return
+	}
+	if !slices.Contains(cfg.allowedVideoTypes, info.ContentType) {
+		respondWithError(w, http.StatusBadRequest, "Unsupported video type "+info.ContentType, nil)
+		return
+	}
+
+	body, err := cfg.videoStore.Get(r.Context(), params.Key)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read the upload", err)
+		return
+	}
+	defer body.Close()
+	uploadFile, err := os.CreateTemp(cfg.uploadsRoot, "tubely-upload-*")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Something went wrong", err)
+		return
+	}
+	defer uploadFile.Close()
+	_, err = io.Copy(uploadFile, body)
+	if err != nil {
+		removeFile(uploadFile.Name())
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read the upload", err)
+		return
+	}
+
+	err = cfg.checkUploadedVideo(uploadFile.Name(), info.ContentType)
+	if err != nil {
+		removeFile(uploadFile.Name())
+		respondWithVideoCheckError(w, err)
+		return
+	}
+	err = cfg.enqueueVideoProcessing(video.ID, uploadFile.Name(), info.ContentType)
+	if errors.Is(err, database.ErrNotFound) {
+		removeFile(uploadFile.Name())
+		respondWithError(w, http.StatusNotFound, "Video not found", err)
+		return
+	}
+	if err != nil {
+		removeFile(uploadFile.Name())
+		respondWithError(w, http.StatusInternalServerError, "Couldn't queue video for processing", err)
+		return
+	}
+	video, err = cfg.db.GetVideo(video.ID)
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, http.StatusNotFound, "Video not found", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	cfg.respondWithVideo(w, r, http.StatusAccepted, video)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+)
+
+type directUploadResponse struct {
+	Key      string            `json:"key"`
+	URL      string            `json:"url"`
+	Headers  map[string]string `json:"headers"`
+	UploadID string            `json:"upload_id"`
+	PartSize int64             `json:"part_size"`
+	Parts    []struct {
+		PartNumber int32 `json:"part_number"`
+		storage.PresignedRequest
+	} `json:"parts"`
+}
+
+// createDirectUpload asks for upload URLs for a video file of the size.
+func (api *testAPI) createDirectUpload(t *testing.T, video database.Video, token string, size int) directUploadResponse {
+	t.Helper()
+	params, err := json.Marshal(map[string]any{"media_type": "video/mp4", "size": size})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := api.do(http.MethodPost, "/api/videos/"+video.ID.String()+"/upload-url", token, bytes.NewReader(params), nil)
+	wantStatus(t, w, http.StatusCreated)
+	return decodeResponse[directUploadResponse](t, w)
+}
+
+func (api *testAPI) completeDirectUpload(t *testing.T, video database.Video, token string, params any) *http.Response {
+	t.Helper()
+	body, err := json.Marshal(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return api.do(http.MethodPost, "/api/videos/"+video.ID.String()+"/upload-complete", token, bytes.NewReader(body), nil).Result()
+}
+
+// putPresigned uploads data the way a browser does, straight to the bucket,
+// and returns the ETag.
+func putPresigned(t *testing.T, req storage.PresignedRequest, data []byte) string {
+	t.Helper()
+	put, err := http.NewRequest(http.MethodPut, req.URL, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, value := range req.Header {
+		put.Header.Set(name, value)
+	}
+	resp, err := http.DefaultClient.Do(put)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("PUT to the presigned URL: %s", resp.Status)
+	}
+	return resp.Header.Get("ETag")
+}
+
+// wantNoStagedUploads fails the test if anything is left in the staging
+// area.
+func (api *testAPI) wantNoStagedUploads(t *testing.T) {
+	t.Helper()
+	staged, err := api.cfg.videoStore.List(context.Background(), stagingPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, obj := range staged {
+		t.Errorf("staged upload %s was left behind", obj.Key)
+	}
+}
+
+func TestDirectUpload(t *testing.T) {
+	data := testVideoFile(t)
+	api := newTestAPI(t)
+	user, token := api.createUser(t, "owner@example.com")
+	video := api.createVideo(t, user.ID)
+
+	upload := api.createDirectUpload(t, video, token, len(data))
+	if upload.URL == "" || !strings.HasPrefix(upload.URL, api.s3+"/"+testBucket+"/"+stagingKeyPrefix(video.ID)) {
+		t.Fatalf("upload URL = %q, want one into the video's staging area", upload.URL)
+	}
+	putPresigned(t, storage.PresignedRequest{URL: upload.URL, Header: upload.Headers}, data)
+
+	resp := api.completeDirectUpload(t, video, token, map[string]string{"key": upload.Key})
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("upload-complete: %s", resp.Status)
+	}
+	api.wantNoStagedUploads(t)
+
+	if n := api.runJobs(t); n != 1 {
+		t.Fatalf("ran %d jobs, want 1", n)
+	}
+	video, err := api.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if video.Status != database.VideoStatusReady || video.VideoURL == nil {
+		t.Fatalf("processed video is %q at %v", video.Status, video.VideoURL)
+	}
+	if _, err := api.cfg.videoStore.Stat(context.Background(), *video.VideoURL); err != nil {
+		t.Errorf("processed video isn't in the bucket: %v", err)
+	}
+	wantEmptyDir(t, api.cfg.uploadsRoot)
+}
+
+func TestDirectUploadMultipart(t *testing.T) {
+	api := newTestAPI(t)
+	user, token := api.createUser(t, "owner@example.com")
+	video := api.createVideo(t, user.ID)
+
+	upload := api.createDirectUpload(t, video, token, directUploadPartSize+1)
+	if upload.UploadID == "" || upload.PartSize != directUploadPartSize || len(upload.Parts) != 2 {
+		t.Fatalf("got upload %q with %d parts of %d bytes, want 2 parts of %d bytes",
+			upload.UploadID, len(upload.Parts), upload.PartSize, directUploadPartSize)
+	}
+	// The bucket doesn't check part sizes, so this stands in for a large
+	// file. It isn't a video, which is only found out once it's complete.
+	parts := []storage.CompletedPart{}
+	for i, chunk := range []string{"not a ", "video"} {
+		etag := putPresigned(t, upload.Parts[i].PresignedRequest, []byte(chunk))
+		parts = append(parts, storage.CompletedPart{PartNumber: upload.Parts[i].PartNumber, ETag: etag})
+	}
+
+	resp := api.completeDirectUpload(t, video, token, map[string]any{
+		"key":       upload.Key,
+		"upload_id": upload.UploadID,
+		"parts":     parts,
+	})
+	if resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Fatalf("upload-complete of a file that isn't a video: %s", resp.Status)
+	}
+	api.wantNoStagedUploads(t)
+	if n := api.runJobs(t); n != 0 {
+		t.Errorf("a rejected upload queued %d jobs", n)
+	}
+	wantEmptyDir(t, api.cfg.uploadsRoot)
+}
+
+func TestDirectUploadRejected(t *testing.T) {
+	api := newTestAPI(t)
+	owner, ownerToken := api.createUser(t, "owner@example.com")
+	_, otherToken := api.createUser(t, "other@example.com")
+	video := api.createVideo(t, owner.ID)
+	otherVideo := api.createVideo(t, owner.ID)
+
+	params, _ := json.Marshal(map[string]any{"media_type": "video/mp4", "size": 1})
+	w := api.do(http.MethodPost, "/api/videos/"+video.ID.String()+"/upload-url", otherToken, bytes.NewReader(params), nil)
+	wantStatus(t, w, http.StatusForbidden)
+
+	// Uploaded for another video.
+	upload := api.createDirectUpload(t, otherVideo, ownerToken, 1)
+	// S3 refuses a body of any other size than the one signed in.
+	if upload.Headers["Content-Length"] != "1" {
+		t.Errorf("upload headers %v don't hold the declared size", upload.Headers)
+	}
+	putPresigned(t, storage.PresignedRequest{URL: upload.URL, Header: upload.Headers}, []byte("x"))
+	resp := api.completeDirectUpload(t, video, ownerToken, map[string]string{"key": upload.Key})
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("upload-complete with another video's key: %s", resp.Status)
+	}
+
+	// Never uploaded.
+	upload = api.createDirectUpload(t, video, ownerToken, 1)
+	resp = api.completeDirectUpload(t, video, ownerToken, map[string]string{"key": upload.Key})
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("upload-complete before uploading: %s", resp.Status)
+	}
+}
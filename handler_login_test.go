@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestLogin(t *testing.T) {
+	api := newTestAPI(t)
+	api.createUser(t, "owner@example.com")
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"correct", `{"email": "owner@example.com", "password": "password"}`, http.StatusOK},
+		{"wrong password", `{"email": "owner@example.com", "password": "wrong"}`, http.StatusUnauthorized},
+		{"unknown email", `{"email": "nobody@example.com", "password": "password"}`, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wantStatus(t, api.do(http.MethodPost, "/api/login", "", strings.NewReader(tt.body), nil), tt.status)
+		})
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	api := newTestAPI(t)
+	api.createUser(t, "owner@example.com")
+	w := api.do(http.MethodPost, "/api/login", "", strings.NewReader(`{"email": "owner@example.com", "password": "password"}`), nil)
+	wantStatus(t, w, http.StatusOK)
+	login := decodeResponse[struct {
+		RefreshToken string `json:"refresh_token"`
+	}](t, w)
+
+	wantStatus(t, api.do(http.MethodPost, "/api/refresh", login.RefreshToken, nil, nil), http.StatusOK)
+	wantStatus(t, api.do(http.MethodPost, "/api/refresh", "unknown", nil, nil), http.StatusUnauthorized)
+}
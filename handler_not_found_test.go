@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestMissingVideo(t *testing.T) {
+	api := newTestAPI(t)
+	user, token := api.createUser(t, "owner@example.com")
+	video := api.createVideo(t, user.ID)
+	missing := "/api/videos/" + uuid.NewString()
+	tus := http.Header{"Tus-Resumable": {tusVersion}}
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		// body makes the request, which otherwise fails before the video
+		// is looked up.
+		body func() (io.Reader, http.Header)
+	}{
+		{
+			name:   "upload video",
+			method: http.MethodPost,
+			target: "/api/video_upload/" + uuid.NewString(),
+			body: func() (io.Reader, http.Header) {
+				return multipartFile(t, "video", "video/mp4", []byte("not a video"))
+			},
+		},
+		{
+			name:   "upload thumbnail",
+			method: http.MethodPost,
+			target: "/api/thumbnail_upload/" + uuid.NewString(),
+			body: func() (io.Reader, http.Header) {
+				return multipartFile(t, "thumbnail", "image/png", testPNG(t))
+			},
+		},
+		{name: "thumbnail from frame", method: http.MethodPost, target: missing + "/thumbnail/from-frame?t=1"},
+		{name: "delete", method: http.MethodDelete, target: missing},
+		{name: "get", method: http.MethodGet, target: missing},
+		{name: "versions", method: http.MethodGet, target: missing + "/versions"},
+		{name: "rollback", method: http.MethodPost, target: missing + "/versions/1/rollback"},
+		{name: "rollback to a missing version", method: http.MethodPost, target: "/api/videos/" + video.ID.String() + "/versions/1/rollback"},
+		{
+			name:   "upload URL",
+			method: http.MethodPost,
+			target: missing + "/upload-url",
+			body: func() (io.Reader, http.Header) {
+				return bytes.NewReader([]byte(`{"media_type": "video/mp4", "size": 1}`)), nil
+			},
+		},
+		{
+			name:   "upload complete",
+			method: http.MethodPost,
+			target: missing + "/upload-complete",
+			body: func() (io.Reader, http.Header) {
+				return bytes.NewReader([]byte(`{"key": "staging/x"}`)), nil
+			},
+		},
+		{
+			name:   "tus create",
+			method: http.MethodPost,
+			target: "/api/tus/videos/" + uuid.NewString(),
+			body: func() (io.Reader, http.Header) {
+				return nil, http.Header{"Tus-Resumable": {tusVersion}, "Upload-Length": {"1"}}
+			},
+		},
+		{name: "tus head", method: http.MethodHead, target: "/api/tus/uploads/" + uuid.NewString()},
+		{
+			name:   "tus patch",
+			method: http.MethodPatch,
+			target: "/api/tus/uploads/" + uuid.NewString(),
+			body: func() (io.Reader, http.Header) {
+				return bytes.NewReader([]byte("x")), http.Header{
+					"Tus-Resumable": {tusVersion},
+					"Upload-Offset": {"0"},
+					"Content-Type":  {"application/offset+octet-stream"},
+				}
+			},
+		},
+		{name: "tus delete", method: http.MethodDelete, target: "/api/tus/uploads/" + uuid.NewString()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body io.Reader
+			header := tus
+			if tt.body != nil {
+				body, header = tt.body()
+			}
+			wantStatus(t, api.do(tt.method, tt.target, token, body, header), http.StatusNotFound)
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func (cfg *apiConfig) handlerThumbnailFromFrame(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	t, err := strconv.ParseFloat(r.URL.Query().Get("t"), 64)
+	if err != nil || t < 0 {
+		respondWithError(w, http.StatusBadRequest, "t must be a timestamp in seconds", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, http.StatusNotFound, "Video not found", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "You are not the owner of this video", nil)
+		return
+	}
+	if video.VideoURL == nil {
+		respondWithError(w, http.StatusConflict, "Video has no uploaded media yet", nil)
+		return
+	}
+
+	videoPath, err := cfg.downloadVideo(r.Context(), *video.VideoURL, video.Encryption)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video media", err)
+		return
+	}
+	defer os.Remove(videoPath)
+
+	probe, err := probeMedia(videoPath)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read video media", err)
+		return
+	}
+	duration := probe.duration()
+	if t >= duration {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("t must be less than the video's duration of %.3f seconds", duration), nil)
+		return
+	}
+	frame, err := extractFrame(r.Context(), videoPath, t)
+	if errors.Is(err, errNoFrame) {
+		respondWithError(w, http.StatusBadRequest, "No frame at that timestamp", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't extract frame", err)
+		return
+	}
+
+	video, err = cfg.saveThumbnail(r.Context(), video, bytes.NewReader(frame), "image/jpeg")
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, http.StatusNotFound, "Video not found", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save the thumbnail", err)
+		return
+	}
+	cfg.respondWithVideo(w, r, http.StatusOK, video)
+}
+
+// downloadVideo copies a stored video to a temporary file for ffmpeg. The
+// caller removes the file.
+func (cfg *apiConfig) downloadVideo(ctx context.Context, videoRef, encryption string) (string, error) {
+	key, ok := cfg.urls.Key(videoStoreName, videoRef)
+	if !ok {
+		return "", fmt.Errorf("%s isn't in the video store", videoRef)
+	}
+	store, err := cfg.encryptedVideoStore(encryption)
+	if err != nil {
+		return "", err
+	}
+	body, err := store.Get(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	f, err := os.CreateTemp("", "tubely-download-*.mp4")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, body); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// Resumable video uploads following the tus 1.0 protocol (core, creation,
+// expiration and termination extensions):
+// https://tus.io/protocols/resumable-upload
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,expiration,termination"
+)
+
+func (cfg *apiConfig) uploadPath(uploadID uuid.UUID) string {
+	return filepath.Join(cfg.uploadsRoot, uploadID.String())
+}
+
+// uploadExpiresAt is when an upload nothing is written to anymore is
+// abandoned, and `tubely gc -delete` may remove it.
+func (cfg *apiConfig) uploadExpiresAt(upload database.Upload) time.Time {
+	return upload.UpdatedAt.Add(cfg.uploadExpiry)
+}
+
+// lockUpload claims an upload for a request that writes to or deletes it,
+// reporting false if another request has it. Uploads are assembled on this
+// server's disk, so a lock in memory is enough.
+func (cfg *apiConfig) lockUpload(uploadID uuid.UUID) bool {
+	_, locked := cfg.uploadLocks.LoadOrStore(uploadID, struct{}{})
+	return !locked
+}
+
+func (cfg *apiConfig) unlockUpload(uploadID uuid.UUID) {
+	cfg.uploadLocks.Delete(uploadID)
+}
+
+func (cfg *apiConfig) handlerTusOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Max-Size", strconv.Itoa(maxVideoUploadSize))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (cfg *apiConfig) handlerTusCreate(w http.ResponseWriter, r *http.Request) {
+	if !checkTusResumable(w, r) {
+		return
+	}
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, http.StatusNotFound, "Video not found", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "You are not the owner of this video", nil)
+		return
+	}
+
+	if r.Header.Get("Upload-Length") == "" && r.Header.Get("Upload-Defer-Length") != "" {
+		respondWithError(w, http.StatusBadRequest, "Upload-Defer-Length is not supported", nil)
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		respondWithError(w, http.StatusBadRequest, "Invalid Upload-Length", err)
+		return
+	}
+	if length > maxVideoUploadSize {
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Video is too large", nil)
+		return
+	}
+
+	metadata, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid Upload-Metadata", err)
+		return
+	}
+	// The type is optional in tus; without it the content alone decides
+	// once the upload is complete.
+	mediaType := metadata["filetype"]
+	if mediaType != "" && !slices.Contains(cfg.allowedVideoTypes, mediaType) {
+		respondWithError(w, http.StatusBadRequest, "Unsupported video type "+mediaType, nil)
+		return
+	}
+
+	upload, err := cfg.db.CreateUpload(database.CreateUploadParams{
+		VideoID:   videoID,
+		UserID:    userID,
+		Length:    length,
+		MediaType: mediaType,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create upload", err)
+		return
+	}
+	f, err := os.Create(cfg.uploadPath(upload.ID))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create upload", err)
+		return
+	}
+	f.Close()
+
+	w.Header().Set("Location", "/api/tus/uploads/"+upload.ID.String())
+	w.Header().Set("Upload-Offset", "0")
+	w.Header().Set("Upload-Expires", cfg.uploadExpiresAt(upload).Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (cfg *apiConfig) handlerTusHead(w http.ResponseWriter, r *http.Request) {
+	if !checkTusResumable(w, r) {
+		return
+	}
+	upload, ok := cfg.getOwnedUpload(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	w.Header().Set("Upload-Expires", cfg.uploadExpiresAt(upload).Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (cfg *apiConfig) handlerTusPatch(w http.ResponseWriter, r *http.Request) {
+	if !checkTusResumable(w, r) {
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		respondWithError(w, http.StatusUnsupportedMediaType, "Content-Type must be application/offset+octet-stream", nil)
+		return
+	}
+	upload, ok := cfg.getOwnedUpload(w, r)
+	if !ok {
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid Upload-Offset", err)
+		return
+	}
+
+	// Nothing else writes to the file until this request is done, and the
+	// offset is checked against the upload as it is now.
+	if !cfg.lockUpload(upload.ID) {
+		respondWithError(w, http.StatusLocked, "Upload is being written to by another request", nil)
+		return
+	}
+	defer cfg.unlockUpload(upload.ID)
+	upload, err = cfg.db.GetUpload(upload.ID)
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, http.StatusNotFound, "Upload not found", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get upload", err)
+		return
+	}
+	if offset != upload.Offset {
+		respondWithError(w, http.StatusConflict, "Upload-Offset doesn't match the current offset", nil)
+		return
+	}
+
+	f, err := os.OpenFile(cfg.uploadPath(upload.ID), os.O_WRONLY, 0)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't open upload", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't open upload", err)
+		return
+	}
+
+	// Whatever arrived before a dropped connection is kept, so the client can
+	// resume from there instead of starting over.
+	n, copyErr := io.Copy(f, io.LimitReader(r.Body, upload.Length-offset))
+	if err := f.Close(); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't write upload", err)
+		return
+	}
+	updated, err := cfg.db.UpdateUploadOffset(upload.ID, offset, offset+n)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save upload offset", err)
+		return
+	}
+	if !updated {
+		respondWithError(w, http.StatusConflict, "Upload was modified concurrently", nil)
+		return
+	}
+	upload.Offset = offset + n
+	upload.UpdatedAt = time.Now()
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Expires", cfg.uploadExpiresAt(upload).Format(http.TimeFormat))
+	if copyErr != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't read upload chunk", copyErr)
+		return
+	}
+
+	if upload.Offset == upload.Length {
+		if err := cfg.checkUploadedVideo(cfg.uploadPath(upload.ID), upload.MediaType); err != nil {
+			cfg.db.DeleteUpload(upload.ID)
+			removeFile(cfg.uploadPath(upload.ID))
+			respondWithVideoCheckError(w, err)
+			return
+		}
+		err := cfg.completeUpload(upload)
+		if errors.Is(err, database.ErrNotFound) {
+			// The video was deleted, and the upload with it.
+			removeFile(cfg.uploadPath(upload.ID))
+			respondWithError(w, http.StatusNotFound, "Video not found", err)
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't queue video for processing", err)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (cfg *apiConfig) handlerTusDelete(w http.ResponseWriter, r *http.Request) {
+	if !checkTusResumable(w, r) {
+		return
+	}
+	upload, ok := cfg.getOwnedUpload(w, r)
+	if !ok {
+		return
+	}
+	if !cfg.lockUpload(upload.ID) {
+		respondWithError(w, http.StatusLocked, "Upload is being written to by another request", nil)
+		return
+	}
+	defer cfg.unlockUpload(upload.ID)
+
+	if err := cfg.db.DeleteUpload(upload.ID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete upload", err)
+		return
+	}
+	if err := os.Remove(cfg.uploadPath(upload.ID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete upload", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// completeUpload hands a fully assembled upload over to the processing queue.
+func (cfg *apiConfig) completeUpload(upload database.Upload) error {
+	err := cfg.enqueueVideoProcessing(upload.VideoID, cfg.uploadPath(upload.ID), upload.MediaType)
+	if err != nil {
+		return err
+	}
+	return cfg.db.DeleteUpload(upload.ID)
+}
+
+func (cfg *apiConfig) getOwnedUpload(w http.ResponseWriter, r *http.Request) (database.Upload, bool) {
+	uploadID, err := uuid.Parse(r.PathValue("uploadID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return database.Upload{}, false
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return database.Upload{}, false
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return database.Upload{}, false
+	}
+
+	upload, err := cfg.db.GetUpload(uploadID)
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, http.StatusNotFound, "Upload not found", err)
+		return database.Upload{}, false
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get upload", err)
+		return database.Upload{}, false
+	}
+	if upload.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "You are not the owner of this upload", nil)
+		return database.Upload{}, false
+	}
+	if time.Now().After(cfg.uploadExpiresAt(upload)) {
+		respondWithError(w, http.StatusGone, "Upload has expired", nil)
+		return database.Upload{}, false
+	}
+	return upload, true
+}
+
+func checkTusResumable(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		respondWithError(w, http.StatusPreconditionFailed, "Unsupported tus version", nil)
+		return false
+	}
+	return true
+}
+
+// parseTusMetadata decodes an Upload-Metadata header: comma separated pairs
+// of a key and an optional base64 encoded value.
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+	if header == "" {
+		return metadata, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, errors.New("empty metadata key")
+		}
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for metadata key %q: %w", key, err)
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// tusHeader is what every tus request carries, plus the given pairs.
+func tusHeader(pairs ...string) http.Header {
+	header := http.Header{"Tus-Resumable": {tusVersion}}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		header.Set(pairs[i], pairs[i+1])
+	}
+	return header
+}
+
+// createTusUpload starts an upload of length bytes and returns its URL.
+func (api *testAPI) createTusUpload(t *testing.T, video database.Video, token string, length int) string {
+	t.Helper()
+	metadata := "filetype " + base64.StdEncoding.EncodeToString([]byte("video/mp4"))
+	w := api.do(http.MethodPost, "/api/tus/videos/"+video.ID.String(), token, nil,
+		tusHeader("Upload-Length", strconv.Itoa(length), "Upload-Metadata", metadata))
+	wantStatus(t, w, http.StatusCreated)
+	if w.Header().Get("Upload-Offset") != "0" || w.Header().Get("Upload-Expires") == "" {
+		t.Errorf("create returned headers %v", w.Header())
+	}
+	location := w.Header().Get("Location")
+	if location == "" {
+		t.Fatal("create returned no Location")
+	}
+	return location
+}
+
+func (api *testAPI) patchTusUpload(location, token string, offset int, chunk []byte) *httptest.ResponseRecorder {
+	return api.do(http.MethodPatch, location, token, bytes.NewReader(chunk), tusHeader(
+		"Upload-Offset", strconv.Itoa(offset),
+		"Content-Type", "application/offset+octet-stream",
+	))
+}
+
+func (api *testAPI) tusOffset(t *testing.T, location, token string) string {
+	t.Helper()
+	w := api.do(http.MethodHead, location, token, nil, tusHeader())
+	wantStatus(t, w, http.StatusOK)
+	return w.Header().Get("Upload-Offset")
+}
+
+func uploadIDOf(t *testing.T, location string) uuid.UUID {
+	t.Helper()
+	id, err := uuid.Parse(location[len("/api/tus/uploads/"):])
+	if err != nil {
+		t.Fatalf("Location %s: %v", location, err)
+	}
+	return id
+}
+
+func TestTusResume(t *testing.T) {
+	api := newTestAPI(t)
+	user, token := api.createUser(t, "owner@example.com")
+	video := api.createVideo(t, user.ID)
+	data := []byte("not a video, in three chunks")
+
+	location := api.createTusUpload(t, video, token, len(data))
+	if got := api.tusOffset(t, location, token); got != "0" {
+		t.Errorf("offset of a new upload = %s, want 0", got)
+	}
+
+	w := api.patchTusUpload(location, token, 0, data[:10])
+	wantStatus(t, w, http.StatusNoContent)
+	if got := w.Header().Get("Upload-Offset"); got != "10" {
+		t.Errorf("PATCH returned offset %s, want 10", got)
+	}
+	// Resumed from where HEAD says it stopped.
+	if got := api.tusOffset(t, location, token); got != "10" {
+		t.Fatalf("offset after the first chunk = %s, want 10", got)
+	}
+	wantStatus(t, api.patchTusUpload(location, token, 10, data[10:20]), http.StatusNoContent)
+
+	// Sending the same chunk again doesn't match the offset anymore.
+	wantStatus(t, api.patchTusUpload(location, token, 10, data[10:20]), http.StatusConflict)
+	if got := api.tusOffset(t, location, token); got != "20" {
+		t.Errorf("offset after a conflicting PATCH = %s, want 20", got)
+	}
+
+	saved, err := os.ReadFile(api.cfg.uploadPath(uploadIDOf(t, location)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(saved, data[:20]) {
+		t.Errorf("assembled %q, want %q", saved, data[:20])
+	}
+
+	// The last chunk completes the upload, and it isn't a video.
+	wantStatus(t, api.patchTusUpload(location, token, 20, data[20:]), http.StatusUnsupportedMediaType)
+	wantStatus(t, api.do(http.MethodHead, location, token, nil, tusHeader()), http.StatusNotFound)
+	if n := api.runJobs(t); n != 0 {
+		t.Errorf("a rejected upload queued %d jobs", n)
+	}
+	wantEmptyDir(t, api.cfg.uploadsRoot)
+}
+
+func TestTusComplete(t *testing.T) {
+	data := testVideoFile(t)
+	api := newTestAPI(t)
+	user, token := api.createUser(t, "owner@example.com")
+	video := api.createVideo(t, user.ID)
+
+	location := api.createTusUpload(t, video, token, len(data))
+	half := len(data) / 2
+	wantStatus(t, api.patchTusUpload(location, token, 0, data[:half]), http.StatusNoContent)
+	wantStatus(t, api.patchTusUpload(location, token, half, data[half:]), http.StatusNoContent)
+
+	if _, err := api.db.GetUpload(uploadIDOf(t, location)); !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("GetUpload of a completed upload: %v", err)
+	}
+	video, err := api.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if video.Status != database.VideoStatusUploaded {
+		t.Errorf("status after the upload = %q, want %q", video.Status, database.VideoStatusUploaded)
+	}
+	now := time.Now()
+	job, err := api.db.ClaimJob(now, now.Add(jobLease))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job == nil || job.Kind != jobKindProcessVideo || *job.VideoID != video.ID {
+		t.Fatalf("queued job %+v, want processing of video %s", job, video.ID)
+	}
+	if next, err := api.db.ClaimJob(now, now.Add(jobLease)); err != nil || next != nil {
+		t.Errorf("queued another job %+v, %v", next, err)
+	}
+}
+
+func TestTusLocked(t *testing.T) {
+	api := newTestAPI(t)
+	user, token := api.createUser(t, "owner@example.com")
+	video := api.createVideo(t, user.ID)
+	location := api.createTusUpload(t, video, token, 10)
+	id := uploadIDOf(t, location)
+
+	// As if another PATCH were still writing.
+	if !api.cfg.lockUpload(id) {
+		t.Fatal("couldn't lock a new upload")
+	}
+	wantStatus(t, api.patchTusUpload(location, token, 0, []byte("abc")), http.StatusLocked)
+	wantStatus(t, api.do(http.MethodDelete, location, token, nil, tusHeader()), http.StatusLocked)
+	api.cfg.unlockUpload(id)
+
+	wantStatus(t, api.patchTusUpload(location, token, 0, []byte("abc")), http.StatusNoContent)
+}
+
+func TestTusExpired(t *testing.T) {
+	api := newTestAPI(t)
+	user, token := api.createUser(t, "owner@example.com")
+	video := api.createVideo(t, user.ID)
+	location := api.createTusUpload(t, video, token, 10)
+
+	api.cfg.uploadExpiry = -time.Second
+	wantStatus(t, api.do(http.MethodHead, location, token, nil, tusHeader()), http.StatusGone)
+	wantStatus(t, api.patchTusUpload(location, token, 0, []byte("abc")), http.StatusGone)
+}
+
+func TestTusTerminate(t *testing.T) {
+	api := newTestAPI(t)
+	owner, token := api.createUser(t, "owner@example.com")
+	_, otherToken := api.createUser(t, "other@example.com")
+	video := api.createVideo(t, owner.ID)
+	location := api.createTusUpload(t, video, token, 10)
+	wantStatus(t, api.patchTusUpload(location, token, 0, []byte("abc")), http.StatusNoContent)
+
+	wantStatus(t, api.do(http.MethodDelete, location, otherToken, nil, tusHeader()), http.StatusForbidden)
+	wantStatus(t, api.do(http.MethodDelete, location, token, nil, tusHeader()), http.StatusNoContent)
+	wantStatus(t, api.do(http.MethodHead, location, token, nil, tusHeader()), http.StatusNotFound)
+	wantEmptyDir(t, api.cfg.uploadsRoot)
+}
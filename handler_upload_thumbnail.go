@@ -1,16 +1,18 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"mime"
 	"net/http"
-	"os"
-	"path/filepath"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 	"github.com/google/uuid"
 )
 
@@ -34,9 +36,6 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	fmt.Println("uploading thumbnail for video", videoID, "by user", userID)
-
-	// TODO: implement the upload here
 	const maxMemory = 10 << 20 //10MB
 
 	err = r.ParseMultipartForm(maxMemory)
@@ -51,46 +50,99 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 	}
 	defer file.Close()
 	video, err := cfg.db.GetVideo(videoID)
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, http.StatusNotFound, "Video not found", err)
+		return
+	}
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
 		return
 	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "You are not the owner of this video", nil)
+		return
+	}
 	mediaType, _, err := mime.ParseMediaType(header.Header.Get("Content-Type"))
 	if err != nil {
 		respondWithError(w, http.StatusBadRequest, "Error parsing media type", err)
 		return
 	}
-	if mediaType != "image/png" && mediaType != "image/jpeg" {
+	if mediaType != "image/png" && mediaType != "image/jpeg" && mediaType != "image/gif" && mediaType != "image/webp" {
 		respondWithError(w, http.StatusBadRequest, "Invalid Image format", err)
 		return
 	}
-	ext, _ := mime.ExtensionsByType(mediaType)
-	randBytes := make([]byte, 32)
-	_, err = rand.Read(randBytes)
+	// The Content-Type comes from the client, so check the bytes agree.
+	detectedType, body, err := sniffImage(file)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't create filename for thumbnail", err)
+		respondWithError(w, http.StatusBadRequest, "couldn't read thumbnail from form", err)
+		return
+	}
+	if detectedType != mediaType {
+		respondWithError(w, http.StatusUnsupportedMediaType, fmt.Sprintf("Declared type %s doesn't match the file's content", mediaType), nil)
+		return
+	}
+	video, err = cfg.saveThumbnail(r.Context(), video, body, mediaType)
+	if errors.Is(err, errInvalidImage) {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode the thumbnail", err)
+		return
+	}
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, http.StatusNotFound, "Video not found", err)
 		return
 	}
-	thumbnailFileName := base64.RawURLEncoding.EncodeToString(randBytes) + ext[0]
-	thumbnailFilePath := filepath.Join(cfg.assetsRoot, thumbnailFileName)
-	thumbnailFile, err := os.Create(thumbnailFilePath)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't save the thumbnail file", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save the thumbnail", err)
 		return
 	}
-	defer thumbnailFile.Close()
+	cfg.respondWithVideo(w, r, http.StatusOK, video)
+}
 
-	_, err = io.Copy(thumbnailFile, file)
+// saveThumbnail resizes an image into the configured thumbnail variants,
+// stores them and makes them the video's thumbnail. Uploaded and generated
+// thumbnails both go through here.
+func (cfg *apiConfig) saveThumbnail(ctx context.Context, video database.Video, body io.Reader, mediaType string) (database.Video, error) {
+	data, err := io.ReadAll(io.LimitReader(body, maxThumbnailSize+1))
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't save the image", err)
-		return
+		return database.Video{}, fmt.Errorf("couldn't read the image: %w", err)
 	}
-	thumbnailURL := fmt.Sprintf("http://localhost:%s/%s", cfg.port, thumbnailFilePath)
-	video.ThumbnailURL = &thumbnailURL
-	err = cfg.db.UpdateVideo(video)
+	if len(data) > maxThumbnailSize {
+		return database.Video{}, fmt.Errorf("%w: larger than %d bytes", errInvalidImage, maxThumbnailSize)
+	}
+	variants, err := renderThumbnails(ctx, data, mediaType, cfg.thumbnailWidths)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't update video in DB", err)
-		return
+		return database.Video{}, err
+	}
+
+	randBytes := make([]byte, 32)
+	_, err = rand.Read(randBytes)
+	if err != nil {
+		return database.Video{}, fmt.Errorf("couldn't create filename for thumbnail: %w", err)
+	}
+	baseName := base64.RawURLEncoding.EncodeToString(randBytes)
+
+	thumbnails := database.Thumbnails{}
+	var thumbnailKey string
+	largestJPEG := 0
+	for _, variant := range variants {
+		key := fmt.Sprintf("%s/%dw%s", baseName, variant.Width, variant.ext)
+		err = cfg.thumbnailStore.Put(ctx, key, bytes.NewReader(variant.data), variant.MediaType)
+		if err != nil {
+			return database.Video{}, fmt.Errorf("couldn't save the image: %w", err)
+		}
+		variant.URL = key
+		thumbnails = append(thumbnails, variant.ThumbnailVariant)
+		// thumbnail_url keeps working for clients that don't know about
+		// the variants.
+		if variant.MediaType == "image/jpeg" && variant.Width > largestJPEG {
+			thumbnailKey, largestJPEG = key, variant.Width
+		}
+	}
+
+	// Only the thumbnail is written: video may be stale by now, after a
+	// slow render or download, and its media replaced meanwhile.
+	err = cfg.db.UpdateVideoThumbnails(video.ID, &thumbnailKey, thumbnails)
+	if err != nil {
+		return database.Video{}, fmt.Errorf("couldn't update video in DB: %w", err)
 	}
-	respondWithJSON(w, http.StatusOK, video)
+	return cfg.db.GetVideo(video.ID)
 }
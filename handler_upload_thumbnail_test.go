@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// testPNG is a 640x360 image.
+func testPNG(t *testing.T) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 640, 360))
+	for x := 0; x < 640; x++ {
+		for y := 0; y < 360; y++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 128, 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestUploadThumbnail(t *testing.T) {
+	requireFFmpeg(t)
+	api := newTestAPI(t)
+	user, token := api.createUser(t, "owner@example.com")
+	video := api.createVideo(t, user.ID)
+
+	body, header := multipartFile(t, "thumbnail", "image/png", testPNG(t))
+	w := api.do(http.MethodPost, "/api/thumbnail_upload/"+video.ID.String(), token, body, header)
+	wantStatus(t, w, http.StatusOK)
+	got := decodeResponse[videoResponse](t, w)
+	if got.ThumbnailURL == nil || !strings.HasPrefix(*got.ThumbnailURL, "http://localhost:8091/assets/") {
+		t.Errorf("thumbnail URL = %v, want one under the assets URL", got.ThumbnailURL)
+	}
+
+	video, err := api.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 1280 is wider than the image, so only 320 and 640, as JPEG and WebP.
+	if len(video.Thumbnails) != 4 {
+		t.Fatalf("stored %d thumbnails, want 4: %+v", len(video.Thumbnails), video.Thumbnails)
+	}
+	for _, thumbnail := range video.Thumbnails {
+		info, err := api.cfg.thumbnailStore.Stat(context.Background(), thumbnail.URL)
+		if err != nil {
+			t.Errorf("%dw %s thumbnail isn't stored: %v", thumbnail.Width, thumbnail.MediaType, err)
+			continue
+		}
+		if info.ContentType != thumbnail.MediaType {
+			t.Errorf("%s is stored as %s, want %s", thumbnail.URL, info.ContentType, thumbnail.MediaType)
+		}
+	}
+	if video.ThumbnailURL == nil || !strings.HasSuffix(*video.ThumbnailURL, "/640w.jpg") {
+		t.Errorf("thumbnail_url = %v, want the largest JPEG", video.ThumbnailURL)
+	}
+}
+
+func TestUploadThumbnailRejected(t *testing.T) {
+	api := newTestAPI(t)
+	owner, ownerToken := api.createUser(t, "owner@example.com")
+	_, otherToken := api.createUser(t, "other@example.com")
+	video := api.createVideo(t, owner.ID)
+	target := "/api/thumbnail_upload/" + video.ID.String()
+	png := testPNG(t)
+	pdf := []byte("%PDF-1.7\n1 0 obj\n<< /Type /Catalog >>\nendobj\n")
+
+	tests := []struct {
+		name        string
+		token       string
+		contentType string
+		data        []byte
+		status      int
+	}{
+		{"no token", "", "image/png", png, http.StatusUnauthorized},
+		{"not the owner", otherToken, "image/png", png, http.StatusForbidden},
+		{"unsupported type", ownerToken, "image/svg+xml", png, http.StatusBadRequest},
+		{"mislabeled", ownerToken, "image/jpeg", png, http.StatusUnsupportedMediaType},
+		{"PDF renamed to PNG", ownerToken, "image/png", pdf, http.StatusUnsupportedMediaType},
+		{"empty", ownerToken, "image/png", nil, http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, header := multipartFile(t, "thumbnail", tt.contentType, tt.data)
+			wantStatus(t, api.do(http.MethodPost, target, tt.token, body, header), tt.status)
+		})
+	}
+
+	video, err := api.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if video.ThumbnailURL != nil || len(video.Thumbnails) != 0 {
+		t.Errorf("rejected uploads set the thumbnail to %v, %+v", video.ThumbnailURL, video.Thumbnails)
+	}
+	wantEmptyDir(t, api.cfg.assetsRoot)
+}
+
+func TestSaveThumbnailKeepsNewerVersion(t *testing.T) {
+	requireFFmpeg(t)
+	api := newTestAPI(t)
+	user, _ := api.createUser(t, "owner@example.com")
+	stale := storeTestVideo(t, api, api.createVideo(t, user.ID), []byte("video"))
+	// Uploaded while the thumbnail for stale was being rendered.
+	current := storeTestVideo(t, api, stale, []byte("newer video"))
+
+	saved, err := api.cfg.saveThumbnail(context.Background(), stale, bytes.NewReader(testPNG(t)), "image/png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Version != current.Version || *saved.VideoURL != *current.VideoURL {
+		t.Errorf("saving the thumbnail put the video back to version %d at %s, want %d at %s",
+			saved.Version, *saved.VideoURL, current.Version, *current.VideoURL)
+	}
+	if saved.ThumbnailURL == nil || *saved.ThumbnailURL == *current.ThumbnailURL {
+		t.Errorf("thumbnail wasn't replaced: %v", saved.ThumbnailURL)
+	}
+}
@@ -2,8 +2,7 @@ package main
 
 import (
 	"bytes"
-	"encoding/base64"
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -12,52 +11,58 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"slices"
 	"strings"
 
-	"crypto/rand"
-
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 	"github.com/google/uuid"
 )
 
-func processVideoForFastStart(filePath string) (string, error) {
+// normalizeVideo turns any supported upload into a faststart MP4 that plays
+// in browsers. Files that are already H.264/AAC are only remuxed; everything
+// else is transcoded.
+func normalizeVideo(ctx context.Context, filePath string, probe mediaProbe) (string, error) {
+	video, ok := probe.videoStream()
+	if !ok {
+		return "", errNoVideoStream
+	}
+	args := []string{"-v", "error", "-i", filePath, "-map", fmt.Sprintf("0:%d", video.Index)}
+	if audio, ok := probe.audioStream(); ok {
+		args = append(args, "-map", fmt.Sprintf("0:%d", audio.Index))
+	}
+	if probe.browserCompatible() {
+		args = append(args, "-c", "copy")
+	} else {
+		args = append(args,
+			"-c:v", "libx264",
+			"-preset", "veryfast",
+			"-crf", "23",
+			"-pix_fmt", "yuv420p",
+			"-c:a", "aac",
+			"-b:a", "128k",
+		)
+	}
 	processingFile := filePath + ".processing"
-	processCmd := exec.Command("ffmpeg", "-i", filePath, "-c", "copy", "-movflags", "faststart", "-f", "mp4", processingFile)
+	args = append(args, "-movflags", "faststart", "-f", "mp4", processingFile)
+
+	processCmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	var stderr bytes.Buffer
+	processCmd.Stderr = &stderr
 	err := processCmd.Run()
 	if err != nil {
-		return "", err
+		os.Remove(processingFile)
+		return "", fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
 	}
 	return processingFile, nil
 }
 
-func getVideoAspectRatio(filePath string) (string, error) {
-	cmd := exec.Command("ffprobe", "-v", "error", "-print_format", "json", "-show_streams", filePath)
-	var stdoutBuff bytes.Buffer
-	cmd.Stdout = &stdoutBuff
-	if err := cmd.Run(); err != nil {
-		return "", err
-	}
-	type FFProbeOut struct {
-		Streams []struct {
-			DisplayAspectRatio string `json:"display_aspect_ratio"`
-		} `json:"streams"`
-	}
-	decoder := json.NewDecoder(&stdoutBuff)
-	var out FFProbeOut
-	if err := decoder.Decode(&out); err != nil {
-		return "", err
-	}
-	if len(out.Streams) < 1 {
-		return "", errors.New("no steams to parse")
-	}
-	return out.Streams[0].DisplayAspectRatio, nil
-}
+// maxVideoUploadSize caps every way of getting a video onto the server.
+const maxVideoUploadSize = 1 << 30
 
 func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request) {
-	const maxUploadSize = 1 << 30
-	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
-	if err := r.ParseMultipartForm(maxUploadSize); err != nil {
+	r.Body = http.MaxBytesReader(w, r.Body, maxVideoUploadSize)
+	if err := r.ParseMultipartForm(maxVideoUploadSize); err != nil {
 		respondWithError(w, http.StatusBadRequest, "Couldn't parse form", err)
 		return
 	}
@@ -80,6 +85,10 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 		return
 	}
 	video, err := cfg.db.GetVideo(videoID)
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, http.StatusNotFound, "Video not found", err)
+		return
+	}
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
 		return
@@ -101,82 +110,130 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 		respondWithError(w, http.StatusBadRequest, "No Content-Type specified", err)
 		return
 	}
-	if mediaType != "video/mp4" {
-		respondWithError(w, http.StatusBadRequest, "Only video/mp4 Content-Type supported", err)
+	if !slices.Contains(cfg.allowedVideoTypes, mediaType) {
+		respondWithError(w, http.StatusBadRequest, "Unsupported video type "+mediaType, nil)
 		return
 	}
-	ext := "." + strings.Split(mediaType, "/")[1]
 
-	tempVidFile, err := os.CreateTemp("", "tubely-upload.mp4")
+	// The file outlives this request: the processing job removes it when
+	// it's done.
+	uploadFile, err := os.CreateTemp(cfg.uploadsRoot, "tubely-upload-*")
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Something went wrong", err)
 		return
 	}
-	log.Printf("Saved video : %s\n", tempVidFile.Name())
-	defer os.Remove(tempVidFile.Name())
-	defer tempVidFile.Close()
-	_, err = io.Copy(tempVidFile, inFile)
+	defer uploadFile.Close()
+	_, err = io.Copy(uploadFile, inFile)
 	if err != nil {
+		removeFile(uploadFile.Name())
 		respondWithError(w, http.StatusInternalServerError, "Something went wrong", err)
 		return
 	}
-	_, err = tempVidFile.Seek(0, io.SeekStart)
+	log.Printf("Saved video : %s\n", uploadFile.Name())
+
+	err = cfg.checkUploadedVideo(uploadFile.Name(), mediaType)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Something went wrong", err)
+		removeFile(uploadFile.Name())
+		respondWithVideoCheckError(w, err)
+		return
+	}
+
+	err = cfg.enqueueVideoProcessing(video.ID, uploadFile.Name(), mediaType)
+	if errors.Is(err, database.ErrNotFound) {
+		removeFile(uploadFile.Name())
+		respondWithError(w, http.StatusNotFound, "Video not found", err)
 		return
 	}
-	processedFilePath, err := processVideoForFastStart(tempVidFile.Name())
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't process video", err)
+		removeFile(uploadFile.Name())
+		respondWithError(w, http.StatusInternalServerError, "Couldn't queue video for processing", err)
+		return
+	}
+	video, err = cfg.db.GetVideo(videoID)
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, http.StatusNotFound, "Video not found", err)
 		return
 	}
-	defer os.Remove(processedFilePath)
-	processedFileBodyBytes, err := os.ReadFile(processedFilePath)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Unable to read processed file", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
 		return
 	}
+	cfg.respondWithVideo(w, r, http.StatusAccepted, video)
+}
 
-	randBytes := make([]byte, 32)
-	_, err = rand.Read(randBytes)
+// storeVideo normalizes an uploaded file to a faststart MP4, stores it under a
+// prefix matching its aspect ratio, deduplicated by content, and points the
+// video record at it. It's
+// shared by every upload path so they all end up with the same result.
+func (cfg *apiConfig) storeVideo(ctx context.Context, videoID uuid.UUID, filePath string) (_ database.Video, err error) {
+	sourceProbe, err := probeMedia(filePath)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Something went wrong", err)
-		return
+		return database.Video{}, fmt.Errorf("couldn't probe upload: %w", err)
 	}
-	aspectRatio, err := getVideoAspectRatio(tempVidFile.Name())
+	processedFilePath, err := normalizeVideo(ctx, filePath, sourceProbe)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Something went wrong while getting ratio", err)
-		return
+		return database.Video{}, fmt.Errorf("couldn't process video: %w", err)
 	}
+	defer os.Remove(processedFilePath)
 
-	videoAspectRatioPrefix := ""
-	switch aspectRatio {
-	case "16:9":
-		videoAspectRatioPrefix = "landscape"
-	case "9:16":
-		videoAspectRatioPrefix = "portrait"
-	default:
-		videoAspectRatioPrefix = "other"
+	probe, err := probeMedia(processedFilePath)
+	if err != nil {
+		return database.Video{}, fmt.Errorf("couldn't probe video: %w", err)
+	}
+	if err := probe.validate(); err != nil {
+		return database.Video{}, err
 	}
 
-	objectKeyInBucket := videoAspectRatioPrefix + "/" + base64.RawURLEncoding.EncodeToString(randBytes) + ext
+	blob, err := cfg.storeBlob(ctx, processedFilePath, probe)
+	if err != nil {
+		return database.Video{}, err
+	}
+	// The blob's reference is ours until a version takes it over. Either
+	// has to be released if the video doesn't end up using it, or a retry
+	// would take another reference.
+	var version database.VideoVersion
+	defer func() {
+		if err == nil {
+			return
+		}
+		if version.ID == uuid.Nil {
+			cfg.releaseBlob(ctx, blob)
+			return
+		}
+		if err := cfg.releaseVideoVersion(ctx, version); err != nil {
+			log.Printf("Couldn't release version %d of video %s: %v", version.Version, videoID, err)
+		}
+	}()
 
-	_, err = cfg.s3Client.PutObject(r.Context(), &s3.PutObjectInput{
-		Bucket:      &cfg.s3Bucket,
-		Key:         &objectKeyInBucket,
-		Body:        bytes.NewReader(processedFileBodyBytes),
-		ContentType: &mediaType,
+	// Read the video only now so edits made while it was processing aren't
+	// lost. It may have been deleted meanwhile, which callers see as
+	// ErrNotFound.
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		return database.Video{}, err
+	}
+	if err := cfg.adoptLegacyVersion(&video); err != nil {
+		return database.Video{}, err
+	}
+	// Only keys are stored; presentVideo turns them into URLs.
+	version, err = cfg.db.CreateVideoVersion(database.CreateVideoVersionParams{
+		VideoID:    video.ID,
+		VideoURL:   &blob.Key,
+		HLSURL:     blob.HLSKey,
+		DASHURL:    blob.DASHKey,
+		Metadata:   probe.metadata(),
+		Encryption: blob.Encryption,
 	})
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't save video. Sorry.", err)
-		return
+		return database.Video{}, err
+	}
+	err = cfg.setVideoVersion(&video, version)
+	if err != nil {
+		return database.Video{}, err
 	}
-	videoURL := fmt.Sprintf("https://%s.cloudfront.net/%s", cfg.s3CfDistribution, objectKeyInBucket)
-	video.VideoURL = &videoURL
 	err = cfg.db.UpdateVideo(video)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Something went wrong", err)
-		return
+		return database.Video{}, err
 	}
-	respondWithJSON(w, http.StatusOK, video)
+	return video, nil
 }
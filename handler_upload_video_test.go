@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestUploadVideo(t *testing.T) {
+	data := testVideoFile(t)
+	api := newTestAPI(t)
+	user, token := api.createUser(t, "owner@example.com")
+	video := api.createVideo(t, user.ID)
+
+	body, header := multipartFile(t, "video", "video/mp4", data)
+	w := api.do(http.MethodPost, "/api/video_upload/"+video.ID.String(), token, body, header)
+	wantStatus(t, w, http.StatusAccepted)
+	if got := decodeResponse[videoResponse](t, w); got.Status != database.VideoStatusUploaded {
+		t.Errorf("status after the upload = %q, want %q", got.Status, database.VideoStatusUploaded)
+	}
+
+	if n := api.runJobs(t); n != 1 {
+		t.Fatalf("ran %d jobs, want 1", n)
+	}
+	video, err := api.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if video.Status != database.VideoStatusReady || video.VideoURL == nil {
+		t.Fatalf("processed video is %q at %v", video.Status, video.VideoURL)
+	}
+	info, err := api.cfg.videoStore.Stat(context.Background(), *video.VideoURL)
+	if err != nil {
+		t.Fatalf("processed video isn't in the bucket: %v", err)
+	}
+	if info.ContentType != "video/mp4" {
+		t.Errorf("stored video's Content-Type = %q, want video/mp4", info.ContentType)
+	}
+	if video.Metadata.Width != 320 || video.Metadata.Height != 240 {
+		t.Errorf("metadata size = %dx%d, want 320x240", video.Metadata.Width, video.Metadata.Height)
+	}
+	if video.ThumbnailURL == nil {
+		t.Errorf("no thumbnail was generated")
+	}
+	wantEmptyDir(t, api.cfg.uploadsRoot)
+}
+
+func TestUploadVideoRejected(t *testing.T) {
+	api := newTestAPI(t)
+	owner, ownerToken := api.createUser(t, "owner@example.com")
+	_, otherToken := api.createUser(t, "other@example.com")
+	video := api.createVideo(t, owner.ID)
+	target := "/api/video_upload/" + video.ID.String()
+
+	tests := []struct {
+		name        string
+		token       string
+		contentType string
+		status      int
+	}{
+		{"no token", "", "video/mp4", http.StatusUnauthorized},
+		{"not the owner", otherToken, "video/mp4", http.StatusUnauthorized},
+		{"unsupported type", ownerToken, "image/png", http.StatusBadRequest},
+		{"not a video", ownerToken, "video/mp4", http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, header := multipartFile(t, "video", tt.contentType, []byte("not a video"))
+			wantStatus(t, api.do(http.MethodPost, target, tt.token, body, header), tt.status)
+		})
+	}
+
+	if n := api.runJobs(t); n != 0 {
+		t.Errorf("rejected uploads queued %d jobs", n)
+	}
+	wantEmptyDir(t, api.cfg.uploadsRoot)
+}
+
+// TestUploadVideoQueuesJob calls the handler directly and checks what it
+// leaves in the database for the workers.
+func TestUploadVideoQueuesJob(t *testing.T) {
+	data := testVideoFile(t)
+	api := newTestAPI(t)
+	user, token := api.createUser(t, "owner@example.com")
+	video := api.createVideo(t, user.ID)
+
+	body, header := multipartFile(t, "video", "video/mp4", data)
+	r := httptest.NewRequest(http.MethodPost, "/api/video_upload/"+video.ID.String(), body)
+	r.SetPathValue("videoID", video.ID.String())
+	r.Header = header
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	api.cfg.handlerUploadVideo(w, r)
+	wantStatus(t, w, http.StatusAccepted)
+
+	video, err := api.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if video.Status != database.VideoStatusUploaded || video.VideoURL != nil {
+		t.Errorf("video is %q at %v, want uploaded without media yet", video.Status, video.VideoURL)
+	}
+	now := time.Now()
+	job, err := api.db.ClaimJob(now, now.Add(jobLease))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job == nil || job.Kind != jobKindProcessVideo || job.VideoID == nil || *job.VideoID != video.ID {
+		t.Fatalf("queued job %+v, want processing of video %s", job, video.ID)
+	}
+	var payload processVideoPayload
+	if err := json.Unmarshal([]byte(job.Payload), &payload); err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Dir(payload.Path) != api.cfg.uploadsRoot || payload.MediaType != "video/mp4" {
+		t.Errorf("payload = %+v, want a video/mp4 file in %s", payload, api.cfg.uploadsRoot)
+	}
+	saved, err := os.ReadFile(payload.Path)
+	if err != nil || !bytes.Equal(saved, data) {
+		t.Errorf("the job's file doesn't hold the upload: %v", err)
+	}
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
@@ -40,7 +42,7 @@ func (cfg *apiConfig) handlerVideoMetaCreate(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	respondWithJSON(w, http.StatusCreated, video)
+	cfg.respondWithVideo(w, r, http.StatusCreated, video)
 }
 
 func (cfg *apiConfig) handlerVideoMetaDelete(w http.ResponseWriter, r *http.Request) {
@@ -63,8 +65,12 @@ func (cfg *apiConfig) handlerVideoMetaDelete(w http.ResponseWriter, r *http.Requ
 	}
 
 	video, err := cfg.db.GetVideo(videoID)
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, http.StatusNotFound, "Video not found", err)
+		return
+	}
 	if err != nil {
-		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
 		return
 	}
 	if video.UserID != userID {
@@ -72,13 +78,32 @@ func (cfg *apiConfig) handlerVideoMetaDelete(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	err = cfg.db.DeleteVideo(videoID)
+	// The media is released along with the rows, and only deleted from
+	// storage once they're gone. Media other videos share stays.
+	released, err := cfg.db.DeleteVideo(videoID)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't delete video", err)
 		return
 	}
 
-	w.WriteHeader(http.StatusNoContent)
+	// The video is gone either way, so don't let a client hanging up stop
+	// the cleanup halfway.
+	ctx := context.WithoutCancel(r.Context())
+	scheduled, failed := cfg.deleteVideoObjects(ctx, cfg.deletedVideoObjects(video, released))
+	if len(scheduled) == 0 && len(failed) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	respondWithJSON(w, http.StatusAccepted, struct {
+		// Scheduled objects couldn't be deleted yet and will be retried
+		// in the background.
+		Scheduled []storedObject `json:"scheduled_deletions"`
+		// Failed objects couldn't be deleted or scheduled and are leaked.
+		Failed []storedObject `json:"failed_deletions"`
+	}{
+		Scheduled: scheduled,
+		Failed:    failed,
+	})
 }
 
 func (cfg *apiConfig) handlerVideoGet(w http.ResponseWriter, r *http.Request) {
@@ -89,13 +114,32 @@ func (cfg *apiConfig) handlerVideoGet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	video, err := cfg.db.GetVideo(videoID)
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
 
+	video, err := cfg.db.GetVideo(videoID)
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, http.StatusNotFound, "Video not found", err)
+		return
+	}
 	if err != nil {
-		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
 		return
 	}
-	respondWithJSON(w, http.StatusOK, video)
+	// Presigned and signed URLs, and signed cookies, are credentials: only
+	// the owner gets them. Anyone else sees the video without its media.
+	if video.UserID != userID && !cfg.publiclyPlayable(video) {
+		video.VideoURL, video.HLSURL, video.DASHURL = nil, nil, nil
+	}
+	cfg.respondWithVideo(w, r, http.StatusOK, video)
 }
 
 func (cfg *apiConfig) handlerVideosRetrieve(w http.ResponseWriter, r *http.Request) {
@@ -115,5 +159,10 @@ func (cfg *apiConfig) handlerVideosRetrieve(w http.ResponseWriter, r *http.Reque
 		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
 		return
 	}
-	respondWithJSON(w, http.StatusOK, videos)
+	presented, err := cfg.presentVideos(r, videos)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create video URLs", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, presented)
 }
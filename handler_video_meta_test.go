@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/cloudfront"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+)
+
+// storeTestMedia points the video at media in the bucket, as if it had been
+// processed.
+func storeTestMedia(t *testing.T, api *testAPI, video database.Video, access database.VideoAccess) database.Video {
+	t.Helper()
+	videoURL := "landscape/" + video.ID.String() + ".mp4"
+	hlsURL := "landscape/" + video.ID.String() + "/hls/master.m3u8"
+	video.VideoURL = &videoURL
+	video.HLSURL = &hlsURL
+	video.Status = database.VideoStatusReady
+	if err := api.db.UpdateVideo(video); err != nil {
+		t.Fatal(err)
+	}
+	if err := api.db.UpdateVideoAccess(video.ID, access); err != nil {
+		t.Fatal(err)
+	}
+	video.Access = access
+	return video
+}
+
+func TestVideoGetRequiresToken(t *testing.T) {
+	api := newTestAPI(t)
+	user, _ := api.createUser(t, "owner@example.com")
+	video := api.createVideo(t, user.ID)
+
+	wantStatus(t, api.do(http.MethodGet, "/api/videos/"+video.ID.String(), "", nil, nil), http.StatusUnauthorized)
+	wantStatus(t, api.do(http.MethodGet, "/api/videos/"+video.ID.String(), "not-a-jwt", nil, nil), http.StatusUnauthorized)
+}
+
+func TestVideoGetSignsOnlyForOwner(t *testing.T) {
+	api := newTestAPI(t)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.cfg.cloudfront.signer = cloudfront.NewSigner("K2JCJMDEHXQW5F", key)
+	owner, ownerToken := api.createUser(t, "owner@example.com")
+	_, otherToken := api.createUser(t, "other@example.com")
+	video := storeTestMedia(t, api, api.createVideo(t, owner.ID), database.VideoAccess{Protected: true})
+	target := "/api/videos/" + video.ID.String()
+
+	w := api.do(http.MethodGet, target, ownerToken, nil, nil)
+	wantStatus(t, w, http.StatusOK)
+	got := decodeResponse[videoResponse](t, w)
+	if got.VideoURL == nil || !strings.Contains(*got.VideoURL, "Signature=") {
+		t.Errorf("owner got video URL %v, want a signed URL", got.VideoURL)
+	}
+	if len(w.Result().Cookies()) == 0 {
+		t.Errorf("owner got no signed cookies")
+	}
+
+	w = api.do(http.MethodGet, target, otherToken, nil, nil)
+	wantStatus(t, w, http.StatusOK)
+	got = decodeResponse[videoResponse](t, w)
+	if got.VideoURL != nil || got.HLSURL != nil || got.DASHURL != nil {
+		t.Errorf("another user got media URLs %v, %v, %v", got.VideoURL, got.HLSURL, got.DASHURL)
+	}
+	if cookies := w.Result().Cookies(); len(cookies) != 0 {
+		t.Errorf("another user got cookies %v", cookies)
+	}
+}
+
+func TestVideoGetPresignsOnlyForOwner(t *testing.T) {
+	api := newTestAPI(t)
+	api.cfg.privateVideos = true
+	owner, ownerToken := api.createUser(t, "owner@example.com")
+	_, otherToken := api.createUser(t, "other@example.com")
+	video := storeTestMedia(t, api, api.createVideo(t, owner.ID), database.VideoAccess{})
+	target := "/api/videos/" + video.ID.String()
+
+	w := api.do(http.MethodGet, target, ownerToken, nil, nil)
+	wantStatus(t, w, http.StatusOK)
+	got := decodeResponse[videoResponse](t, w)
+	if got.VideoURL == nil || !strings.Contains(*got.VideoURL, "X-Amz-Signature=") {
+		t.Errorf("owner got video URL %v, want a presigned URL", got.VideoURL)
+	}
+
+	w = api.do(http.MethodGet, target, otherToken, nil, nil)
+	wantStatus(t, w, http.StatusOK)
+	if got := decodeResponse[videoResponse](t, w); got.VideoURL != nil {
+		t.Errorf("another user got video URL %s", *got.VideoURL)
+	}
+}
+
+func TestVideoGetPublicVideo(t *testing.T) {
+	api := newTestAPI(t)
+	owner, _ := api.createUser(t, "owner@example.com")
+	_, otherToken := api.createUser(t, "other@example.com")
+	video := storeTestMedia(t, api, api.createVideo(t, owner.ID), database.VideoAccess{})
+
+	w := api.do(http.MethodGet, "/api/videos/"+video.ID.String(), otherToken, nil, nil)
+	wantStatus(t, w, http.StatusOK)
+	got := decodeResponse[videoResponse](t, w)
+	want := api.s3 + "/" + testBucket + "/" + *video.VideoURL
+	if got.VideoURL == nil || *got.VideoURL != want {
+		t.Errorf("video URL = %v, want %s", got.VideoURL, want)
+	}
+}
+
+// storeTestVideo stores data as the video's media, with an HLS package and a
+// thumbnail, the way processing does, short of running ffmpeg.
+func storeTestVideo(t *testing.T, api *testAPI, video database.Video, data []byte) database.Video {
+	t.Helper()
+	ctx := context.Background()
+	sum := sha256.Sum256(data)
+	blob, err := api.db.AcquireBlob(database.Blob{Key: "landscape/" + hex.EncodeToString(sum[:]) + ".mp4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hlsKey := strings.TrimSuffix(blob.Key, ".mp4") + "/hls/master.m3u8"
+	if !blob.Stored {
+		blob.HLSKey = &hlsKey
+		objects := map[string]string{
+			blob.Key: "video/mp4",
+			hlsKey:   "application/vnd.apple.mpegurl",
+			strings.TrimSuffix(hlsKey, "master.m3u8") + "720p/segment0.ts": "video/mp2t",
+		}
+		for key, contentType := range objects {
+			if err := api.cfg.videoStore.Put(ctx, key, bytes.NewReader(data), contentType); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := api.db.MarkBlobStored(blob); err != nil {
+			t.Fatal(err)
+		}
+	}
+	version, err := api.db.CreateVideoVersion(database.CreateVideoVersionParams{
+		VideoID:  video.ID,
+		VideoURL: &blob.Key,
+		HLSURL:   &hlsKey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := api.cfg.setVideoVersion(&video, version); err != nil {
+		t.Fatal(err)
+	}
+
+	thumbnailKey := video.ID.String() + "/640w.jpg"
+	if err := api.cfg.thumbnailStore.Put(ctx, thumbnailKey, strings.NewReader("jpeg"), "image/jpeg"); err != nil {
+		t.Fatal(err)
+	}
+	video.ThumbnailURL = &thumbnailKey
+	video.Thumbnails = database.Thumbnails{{URL: thumbnailKey, Width: 640, Height: 360, MediaType: "image/jpeg"}}
+	video.Status = database.VideoStatusReady
+	if err := api.db.UpdateVideo(video); err != nil {
+		t.Fatal(err)
+	}
+	return video
+}
+
+// wantStored checks whether the object is in store.
+func wantStored(t *testing.T, store storage.BlobStore, key string, want bool) {
+	t.Helper()
+	_, err := store.Stat(context.Background(), key)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		t.Fatal(err)
+	}
+	if got := err == nil; got != want {
+		t.Errorf("%s stored = %t, want %t", key, got, want)
+	}
+}
+
+func TestVideoDelete(t *testing.T) {
+	api := newTestAPI(t)
+	user, token := api.createUser(t, "owner@example.com")
+	video := storeTestVideo(t, api, api.createVideo(t, user.ID), []byte("video"))
+	// The same upload again shares the stored media.
+	copied := storeTestVideo(t, api, api.createVideo(t, user.ID), []byte("video"))
+	if *copied.VideoURL != *video.VideoURL {
+		t.Fatalf("copy is stored at %s, not with the original at %s", *copied.VideoURL, *video.VideoURL)
+	}
+	segment := strings.TrimSuffix(*video.HLSURL, "master.m3u8") + "720p/segment0.ts"
+
+	w := api.do(http.MethodDelete, "/api/videos/"+video.ID.String(), token, nil, nil)
+	wantStatus(t, w, http.StatusNoContent)
+	if _, err := api.db.GetVideo(video.ID); !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("GetVideo after deleting it: %v", err)
+	}
+	wantStored(t, api.cfg.thumbnailStore, *video.ThumbnailURL, false)
+	// The copy still needs the media.
+	wantStored(t, api.cfg.videoStore, *video.VideoURL, true)
+	wantStored(t, api.cfg.videoStore, segment, true)
+
+	w = api.do(http.MethodDelete, "/api/videos/"+copied.ID.String(), token, nil, nil)
+	wantStatus(t, w, http.StatusNoContent)
+	wantStored(t, api.cfg.thumbnailStore, *copied.ThumbnailURL, false)
+	wantStored(t, api.cfg.videoStore, *video.VideoURL, false)
+	wantStored(t, api.cfg.videoStore, *video.HLSURL, false)
+	wantStored(t, api.cfg.videoStore, segment, false)
+	if _, err := api.db.GetBlob(*video.VideoURL); !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("GetBlob after deleting its objects: %v", err)
+	}
+	if n := api.runJobs(t); n != 0 {
+		t.Errorf("deleting queued %d jobs", n)
+	}
+}
+
+func TestVideoDeleteRejected(t *testing.T) {
+	api := newTestAPI(t)
+	owner, _ := api.createUser(t, "owner@example.com")
+	_, otherToken := api.createUser(t, "other@example.com")
+	video := storeTestVideo(t, api, api.createVideo(t, owner.ID), []byte("video"))
+	target := "/api/videos/" + video.ID.String()
+
+	wantStatus(t, api.do(http.MethodDelete, target, "", nil, nil), http.StatusUnauthorized)
+	wantStatus(t, api.do(http.MethodDelete, target, otherToken, nil, nil), http.StatusForbidden)
+	if _, err := api.db.GetVideo(video.ID); err != nil {
+		t.Errorf("GetVideo after rejected deletes: %v", err)
+	}
+	wantStored(t, api.cfg.videoStore, *video.VideoURL, true)
+	wantStored(t, api.cfg.thumbnailStore, *video.ThumbnailURL, true)
+}
+
+// unreachableStore is a store whose objects can't be deleted, like a bucket
+// that's down.
+type unreachableStore struct {
+	storage.BlobStore
+}
+
+func (unreachableStore) Delete(ctx context.Context, key string) error {
+	return errors.New("connection refused")
+}
+
+// deleteVideo calls the handler directly, without the routes.
+func (api *testAPI) deleteVideo(video database.Video, token string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodDelete, "/api/videos/"+video.ID.String(), nil)
+	r.SetPathValue("videoID", video.ID.String())
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	api.cfg.handlerVideoMetaDelete(w, r)
+	return w
+}
+
+func TestVideoDeleteRows(t *testing.T) {
+	api := newTestAPI(t)
+	user, token := api.createUser(t, "owner@example.com")
+	video := storeTestVideo(t, api, api.createVideo(t, user.ID), []byte("video"))
+	// A newer version retires the first, which stays until it expires.
+	video = storeTestVideo(t, api, video, []byte("newer video"))
+	upload, err := api.db.CreateUpload(database.CreateUploadParams{VideoID: video.ID, UserID: user.ID, Length: 1, MediaType: "video/mp4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantStatus(t, api.deleteVideo(video, token), http.StatusNoContent)
+	if _, err := api.db.GetVideo(video.ID); !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("GetVideo: %v", err)
+	}
+	if versions, err := api.db.GetVideoVersions(video.ID); err != nil || len(versions) != 0 {
+		t.Errorf("GetVideoVersions = %v, %v, want none", versions, err)
+	}
+	if _, err := api.db.GetUpload(upload.ID); !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("GetUpload: %v", err)
+	}
+	if _, err := api.db.GetBlob(*video.VideoURL); !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("GetBlob of the deleted media: %v", err)
+	}
+}
+
+func TestVideoDeleteSchedulesFailedDeletions(t *testing.T) {
+	api := newTestAPI(t)
+	user, token := api.createUser(t, "owner@example.com")
+	video := storeTestVideo(t, api, api.createVideo(t, user.ID), []byte("video"))
+	api.cfg.videoStore = unreachableStore{api.cfg.videoStore}
+
+	w := api.deleteVideo(video, token)
+	wantStatus(t, w, http.StatusAccepted)
+	got := decodeResponse[struct {
+		Scheduled []storedObject `json:"scheduled_deletions"`
+		Failed    []storedObject `json:"failed_deletions"`
+	}](t, w)
+	if len(got.Scheduled) != 2 || len(got.Failed) != 0 {
+		t.Fatalf("scheduled %+v and failed %+v, want the MP4 and HLS package scheduled", got.Scheduled, got.Failed)
+	}
+	// The thumbnail's store is up.
+	wantStored(t, api.cfg.thumbnailStore, *video.ThumbnailURL, false)
+
+	// The blob is only forgotten once its objects are gone.
+	if _, err := api.db.GetBlob(*video.VideoURL); err != nil {
+		t.Errorf("GetBlob before the retries: %v", err)
+	}
+	scheduled := []storedObject{}
+	for {
+		now := time.Now().Add(time.Hour)
+		job, err := api.db.ClaimJob(now, now.Add(jobLease))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job == nil {
+			break
+		}
+		if job.Kind != jobKindDeleteObject {
+			t.Errorf("queued a %s job", job.Kind)
+			continue
+		}
+		var obj storedObject
+		if err := json.Unmarshal([]byte(job.Payload), &obj); err != nil {
+			t.Fatal(err)
+		}
+		scheduled = append(scheduled, obj)
+	}
+	if len(scheduled) != len(got.Scheduled) {
+		t.Errorf("queued deletions of %+v, want %+v", scheduled, got.Scheduled)
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const jobKindRetireVersion = "retire_version"
+
+type retireVersionPayload struct {
+	VersionID uuid.UUID `json:"version_id"`
+}
+
+// setVideoVersion makes an existing version the video's current media and
+// schedules the media it replaces for deletion. The caller saves the video.
+func (cfg *apiConfig) setVideoVersion(video *database.Video, version database.VideoVersion) error {
+	if err := cfg.adoptLegacyVersion(video); err != nil {
+		return err
+	}
+	previous := video.Version
+	if err := cfg.db.ExpireVideoVersion(version.ID, nil); err != nil {
+		return err
+	}
+
+	video.Version = version.Version
+	video.VideoURL = version.VideoURL
+	video.HLSURL = version.HLSURL
+	video.DASHURL = version.DASHURL
+	video.Metadata = version.Metadata
+	video.Encryption = version.Encryption
+
+	if previous == 0 || previous == version.Version {
+		return nil
+	}
+	return cfg.retireVideoVersion(video.ID, previous)
+}
+
+// adoptLegacyVersion records media uploaded before versions were tracked as
+// version 1, so it's retired like any other. It has to happen before the
+// video's next version is created.
+func (cfg *apiConfig) adoptLegacyVersion(video *database.Video) error {
+	if video.Version != 0 || video.VideoURL == nil {
+		return nil
+	}
+	legacy, err := cfg.db.CreateVideoVersion(database.CreateVideoVersionParams{
+		VideoID:    video.ID,
+		VideoURL:   video.VideoURL,
+		HLSURL:     video.HLSURL,
+		DASHURL:    video.DASHURL,
+		Metadata:   video.Metadata,
+		Encryption: video.Encryption,
+	})
+	if err != nil {
+		return err
+	}
+	video.Version = legacy.Version
+	return nil
+}
+
+// retireVideoVersion keeps a superseded version around for the retention
+// window, so viewers in the middle of it can finish, then deletes its media.
+func (cfg *apiConfig) retireVideoVersion(videoID uuid.UUID, number int) error {
+	version, err := cfg.db.GetVideoVersion(videoID, number)
+	if errors.Is(err, database.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if version.DeletedAt != nil {
+		return nil
+	}
+	expiresAt := time.Now().Add(cfg.videoVersionRetention)
+	if err := cfg.db.ExpireVideoVersion(version.ID, &expiresAt); err != nil {
+		return err
+	}
+	payload, err := json.Marshal(retireVersionPayload{VersionID: version.ID})
+	if err != nil {
+		return err
+	}
+	return cfg.enqueueJob(jobKindRetireVersion, &videoID, string(payload), expiresAt)
+}
+
+func (cfg *apiConfig) retireVersionJob(ctx context.Context, job database.Job) error {
+	var payload retireVersionPayload
+	if err := json.Unmarshal([]byte(job.Payload), &payload); err != nil {
+		return err
+	}
+	// Nothing to do if the video was deleted, the version was rolled back
+	// to, or it was retired again later and a newer job owns it.
+	version, err := cfg.db.GetVideoVersionByID(payload.VersionID)
+	if errors.Is(err, database.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if version.DeletedAt != nil || version.ExpiresAt == nil || version.ExpiresAt.After(time.Now()) {
+		return nil
+	}
+	video, err := cfg.db.GetVideo(version.VideoID)
+	if errors.Is(err, database.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if video.Version == version.Version {
+		return nil
+	}
+
+	return cfg.releaseVideoVersion(ctx, version)
+}
+
+// releaseVideoVersion deletes a version's media unless other videos share
+// it, in which case it's only deleted with the last reference.
+func (cfg *apiConfig) releaseVideoVersion(ctx context.Context, version database.VideoVersion) error {
+	unreferenced, err := cfg.db.ReleaseVideoVersion(version.ID)
+	if err != nil {
+		return err
+	}
+	if unreferenced {
+		cfg.deleteVideoObjects(ctx, cfg.mediaObjects(version.Encryption, version.VideoURL, version.HLSURL, version.DASHURL))
+	}
+	return nil
+}
+
+// deletedVideoObjects lists the objects a deleted video leaves behind that
+// nothing references anymore: its thumbnails and the media of the versions
+// DeleteVideo released.
+func (cfg *apiConfig) deletedVideoObjects(video database.Video, released []database.VideoVersion) []storedObject {
+	objects := cfg.thumbnailObjects(video)
+	if video.Version == 0 {
+		// Media from before versions were tracked isn't shared.
+		objects = appendObjects(objects, cfg.mediaObjects(video.Encryption, video.VideoURL, video.HLSURL, video.DASHURL)...)
+	}
+	for _, version := range released {
+		objects = appendObjects(objects, cfg.mediaObjects(version.Encryption, version.VideoURL, version.HLSURL, version.DASHURL)...)
+	}
+	return objects
+}
+
+// retainedVersionObjects lists the media of every version of a video that
+// hasn't been deleted yet.
+func (cfg *apiConfig) retainedVersionObjects(videoID uuid.UUID) ([]storedObject, error) {
+	versions, err := cfg.db.GetVideoVersions(videoID)
+	if err != nil {
+		return nil, err
+	}
+	objects := []storedObject{}
+	for _, version := range versions {
+		if version.DeletedAt == nil {
+			objects = appendObjects(objects, cfg.mediaObjects(version.Encryption, version.VideoURL, version.HLSURL, version.DASHURL)...)
+		}
+	}
+	return objects, nil
+}
+
+func (cfg *apiConfig) handlerVideoVersionsList(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.getOwnedVideo(w, r)
+	if !ok {
+		return
+	}
+
+	versions, err := cfg.db.GetVideoVersions(video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve versions", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, cfg.presentVideoVersions(versions))
+}
+
+func (cfg *apiConfig) handlerVideoVersionRollback(w http.ResponseWriter, r *http.Request) {
+	number, err := strconv.Atoi(r.PathValue("version"))
+	if err != nil || number < 1 {
+		respondWithError(w, http.StatusBadRequest, "Invalid version", err)
+		return
+	}
+
+	video, ok := cfg.getOwnedVideo(w, r)
+	if !ok {
+		return
+	}
+
+	version, err := cfg.db.GetVideoVersion(video.ID, number)
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, http.StatusNotFound, "Version not found", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get version", err)
+		return
+	}
+	if version.DeletedAt != nil {
+		respondWithError(w, http.StatusGone, "That version's media has already been deleted", nil)
+		return
+	}
+	if version.Version == video.Version {
+		cfg.respondWithVideo(w, r, http.StatusOK, video)
+		return
+	}
+
+	err = cfg.setVideoVersion(&video, version)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't roll back", err)
+		return
+	}
+	err = cfg.db.UpdateVideo(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		return
+	}
+	cfg.respondWithVideo(w, r, http.StatusOK, video)
+}
+
+// getOwnedVideo loads the video named in the path and checks it belongs to
+// the requesting user, responding with an error if not.
+func (cfg *apiConfig) getOwnedVideo(w http.ResponseWriter, r *http.Request) (database.Video, bool) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return database.Video{}, false
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return database.Video{}, false
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return database.Video{}, false
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, http.StatusNotFound, "Video not found", err)
+		return database.Video{}, false
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return database.Video{}, false
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "You are not the owner of this video", nil)
+		return database.Video{}, false
+	}
+	return video, true
+}
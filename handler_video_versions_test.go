@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func rollbackTarget(videoID uuid.UUID, version string) string {
+	return "/api/videos/" + videoID.String() + "/versions/" + version + "/rollback"
+}
+
+func (api *testAPI) videoVersion(t *testing.T, videoID uuid.UUID, number int) database.VideoVersion {
+	t.Helper()
+	version, err := api.db.GetVideoVersion(videoID, number)
+	if err != nil {
+		t.Fatalf("GetVideoVersion %d: %v", number, err)
+	}
+	return version
+}
+
+func TestVideoVersionRollback(t *testing.T) {
+	api := newTestAPI(t)
+	owner, token := api.createUser(t, "owner@example.com")
+	_, otherToken := api.createUser(t, "other@example.com")
+	first := storeTestVideo(t, api, api.createVideo(t, owner.ID), []byte("video"))
+	video := storeTestVideo(t, api, first, []byte("newer video"))
+	if video.Version != 2 {
+		t.Fatalf("replaced video is at version %d, want 2", video.Version)
+	}
+
+	w := api.do(http.MethodGet, "/api/videos/"+video.ID.String()+"/versions", token, nil, nil)
+	wantStatus(t, w, http.StatusOK)
+	if versions := decodeResponse[[]database.VideoVersion](t, w); len(versions) != 2 {
+		t.Fatalf("listed %d versions, want 2", len(versions))
+	}
+
+	wantStatus(t, api.do(http.MethodPost, rollbackTarget(video.ID, "1"), otherToken, nil, nil), http.StatusForbidden)
+	wantStatus(t, api.do(http.MethodPost, rollbackTarget(video.ID, "first"), token, nil, nil), http.StatusBadRequest)
+	wantStatus(t, api.do(http.MethodPost, rollbackTarget(video.ID, "3"), token, nil, nil), http.StatusNotFound)
+
+	w = api.do(http.MethodPost, rollbackTarget(video.ID, "1"), token, nil, nil)
+	wantStatus(t, w, http.StatusOK)
+	if got := decodeResponse[videoResponse](t, w); got.Version != 1 {
+		t.Errorf("rollback returned version %d, want 1", got.Version)
+	}
+	rolledBack, err := api.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rolledBack.Version != 1 || *rolledBack.VideoURL != *first.VideoURL || *rolledBack.HLSURL != *first.HLSURL {
+		t.Errorf("rolled back video is version %d at %s, want version 1 at %s", rolledBack.Version, *rolledBack.VideoURL, *first.VideoURL)
+	}
+	// The title and thumbnail aren't versioned.
+	if rolledBack.Title != video.Title || *rolledBack.ThumbnailURL != *video.ThumbnailURL {
+		t.Errorf("rollback changed the video to %+v", rolledBack)
+	}
+
+	// The version rolled back to is no longer retiring, the one it
+	// replaced is.
+	if v := api.videoVersion(t, video.ID, 1); v.ExpiresAt != nil {
+		t.Errorf("version 1 still expires at %v", v.ExpiresAt)
+	}
+	if v := api.videoVersion(t, video.ID, 2); v.ExpiresAt == nil {
+		t.Errorf("version 2 isn't retiring")
+	}
+
+	// Rolling back to the current version changes nothing.
+	wantStatus(t, api.do(http.MethodPost, rollbackTarget(video.ID, "1"), token, nil, nil), http.StatusOK)
+	if v := api.videoVersion(t, video.ID, 2); v.ExpiresAt == nil {
+		t.Errorf("version 2 isn't retiring after a rollback to the current version")
+	}
+}
+
+func TestRetireVersionJob(t *testing.T) {
+	api := newTestAPI(t)
+	user, token := api.createUser(t, "owner@example.com")
+	// Replaced media is due for deletion right away.
+	api.cfg.videoVersionRetention = -time.Second
+	first := storeTestVideo(t, api, api.createVideo(t, user.ID), []byte("video"))
+	video := storeTestVideo(t, api, first, []byte("newer video"))
+
+	if n := api.runJobs(t); n != 1 {
+		t.Fatalf("ran %d jobs, want 1", n)
+	}
+	wantStored(t, api.cfg.videoStore, *first.VideoURL, false)
+	wantStored(t, api.cfg.videoStore, *first.HLSURL, false)
+	wantStored(t, api.cfg.videoStore, *video.VideoURL, true)
+	wantStored(t, api.cfg.videoStore, *video.HLSURL, true)
+	if _, err := api.db.GetBlob(*first.VideoURL); !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("GetBlob of the retired media: %v", err)
+	}
+	if v := api.videoVersion(t, video.ID, 1); v.DeletedAt == nil {
+		t.Errorf("retired version isn't marked deleted")
+	}
+
+	wantStatus(t, api.do(http.MethodPost, rollbackTarget(video.ID, "1"), token, nil, nil), http.StatusGone)
+}
+
+func TestRetireVersionJobAfterRollback(t *testing.T) {
+	api := newTestAPI(t)
+	user, token := api.createUser(t, "owner@example.com")
+	api.cfg.videoVersionRetention = -time.Second
+	first := storeTestVideo(t, api, api.createVideo(t, user.ID), []byte("video"))
+	video := storeTestVideo(t, api, first, []byte("newer video"))
+
+	// Rolled back before version 1's job ran; version 2 is retired instead.
+	wantStatus(t, api.do(http.MethodPost, rollbackTarget(video.ID, "1"), token, nil, nil), http.StatusOK)
+	if n := api.runJobs(t); n != 2 {
+		t.Fatalf("ran %d jobs, want 2", n)
+	}
+	wantStored(t, api.cfg.videoStore, *first.VideoURL, true)
+	wantStored(t, api.cfg.videoStore, *first.HLSURL, true)
+	wantStored(t, api.cfg.videoStore, *video.VideoURL, false)
+	if v := api.videoVersion(t, video.ID, 1); v.DeletedAt != nil {
+		t.Errorf("the current version was deleted")
+	}
+}
+
+func TestRetireVersionJobKeepsSharedMedia(t *testing.T) {
+	api := newTestAPI(t)
+	user, _ := api.createUser(t, "owner@example.com")
+	api.cfg.videoVersionRetention = -time.Second
+	video := storeTestVideo(t, api, api.createVideo(t, user.ID), []byte("video"))
+	// The same upload again shares the stored media.
+	copied := storeTestVideo(t, api, api.createVideo(t, user.ID), []byte("video"))
+	shared := *video.VideoURL
+	playlist := *video.HLSURL
+
+	storeTestVideo(t, api, video, []byte("newer video"))
+	if n := api.runJobs(t); n != 1 {
+		t.Fatalf("ran %d jobs, want 1", n)
+	}
+	// The copy still plays it.
+	wantStored(t, api.cfg.videoStore, shared, true)
+	wantStored(t, api.cfg.videoStore, playlist, true)
+	if _, err := api.db.GetBlob(shared); err != nil {
+		t.Errorf("GetBlob of the shared media: %v", err)
+	}
+
+	// Until the copy moves on too.
+	storeTestVideo(t, api, copied, []byte("another video"))
+	if n := api.runJobs(t); n != 1 {
+		t.Fatalf("ran %d jobs, want 1", n)
+	}
+	wantStored(t, api.cfg.videoStore, shared, false)
+	wantStored(t, api.cfg.videoStore, playlist, false)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"mime"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	mime.AddExtensionType(".m3u8", "application/vnd.apple.mpegurl")
+	mime.AddExtensionType(".ts", "video/mp2t")
+}
+
+// packageHLS transcodes filePath into every rendition of the ladder, writes a
+// master playlist next to them and stores the whole tree under keyPrefix. It
+// returns the key of the master playlist.
+func (cfg *apiConfig) packageHLS(ctx context.Context, filePath string, probe mediaProbe, keyPrefix string) (string, error) {
+	src, ok := probe.videoStream()
+	if !ok {
+		return "", errNoVideoStream
+	}
+	_, hasAudio := probe.audioStream()
+	width, height := src.displaySize()
+	renditions := planRenditions(cfg.renditionLadder, width, height, probe.frameRate())
+
+	outDir, err := os.MkdirTemp("", "tubely-hls-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(outDir)
+
+	for _, r := range renditions {
+		if err := transcodeHLSRendition(ctx, filePath, filepath.Join(outDir, r.Name), r); err != nil {
+			return "", fmt.Errorf("couldn't transcode %s rendition: %w", r.Name, err)
+		}
+	}
+	err = os.WriteFile(filepath.Join(outDir, "master.m3u8"), []byte(hlsMasterPlaylist(renditions, hasAudio)), 0644)
+	if err != nil {
+		return "", err
+	}
+
+	if err := cfg.putTree(ctx, outDir, keyPrefix); err != nil {
+		return "", err
+	}
+	return path.Join(keyPrefix, "master.m3u8"), nil
+}
+
+func transcodeHLSRendition(ctx context.Context, filePath, outDir string, r rendition) error {
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, "ffmpeg",
+		"-v", "error",
+		"-i", filePath,
+		"-map", "0:v:0",
+		"-map", "0:a:0?",
+		"-vf", fmt.Sprintf("scale=%d:%d", r.Width, r.Height),
+		"-c:v", "libx264",
+		"-preset", "veryfast",
+		"-profile:v", "high",
+		"-level:v", fmt.Sprintf("%d.%d", r.Level/10, r.Level%10),
+		"-b:v", fmt.Sprintf("%dk", r.VideoBitrate),
+		"-maxrate", fmt.Sprintf("%dk", r.VideoBitrate*107/100),
+		"-bufsize", fmt.Sprintf("%dk", r.VideoBitrate*3/2),
+		"-force_key_frames", fmt.Sprintf("expr:gte(t,n_forced*%d)", segmentSeconds),
+		"-sc_threshold", "0",
+		"-c:a", "aac",
+		"-b:a", fmt.Sprintf("%dk", r.AudioBitrate),
+		"-ac", "2",
+		"-f", "hls",
+		"-hls_time", strconv.Itoa(segmentSeconds),
+		"-hls_playlist_type", "vod",
+		"-hls_segment_filename", filepath.Join(outDir, "segment_%04d.ts"),
+		filepath.Join(outDir, "index.m3u8"),
+	)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+func hlsMasterPlaylist(renditions []rendition, hasAudio bool) string {
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+	for _, r := range renditions {
+		bandwidth := r.VideoBitrate * 1000
+		if hasAudio {
+			bandwidth += r.AudioBitrate * 1000
+		}
+		fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d,RESOLUTION=%dx%d,CODECS=\"%s\"\n", bandwidth, r.Width, r.Height, r.codecs(hasAudio))
+		fmt.Fprintf(&b, "%s/index.m3u8\n", r.Name)
+	}
+	return b.String()
+}
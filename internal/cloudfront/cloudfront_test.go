@@ -0,0 +1,230 @@
+package cloudfront
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const keyPairID = "K2JCJMDEHXQW5F"
+
+var expires = time.Unix(1700000000, 0)
+
+func newTestSigner(t *testing.T) (*Signer, *rsa.PrivateKey) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewSigner(keyPairID, key), key
+}
+
+// decode reverses encode.
+func decode(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := base64.StdEncoding.DecodeString(strings.NewReplacer("-", "+", "_", "=", "~", "/").Replace(s))
+	if err != nil {
+		t.Fatalf("decoding %q: %v", s, err)
+	}
+	return b
+}
+
+// verify checks sig is the key's signature of doc, the way CloudFront does.
+func verify(t *testing.T, key *rsa.PrivateKey, doc []byte, sig string) {
+	t.Helper()
+	hash := sha1.Sum(doc)
+	if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA1, hash[:], decode(t, sig)); err != nil {
+		t.Errorf("signature doesn't verify for %s: %v", doc, err)
+	}
+}
+
+func TestEncode(t *testing.T) {
+	// Standard base64 of these bytes is "+/8=", with every character
+	// CloudFront swaps.
+	if got := encode([]byte{0xfb, 0xff}); got != "-~8_" {
+		t.Errorf("encode = %q, want %q", got, "-~8_")
+	}
+	data := []byte("{\"Statement\":[{\"Resource\":\"https://d111111abcdef8.cloudfront.net/*?\"}]}\xfb\xff\xfe")
+	encoded := encode(data)
+	if strings.ContainsAny(encoded, "+/=") {
+		t.Errorf("encode(%q) = %q, which isn't safe in a query string", data, encoded)
+	}
+	if got := decode(t, encoded); string(got) != string(data) {
+		t.Errorf("encode doesn't round trip: got %q, want %q", got, data)
+	}
+}
+
+func TestPolicyDocument(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy Policy
+		want   string
+	}{
+		{
+			name:   "canned",
+			policy: Policy{Resource: "https://d111111abcdef8.cloudfront.net/a.mp4?x=1&y=2", Expires: expires},
+			want:   `{"Statement":[{"Resource":"https://d111111abcdef8.cloudfront.net/a.mp4?x=1&y=2","Condition":{"DateLessThan":{"AWS:EpochTime":1700000000}}}]}`,
+		},
+		{
+			name:   "IPv4 address",
+			policy: Policy{Resource: "https://d111111abcdef8.cloudfront.net/videos/*", Expires: expires, IPAddress: "203.0.113.7"},
+			want:   `{"Statement":[{"Resource":"https://d111111abcdef8.cloudfront.net/videos/*","Condition":{"DateLessThan":{"AWS:EpochTime":1700000000},"IpAddress":{"AWS:SourceIp":"203.0.113.7/32"}}}]}`,
+		},
+		{
+			name:   "IPv6 address",
+			policy: Policy{Resource: "https://d111111abcdef8.cloudfront.net/videos/*", Expires: expires, IPAddress: "2001:db8::1"},
+			want:   `{"Statement":[{"Resource":"https://d111111abcdef8.cloudfront.net/videos/*","Condition":{"DateLessThan":{"AWS:EpochTime":1700000000},"IpAddress":{"AWS:SourceIp":"2001:db8::1/128"}}}]}`,
+		},
+		{
+			name:   "CIDR range and start time",
+			policy: Policy{Resource: "https://d111111abcdef8.cloudfront.net/videos/*", Expires: expires, NotBefore: expires.Add(-time.Hour), IPAddress: "203.0.113.0/24"},
+			want:   `{"Statement":[{"Resource":"https://d111111abcdef8.cloudfront.net/videos/*","Condition":{"DateLessThan":{"AWS:EpochTime":1700000000},"DateGreaterThan":{"AWS:EpochTime":1699996400},"IpAddress":{"AWS:SourceIp":"203.0.113.0/24"}}}]}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, err := tt.policy.document()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(doc) != tt.want {
+				t.Errorf("document =\n%s\nwant\n%s", doc, tt.want)
+			}
+		})
+	}
+
+	if _, err := (Policy{Expires: expires}).document(); err == nil {
+		t.Errorf("document of a policy without a resource didn't fail")
+	}
+	if _, err := (Policy{Resource: "https://d111111abcdef8.cloudfront.net/a.mp4"}).document(); err == nil {
+		t.Errorf("document of a policy without an expiry didn't fail")
+	}
+}
+
+func TestSignURL(t *testing.T) {
+	signer, key := newTestSigner(t)
+	const rawURL = "https://d111111abcdef8.cloudfront.net/landscape/a.mp4?width=1280"
+
+	tests := []struct {
+		name   string
+		policy Policy
+		canned bool
+	}{
+		{"expiry only", Policy{Expires: expires}, true},
+		{"resource is the URL", Policy{Resource: rawURL, Expires: expires}, true},
+		{"IP restricted", Policy{Expires: expires, IPAddress: "203.0.113.7"}, false},
+		{"start time", Policy{Expires: expires, NotBefore: expires.Add(-time.Hour)}, false},
+		{"wildcard resource", Policy{Resource: "https://d111111abcdef8.cloudfront.net/landscape/*", Expires: expires}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signed, err := signer.SignURL(rawURL, tt.policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(signed, rawURL+"&") {
+				t.Errorf("signed URL %s doesn't keep the original URL", signed)
+			}
+			u, err := url.Parse(signed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Parsed by hand, so the values are checked exactly as
+			// they were sent.
+			params := map[string]string{}
+			for _, param := range strings.Split(u.RawQuery, "&") {
+				name, value, _ := strings.Cut(param, "=")
+				params[name] = value
+			}
+			if params["Key-Pair-Id"] != keyPairID {
+				t.Errorf("Key-Pair-Id = %q, want %q", params["Key-Pair-Id"], keyPairID)
+			}
+
+			var doc []byte
+			if tt.canned {
+				if params["Expires"] != "1700000000" || params["Policy"] != "" {
+					t.Fatalf("signed URL %s doesn't use a canned policy", signed)
+				}
+				// CloudFront rebuilds the canned policy from the URL.
+				doc = []byte(`{"Statement":[{"Resource":"` + rawURL + `","Condition":{"DateLessThan":{"AWS:EpochTime":1700000000}}}]}`)
+			} else {
+				if params["Policy"] == "" || params["Expires"] != "" {
+					t.Fatalf("signed URL %s doesn't use a custom policy", signed)
+				}
+				doc = decode(t, params["Policy"])
+				want := tt.policy
+				if want.Resource == "" {
+					want.Resource = rawURL
+				}
+				wantDoc, err := want.document()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(doc) != string(wantDoc) {
+					t.Errorf("Policy = %s, want %s", doc, wantDoc)
+				}
+			}
+			verify(t, key, doc, params["Signature"])
+		})
+	}
+}
+
+func TestSignedCookies(t *testing.T) {
+	signer, key := newTestSigner(t)
+	policy := Policy{Resource: "https://d111111abcdef8.cloudfront.net/landscape/abc/*", Expires: expires, IPAddress: "203.0.113.7"}
+	cookies, err := signer.SignedCookies(policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]string{}
+	for _, c := range cookies {
+		values[c.Name] = c.Value
+		if !c.Secure || !c.HttpOnly || !c.Expires.Equal(expires) {
+			t.Errorf("cookie %s = %+v, want secure, HTTP only and expiring with the policy", c.Name, c)
+		}
+	}
+	if values["CloudFront-Key-Pair-Id"] != keyPairID {
+		t.Errorf("CloudFront-Key-Pair-Id = %q, want %q", values["CloudFront-Key-Pair-Id"], keyPairID)
+	}
+	doc := decode(t, values["CloudFront-Policy"])
+	wantDoc, err := policy.document()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(doc) != string(wantDoc) {
+		t.Errorf("CloudFront-Policy = %s, want %s", doc, wantDoc)
+	}
+	verify(t, key, doc, values["CloudFront-Signature"])
+}
+
+func TestParsePrivateKey(t *testing.T) {
+	_, key := newTestSigner(t)
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, block := range []*pem.Block{
+		{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)},
+		{Type: "PRIVATE KEY", Bytes: pkcs8},
+	} {
+		parsed, err := ParsePrivateKey(pem.EncodeToMemory(block))
+		if err != nil {
+			t.Errorf("ParsePrivateKey of a %s: %v", block.Type, err)
+			continue
+		}
+		if !parsed.Equal(key) {
+			t.Errorf("ParsePrivateKey of a %s returned another key", block.Type)
+		}
+	}
+	if _, err := ParsePrivateKey([]byte("not a key")); err == nil {
+		t.Errorf("ParsePrivateKey of garbage didn't fail")
+	}
+}
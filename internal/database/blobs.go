@@ -0,0 +1,179 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ErrBlobReleased is returned when acquiring a blob whose last reference was
+// released and whose objects are being deleted. It can be acquired again
+// once ForgetBlob has run.
+var ErrBlobReleased = errors.New("blob is being deleted")
+
+// Blob is a video's media stored under a key derived from its content, so
+// every upload of the same file shares it. RefCount is the number of video
+// versions, and uploads in progress, using it. A blob is recorded before its
+// objects are uploaded, Stored says when they are. After the last reference
+// is released the row stays, with RefCount 0, until the objects have been
+// deleted, so nothing can reuse or re-upload them in the meantime.
+type Blob struct {
+	// Key is the MP4's key. The streaming packages, if any, were made from
+	// it and live next to it.
+	Key        string    `json:"key"`
+	HLSKey     *string   `json:"hls_key"`
+	DASHKey    *string   `json:"dash_key"`
+	Encryption string    `json:"encryption"`
+	RefCount   int       `json:"ref_count"`
+	Stored     bool      `json:"stored"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+const blobColumns = `
+		key,
+		hls_key,
+		dash_key,
+		encryption,
+		ref_count,
+		stored,
+		created_at`
+
+func scanBlob(row interface{ Scan(...any) error }) (Blob, error) {
+	var blob Blob
+	err := row.Scan(
+		&blob.Key,
+		&blob.HLSKey,
+		&blob.DASHKey,
+		&blob.Encryption,
+		&blob.RefCount,
+		&blob.Stored,
+		&blob.CreatedAt)
+	return blob, err
+}
+
+func (c Client) GetBlob(key string) (Blob, error) {
+	query := `SELECT` + blobColumns + `
+	FROM blob_refs
+	WHERE key = ?
+	`
+	blob, err := scanBlob(c.db.QueryRow(query, key))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Blob{}, ErrNotFound
+		}
+		return Blob{}, err
+	}
+	return blob, nil
+}
+
+// GetReleasedBlobs returns the blobs whose objects are waiting to be deleted.
+func (c Client) GetReleasedBlobs() ([]Blob, error) {
+	query := `SELECT` + blobColumns + `
+	FROM blob_refs
+	WHERE ref_count <= 0
+	ORDER BY created_at
+	`
+	rows, err := c.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	blobs := []Blob{}
+	for rows.Next() {
+		blob, err := scanBlob(rows)
+		if err != nil {
+			return nil, err
+		}
+		blobs = append(blobs, blob)
+	}
+	return blobs, rows.Err()
+}
+
+// AcquireBlob adds a reference to the blob, recording it, not yet stored, if
+// it's new. An existing blob keeps its packages and encryption, which are
+// returned. A released blob can't be acquired, see ErrBlobReleased.
+func (c Client) AcquireBlob(blob Blob) (Blob, error) {
+	query := `
+	INSERT INTO blob_refs (
+		key,
+		created_at,
+		hls_key,
+		dash_key,
+		encryption,
+		ref_count,
+		stored
+	) VALUES (?, CURRENT_TIMESTAMP, ?, ?, ?, 1, FALSE)
+	ON CONFLICT(key) DO UPDATE SET ref_count = blob_refs.ref_count + 1
+	WHERE blob_refs.ref_count > 0
+	RETURNING` + blobColumns
+	acquired, err := scanBlob(c.db.QueryRow(query, blob.Key, blob.HLSKey, blob.DASHKey, blob.Encryption))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Blob{}, ErrBlobReleased
+	}
+	if err != nil {
+		return Blob{}, err
+	}
+	return acquired, nil
+}
+
+// MarkBlobStored records that the blob's objects have been uploaded, along
+// with its streaming packages.
+func (c Client) MarkBlobStored(blob Blob) error {
+	query := `
+	UPDATE blob_refs
+	SET
+		hls_key = ?,
+		dash_key = ?,
+		stored = TRUE
+	WHERE key = ?
+	`
+	_, err := c.db.Exec(query, blob.HLSKey, blob.DASHKey, blob.Key)
+	return err
+}
+
+// ReleaseBlob drops a reference that isn't held by a video version, see
+// ReleaseVideoVersion for those. It reports whether the blob is now
+// unreferenced, in which case its objects should be deleted and the blob
+// forgotten.
+func (c Client) ReleaseBlob(key string) (bool, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	unreferenced, err := releaseBlob(tx, key)
+	if err != nil {
+		return false, err
+	}
+	return unreferenced, tx.Commit()
+}
+
+// releaseBlob drops one reference to key. The row stays with the last one,
+// see Blob. Keys without a row, like media stored before deduplication, are
+// never shared, so they're unreferenced as soon as they're released.
+func releaseBlob(tx tx, key string) (bool, error) {
+	var refCount int
+	query := `
+	UPDATE blob_refs
+	SET ref_count = ref_count - 1
+	WHERE key = ? AND ref_count > 0
+	RETURNING ref_count
+	`
+	err := tx.QueryRow(query, key).Scan(&refCount)
+	if errors.Is(err, sql.ErrNoRows) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return refCount == 0, nil
+}
+
+// ForgetBlob deletes a released blob once its objects are gone, so the same
+// content can be stored again.
+func (c Client) ForgetBlob(key string) error {
+	_, err := c.db.Exec("DELETE FROM blob_refs WHERE key = ? AND ref_count <= 0", key)
+	return err
+}
@@ -0,0 +1,106 @@
+package database
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+)
+
+// dialect is the SQL engine behind a Client. Queries are written once, with ?
+// placeholders and SQL both engines understand; the few differences are
+// handled here.
+type dialect string
+
+const (
+	sqlite   dialect = "sqlite"
+	postgres dialect = "postgres"
+)
+
+// dialectOf tells Postgres URLs apart from SQLite paths.
+func dialectOf(dataSource string) dialect {
+	if strings.HasPrefix(dataSource, "postgres://") || strings.HasPrefix(dataSource, "postgresql://") {
+		return postgres
+	}
+	return sqlite
+}
+
+// rebind rewrites the ? placeholders of query to the dialect's.
+func (d dialect) rebind(query string) string {
+	if d != postgres || !strings.Contains(query, "?") {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	quoted := false
+	for _, r := range query {
+		switch {
+		case r == '\'':
+			quoted = !quoted
+		case r == '?' && !quoted:
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// skipLocked is appended to a subquery selecting rows to update, so
+// concurrent updates each get a different row. SQLite has a single writer
+// anyway.
+func (d dialect) skipLocked() string {
+	if d == postgres {
+		return " FOR UPDATE SKIP LOCKED"
+	}
+	return ""
+}
+
+// timestamp is the column type of timestamps.
+func (d dialect) timestamp() string {
+	if d == postgres {
+		return "TIMESTAMPTZ"
+	}
+	return "TIMESTAMP"
+}
+
+// db runs queries written with ? placeholders against the dialect.
+type db struct {
+	*sql.DB
+	dialect dialect
+}
+
+func (db db) Exec(query string, args ...any) (sql.Result, error) {
+	return db.DB.Exec(db.dialect.rebind(query), args...)
+}
+
+func (db db) Query(query string, args ...any) (*sql.Rows, error) {
+	return db.DB.Query(db.dialect.rebind(query), args...)
+}
+
+func (db db) QueryRow(query string, args ...any) *sql.Row {
+	return db.DB.QueryRow(db.dialect.rebind(query), args...)
+}
+
+func (db db) Begin() (tx, error) {
+	sqlTx, err := db.DB.Begin()
+	return tx{sqlTx, db.dialect}, err
+}
+
+// tx is db's transaction.
+type tx struct {
+	*sql.Tx
+	dialect dialect
+}
+
+func (tx tx) Exec(query string, args ...any) (sql.Result, error) {
+	return tx.Tx.Exec(tx.dialect.rebind(query), args...)
+}
+
+func (tx tx) Query(query string, args ...any) (*sql.Rows, error) {
+	return tx.Tx.Query(tx.dialect.rebind(query), args...)
+}
+
+func (tx tx) QueryRow(query string, args ...any) *sql.Row {
+	return tx.Tx.QueryRow(tx.dialect.rebind(query), args...)
+}
@@ -0,0 +1,272 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type JobStatus string
+
+const (
+	JobStatusQueued  JobStatus = "queued"
+	JobStatusRunning JobStatus = "running"
+	JobStatusDone    JobStatus = "done"
+	JobStatusFailed  JobStatus = "failed"
+)
+
+type Job struct {
+	ID        uuid.UUID `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Status    JobStatus `json:"status"`
+	Attempts  int       `json:"attempts"`
+	LastError *string   `json:"last_error"`
+	// LockedUntil is when a running job's lease runs out, see ClaimJob.
+	LockedUntil *time.Time `json:"locked_until"`
+	CreateJobParams
+}
+
+type CreateJobParams struct {
+	Kind        string     `json:"kind"`
+	VideoID     *uuid.UUID `json:"video_id"`
+	Payload     string     `json:"payload"`
+	MaxAttempts int        `json:"max_attempts"`
+	RunAt       time.Time  `json:"run_at"`
+}
+
+const jobColumns = `
+		id,
+		created_at,
+		updated_at,
+		kind,
+		video_id,
+		payload,
+		status,
+		attempts,
+		max_attempts,
+		run_at,
+		last_error,
+		locked_until`
+
+func scanJob(row interface{ Scan(...any) error }) (Job, error) {
+	var job Job
+	err := row.Scan(
+		&job.ID,
+		&job.CreatedAt,
+		&job.UpdatedAt,
+		&job.Kind,
+		&job.VideoID,
+		&job.Payload,
+		&job.Status,
+		&job.Attempts,
+		&job.MaxAttempts,
+		&job.RunAt,
+		&job.LastError,
+		&job.LockedUntil)
+	return job, err
+}
+
+func (c Client) CreateJob(params CreateJobParams) (Job, error) {
+	id, err := createJob(c.db, params)
+	if err != nil {
+		return Job{}, err
+	}
+	return c.GetJob(id)
+}
+
+// CreateVideoJob sets the video's status and queues a job for it together,
+// so a video is never left waiting for a job that doesn't exist. It returns
+// ErrNotFound if the video doesn't exist.
+func (c Client) CreateVideoJob(status VideoStatus, params CreateJobParams) (Job, error) {
+	if params.VideoID == nil {
+		return Job{}, errors.New("job has no video")
+	}
+	tx, err := c.db.Begin()
+	if err != nil {
+		return Job{}, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("UPDATE videos SET status = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?", status, *params.VideoID)
+	if err != nil {
+		return Job{}, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		if err == nil {
+			err = ErrNotFound
+		}
+		return Job{}, err
+	}
+	id, err := createJob(tx, params)
+	if err != nil {
+		return Job{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Job{}, err
+	}
+	return c.GetJob(id)
+}
+
+func createJob(q interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}, params CreateJobParams) (uuid.UUID, error) {
+	id := uuid.New()
+	if params.RunAt.IsZero() {
+		params.RunAt = time.Now()
+	}
+	query := `
+	INSERT INTO jobs (
+		id,
+		created_at,
+		updated_at,
+		kind,
+		video_id,
+		payload,
+		status,
+		attempts,
+		max_attempts,
+		run_at
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?, 0, ?, ?)
+	`
+	_, err := q.Exec(query, id, params.Kind, params.VideoID, params.Payload, JobStatusQueued, params.MaxAttempts, params.RunAt.UTC())
+	return id, err
+}
+
+func (c Client) GetJob(id uuid.UUID) (Job, error) {
+	query := `SELECT` + jobColumns + `
+	FROM jobs
+	WHERE id = ?
+	`
+	job, err := scanJob(c.db.QueryRow(query, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Job{}, ErrNotFound
+		}
+		return Job{}, err
+	}
+	return job, nil
+}
+
+// JobLeaseExpired is the last error of a job whose lease ran out on its last
+// attempt.
+const JobLeaseExpired = "lease ran out on the last attempt"
+
+// ClaimJob marks the oldest job that is due as running, leased to the caller
+// until lockedUntil, and returns it, or nil when there's nothing to do. Jobs
+// still running whose lease ran out are due again: their worker is presumed
+// dead. If that was their last attempt they are marked failed instead, and
+// returned as such for the caller to clean up after. The select and update
+// happen in a single statement so two workers can't claim the same job.
+func (c Client) ClaimJob(now, lockedUntil time.Time) (*Job, error) {
+	now = now.UTC()
+	failQuery := `
+	UPDATE jobs
+	SET
+		status = ?,
+		last_error = ?,
+		locked_until = NULL,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = (
+		SELECT id FROM jobs
+		WHERE status = ? AND (locked_until IS NULL OR locked_until < ?) AND attempts >= max_attempts
+		ORDER BY run_at
+		LIMIT 1` + c.db.dialect.skipLocked() + `
+	)
+	RETURNING` + jobColumns
+	job, err := scanJob(c.db.QueryRow(failQuery, JobStatusFailed, JobLeaseExpired, JobStatusRunning, now))
+	if err == nil {
+		return &job, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	query := `
+	UPDATE jobs
+	SET
+		status = ?,
+		attempts = attempts + 1,
+		locked_until = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = (
+		SELECT id FROM jobs
+		WHERE (status = ? AND run_at <= ?)
+			OR (status = ? AND (locked_until IS NULL OR locked_until < ?) AND attempts < max_attempts)
+		ORDER BY run_at
+		LIMIT 1` + c.db.dialect.skipLocked() + `
+	)
+	RETURNING` + jobColumns
+	job, err = scanJob(c.db.QueryRow(query, JobStatusRunning, lockedUntil.UTC(), JobStatusQueued, now, JobStatusRunning, now))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &job, nil
+}
+
+// ExtendJobLease moves the lease of a running job to lockedUntil. The job is
+// identified by its attempt too, so a worker whose lease ran out and was
+// claimed by another one learns that it lost the job: it's reported with
+// false.
+func (c Client) ExtendJobLease(id uuid.UUID, attempt int, lockedUntil time.Time) (bool, error) {
+	query := `
+	UPDATE jobs
+	SET locked_until = ?
+	WHERE id = ? AND attempts = ? AND status = ?
+	`
+	res, err := c.db.Exec(query, lockedUntil.UTC(), id, attempt, JobStatusRunning)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (c Client) CompleteJob(id uuid.UUID) error {
+	query := `
+	UPDATE jobs
+	SET
+		status = ?,
+		last_error = NULL,
+		locked_until = NULL,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, JobStatusDone, id)
+	return err
+}
+
+// RetryJob puts a job back in the queue to run again at runAt.
+func (c Client) RetryJob(id uuid.UUID, runAt time.Time, lastError string) error {
+	query := `
+	UPDATE jobs
+	SET
+		status = ?,
+		run_at = ?,
+		last_error = ?,
+		locked_until = NULL,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, JobStatusQueued, runAt.UTC(), lastError, id)
+	return err
+}
+
+func (c Client) FailJob(id uuid.UUID, lastError string) error {
+	query := `
+	UPDATE jobs
+	SET
+		status = ?,
+		last_error = ?,
+		locked_until = NULL,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, JobStatusFailed, lastError, id)
+	return err
+}
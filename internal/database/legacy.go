@@ -0,0 +1,48 @@
+package database
+
+import (
+	"fmt"
+)
+
+// legacyColumns were added by autoMigrate, which predates migrations, after
+// their tables were first created. Databases it set up may lack some of them.
+var legacyColumns = []struct{ table, name, definition string }{
+	{"videos", "status", "TEXT NOT NULL DEFAULT ''"},
+	{"videos", "hls_url", "TEXT"},
+	{"videos", "dash_url", "TEXT"},
+	{"videos", "duration_seconds", "REAL NOT NULL DEFAULT 0"},
+	{"videos", "width", "INTEGER NOT NULL DEFAULT 0"},
+	{"videos", "height", "INTEGER NOT NULL DEFAULT 0"},
+	{"videos", "video_codec", "TEXT NOT NULL DEFAULT ''"},
+	{"videos", "audio_codec", "TEXT NOT NULL DEFAULT ''"},
+	{"videos", "bit_rate", "INTEGER NOT NULL DEFAULT 0"},
+	{"videos", "frame_rate", "REAL NOT NULL DEFAULT 0"},
+	{"videos", "audio_channel_layout", "TEXT NOT NULL DEFAULT ''"},
+	{"videos", "container_format", "TEXT NOT NULL DEFAULT ''"},
+	{"videos", "file_size", "INTEGER NOT NULL DEFAULT 0"},
+	{"videos", "thumbnails", "TEXT NOT NULL DEFAULT '[]'"},
+	{"videos", "version", "INTEGER NOT NULL DEFAULT 0"},
+	{"videos", "protected", "BOOLEAN NOT NULL DEFAULT FALSE"},
+	{"videos", "url_expiry_seconds", "INTEGER NOT NULL DEFAULT 0"},
+	{"videos", "restrict_ip", "BOOLEAN NOT NULL DEFAULT FALSE"},
+	{"videos", "encryption", "TEXT NOT NULL DEFAULT ''"},
+	{"video_versions", "encryption", "TEXT NOT NULL DEFAULT ''"},
+}
+
+func addLegacyColumns(tx tx) error {
+	for _, col := range legacyColumns {
+		var count int
+		err := tx.QueryRow("SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", col.table, col.name).Scan(&count)
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			continue
+		}
+		_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", col.table, col.name, col.definition))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,780 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	errForeignKey = errors.New("foreign key constraint failed")
+	errUnique     = errors.New("unique constraint failed")
+)
+
+// MemoryStore is a Store that keeps everything in memory, for tests and
+// development. It behaves like Client, down to the constraints the schema
+// enforces, so the two can be swapped.
+type MemoryStore struct {
+	mu            sync.Mutex
+	users         map[uuid.UUID]User
+	refreshTokens map[string]RefreshToken
+	videos        map[uuid.UUID]Video
+	versions      map[uuid.UUID]VideoVersion
+	blobs         map[string]Blob
+	uploads       map[uuid.UUID]Upload
+	jobs          map[uuid.UUID]Job
+}
+
+func NewMemoryStore() *MemoryStore {
+	s := &MemoryStore{}
+	s.reset()
+	return s
+}
+
+func (s *MemoryStore) reset() {
+	s.users = map[uuid.UUID]User{}
+	s.refreshTokens = map[string]RefreshToken{}
+	s.videos = map[uuid.UUID]Video{}
+	s.versions = map[uuid.UUID]VideoVersion{}
+	s.blobs = map[string]Blob{}
+	s.uploads = map[uuid.UUID]Upload{}
+	s.jobs = map[uuid.UUID]Job{}
+}
+
+func (s *MemoryStore) Reset() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reset()
+	return nil
+}
+
+// now is what CURRENT_TIMESTAMP is to Client.
+func now() time.Time {
+	return time.Now().UTC()
+}
+
+// Stored values are copied on the way in and out so callers can't change
+// them behind the store's back.
+
+func clonePtr[T any](p *T) *T {
+	if p == nil {
+		return nil
+	}
+	v := *p
+	return &v
+}
+
+func (v Video) clone() Video {
+	v.ThumbnailURL = clonePtr(v.ThumbnailURL)
+	v.Thumbnails = slices.Clone(v.Thumbnails)
+	if v.Thumbnails == nil {
+		v.Thumbnails = Thumbnails{}
+	}
+	v.VideoURL = clonePtr(v.VideoURL)
+	v.HLSURL = clonePtr(v.HLSURL)
+	v.DASHURL = clonePtr(v.DASHURL)
+	return v
+}
+
+func (v VideoVersion) clone() VideoVersion {
+	v.ExpiresAt = clonePtr(v.ExpiresAt)
+	v.DeletedAt = clonePtr(v.DeletedAt)
+	v.VideoURL = clonePtr(v.VideoURL)
+	v.HLSURL = clonePtr(v.HLSURL)
+	v.DASHURL = clonePtr(v.DASHURL)
+	return v
+}
+
+func (b Blob) clone() Blob {
+	b.HLSKey = clonePtr(b.HLSKey)
+	b.DASHKey = clonePtr(b.DASHKey)
+	return b
+}
+
+func (j Job) clone() Job {
+	j.LastError = clonePtr(j.LastError)
+	j.VideoID = clonePtr(j.VideoID)
+	j.LockedUntil = clonePtr(j.LockedUntil)
+	return j
+}
+
+func (s *MemoryStore) GetVideos(userID uuid.UUID) ([]Video, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	videos := s.sortedVideos(func(v Video) bool { return v.UserID == userID })
+	slices.Reverse(videos)
+	return videos, nil
+}
+
+func (s *MemoryStore) GetAllVideos() ([]Video, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sortedVideos(func(Video) bool { return true }), nil
+}
+
+// sortedVideos returns the videos matching keep, oldest first.
+func (s *MemoryStore) sortedVideos(keep func(Video) bool) []Video {
+	videos := []Video{}
+	for _, video := range s.videos {
+		if keep(video) {
+			videos = append(videos, video.clone())
+		}
+	}
+	slices.SortFunc(videos, func(a, b Video) int {
+		if c := a.CreatedAt.Compare(b.CreatedAt); c != 0 {
+			return c
+		}
+		return slices.Compare(a.ID[:], b.ID[:])
+	})
+	return videos
+}
+
+func (s *MemoryStore) CreateVideo(params CreateVideoParams) (Video, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[params.UserID]; !ok {
+		return Video{}, fmt.Errorf("%w: video's user %s", errForeignKey, params.UserID)
+	}
+	created := now()
+	video := Video{
+		ID:                uuid.New(),
+		CreatedAt:         created,
+		UpdatedAt:         created,
+		Thumbnails:        Thumbnails{},
+		Status:            VideoStatusCreated,
+		CreateVideoParams: params,
+	}
+	s.videos[video.ID] = video
+	return video.clone(), nil
+}
+
+func (s *MemoryStore) GetVideo(id uuid.UUID) (Video, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	video, ok := s.videos[id]
+	if !ok {
+		return Video{}, ErrNotFound
+	}
+	return video.clone(), nil
+}
+
+// UpdateVideo updates what Client.UpdateVideo does, leaving status, access
+// and timestamps alone.
+func (s *MemoryStore) UpdateVideo(video Video) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.videos[video.ID]
+	if !ok {
+		return nil
+	}
+	if _, ok := s.users[video.UserID]; !ok {
+		return fmt.Errorf("%w: video's user %s", errForeignKey, video.UserID)
+	}
+	video = video.clone()
+	stored.CreateVideoParams = video.CreateVideoParams
+	stored.ThumbnailURL = video.ThumbnailURL
+	stored.Thumbnails = video.Thumbnails
+	stored.VideoURL = video.VideoURL
+	stored.HLSURL = video.HLSURL
+	stored.DASHURL = video.DASHURL
+	stored.Metadata = video.Metadata
+	stored.Version = video.Version
+	stored.Encryption = video.Encryption
+	s.videos[video.ID] = stored
+	return nil
+}
+
+func (s *MemoryStore) DeleteVideo(id uuid.UUID) ([]VideoVersion, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	released := []VideoVersion{}
+	for versionID, version := range s.versions {
+		if version.VideoID != id {
+			continue
+		}
+		if s.releaseVideoVersion(versionID) {
+			released = append(released, version.clone())
+		}
+		delete(s.versions, versionID)
+	}
+	slices.SortFunc(released, func(a, b VideoVersion) int { return b.Version - a.Version })
+	for uploadID, upload := range s.uploads {
+		if upload.VideoID == id {
+			delete(s.uploads, uploadID)
+		}
+	}
+	delete(s.videos, id)
+	return released, nil
+}
+
+func (s *MemoryStore) UpdateVideoStatus(id uuid.UUID, status VideoStatus) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	video, ok := s.videos[id]
+	if !ok {
+		return nil
+	}
+	video.Status = status
+	video.UpdatedAt = now()
+	s.videos[id] = video
+	return nil
+}
+
+func (s *MemoryStore) UpdateVideoThumbnails(id uuid.UUID, thumbnailURL *string, thumbnails Thumbnails) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	video, ok := s.videos[id]
+	if !ok {
+		return nil
+	}
+	video.ThumbnailURL = clonePtr(thumbnailURL)
+	video.Thumbnails = slices.Clone(thumbnails)
+	video.UpdatedAt = now()
+	s.videos[id] = video
+	return nil
+}
+
+func (s *MemoryStore) UpdateVideoAccess(id uuid.UUID, access VideoAccess) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	video, ok := s.videos[id]
+	if !ok {
+		return nil
+	}
+	video.Access = access
+	video.UpdatedAt = now()
+	s.videos[id] = video
+	return nil
+}
+
+func (s *MemoryStore) CreateVideoVersion(params CreateVideoVersionParams) (VideoVersion, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.videos[params.VideoID]; !ok {
+		return VideoVersion{}, fmt.Errorf("%w: version's video %s", errForeignKey, params.VideoID)
+	}
+	latest := 0
+	for _, version := range s.versions {
+		if version.VideoID == params.VideoID {
+			latest = max(latest, version.Version)
+		}
+	}
+	version := VideoVersion{
+		ID:                       uuid.New(),
+		CreatedAt:                now(),
+		Version:                  latest + 1,
+		CreateVideoVersionParams: params,
+	}.clone()
+	s.versions[version.ID] = version
+	return version.clone(), nil
+}
+
+func (s *MemoryStore) GetVideoVersions(videoID uuid.UUID) ([]VideoVersion, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	versions := []VideoVersion{}
+	for _, version := range s.versions {
+		if version.VideoID == videoID {
+			versions = append(versions, version.clone())
+		}
+	}
+	slices.SortFunc(versions, func(a, b VideoVersion) int { return b.Version - a.Version })
+	return versions, nil
+}
+
+func (s *MemoryStore) GetVideoVersion(videoID uuid.UUID, number int) (VideoVersion, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, version := range s.versions {
+		if version.VideoID == videoID && version.Version == number {
+			return version.clone(), nil
+		}
+	}
+	return VideoVersion{}, ErrNotFound
+}
+
+func (s *MemoryStore) GetVideoVersionByID(id uuid.UUID) (VideoVersion, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	version, ok := s.versions[id]
+	if !ok {
+		return VideoVersion{}, ErrNotFound
+	}
+	return version.clone(), nil
+}
+
+func (s *MemoryStore) ExpireVideoVersion(id uuid.UUID, expiresAt *time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	version, ok := s.versions[id]
+	if !ok {
+		return nil
+	}
+	version.ExpiresAt = nil
+	if expiresAt != nil {
+		utc := expiresAt.UTC()
+		version.ExpiresAt = &utc
+	}
+	s.versions[id] = version
+	return nil
+}
+
+func (s *MemoryStore) ReleaseVideoVersion(id uuid.UUID) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.releaseVideoVersion(id), nil
+}
+
+// releaseVideoVersion is the counterpart of the package's
+// releaseVideoVersion.
+func (s *MemoryStore) releaseVideoVersion(id uuid.UUID) bool {
+	version, ok := s.versions[id]
+	if !ok || version.DeletedAt != nil {
+		return false
+	}
+	deletedAt := now()
+	version.DeletedAt = &deletedAt
+	s.versions[id] = version
+	if version.VideoURL == nil {
+		return true
+	}
+	return s.releaseBlob(*version.VideoURL)
+}
+
+func (s *MemoryStore) GetBlob(key string) (Blob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	blob, ok := s.blobs[key]
+	if !ok {
+		return Blob{}, ErrNotFound
+	}
+	return blob.clone(), nil
+}
+
+func (s *MemoryStore) GetReleasedBlobs() ([]Blob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	blobs := []Blob{}
+	for _, blob := range s.blobs {
+		if blob.RefCount <= 0 {
+			blobs = append(blobs, blob.clone())
+		}
+	}
+	slices.SortFunc(blobs, func(a, b Blob) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	return blobs, nil
+}
+
+func (s *MemoryStore) AcquireBlob(blob Blob) (Blob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.blobs[blob.Key]
+	if ok && stored.RefCount <= 0 {
+		return Blob{}, ErrBlobReleased
+	}
+	if ok {
+		stored.RefCount++
+	} else {
+		stored = Blob{
+			Key:        blob.Key,
+			HLSKey:     clonePtr(blob.HLSKey),
+			DASHKey:    clonePtr(blob.DASHKey),
+			Encryption: blob.Encryption,
+			RefCount:   1,
+			CreatedAt:  now(),
+		}
+	}
+	s.blobs[blob.Key] = stored
+	return stored.clone(), nil
+}
+
+func (s *MemoryStore) MarkBlobStored(blob Blob) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.blobs[blob.Key]
+	if !ok {
+		return nil
+	}
+	stored.HLSKey = clonePtr(blob.HLSKey)
+	stored.DASHKey = clonePtr(blob.DASHKey)
+	stored.Stored = true
+	s.blobs[blob.Key] = stored
+	return nil
+}
+
+func (s *MemoryStore) ReleaseBlob(key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.releaseBlob(key), nil
+}
+
+// releaseBlob is the counterpart of the package's releaseBlob.
+func (s *MemoryStore) releaseBlob(key string) bool {
+	blob, ok := s.blobs[key]
+	if !ok || blob.RefCount <= 0 {
+		return true
+	}
+	blob.RefCount--
+	s.blobs[key] = blob
+	return blob.RefCount == 0
+}
+
+func (s *MemoryStore) ForgetBlob(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if blob, ok := s.blobs[key]; ok && blob.RefCount <= 0 {
+		delete(s.blobs, key)
+	}
+	return nil
+}
+
+func (s *MemoryStore) CreateUpload(params CreateUploadParams) (Upload, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.videos[params.VideoID]; !ok {
+		return Upload{}, fmt.Errorf("%w: upload's video %s", errForeignKey, params.VideoID)
+	}
+	if _, ok := s.users[params.UserID]; !ok {
+		return Upload{}, fmt.Errorf("%w: upload's user %s", errForeignKey, params.UserID)
+	}
+	created := now()
+	upload := Upload{
+		ID:                 uuid.New(),
+		CreatedAt:          created,
+		UpdatedAt:          created,
+		CreateUploadParams: params,
+	}
+	s.uploads[upload.ID] = upload
+	return upload, nil
+}
+
+func (s *MemoryStore) GetUpload(id uuid.UUID) (Upload, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	upload, ok := s.uploads[id]
+	if !ok {
+		return Upload{}, ErrNotFound
+	}
+	return upload, nil
+}
+
+func (s *MemoryStore) GetExpiredUploads(updatedBefore time.Time) ([]Upload, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	uploads := []Upload{}
+	for _, upload := range s.uploads {
+		if upload.UpdatedAt.Before(updatedBefore) {
+			uploads = append(uploads, upload)
+		}
+	}
+	slices.SortFunc(uploads, func(a, b Upload) int { return a.UpdatedAt.Compare(b.UpdatedAt) })
+	return uploads, nil
+}
+
+func (s *MemoryStore) UpdateUploadOffset(id uuid.UUID, from, to int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	upload, ok := s.uploads[id]
+	if !ok || upload.Offset != from {
+		return false, nil
+	}
+	upload.Offset = to
+	upload.UpdatedAt = now()
+	s.uploads[id] = upload
+	return true, nil
+}
+
+func (s *MemoryStore) DeleteUpload(id uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.uploads, id)
+	return nil
+}
+
+// GetUsers returns only IDs and emails, like Client.GetUsers.
+func (s *MemoryStore) GetUsers() ([]User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	users := []User{}
+	for _, user := range s.users {
+		users = append(users, User{ID: user.ID, CreateUserParams: CreateUserParams{Email: user.Email}})
+	}
+	return users, nil
+}
+
+func (s *MemoryStore) GetUserByEmail(email string) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, user := range s.users {
+		if user.Email == email {
+			return user, nil
+		}
+	}
+	return User{}, ErrNotFound
+}
+
+func (s *MemoryStore) GetUserByRefreshToken(token string) (*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rt, ok := s.refreshTokens[token]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	user, ok := s.users[rt.UserID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &user, nil
+}
+
+func (s *MemoryStore) CreateUser(params CreateUserParams) (*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, user := range s.users {
+		if user.Email == params.Email {
+			return nil, fmt.Errorf("%w: email %s", errUnique, params.Email)
+		}
+	}
+	created := now()
+	user := User{
+		ID:               uuid.New(),
+		CreatedAt:        created,
+		UpdatedAt:        created,
+		CreateUserParams: params,
+	}
+	s.users[user.ID] = user
+	return &user, nil
+}
+
+func (s *MemoryStore) GetUser(id uuid.UUID) (*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &user, nil
+}
+
+func (s *MemoryStore) DeleteUser(id uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, rt := range s.refreshTokens {
+		if rt.UserID == id {
+			return fmt.Errorf("%w: user %s has refresh tokens", errForeignKey, id)
+		}
+	}
+	for _, video := range s.videos {
+		if video.UserID == id {
+			return fmt.Errorf("%w: user %s has videos", errForeignKey, id)
+		}
+	}
+	for _, upload := range s.uploads {
+		if upload.UserID == id {
+			return fmt.Errorf("%w: user %s has uploads", errForeignKey, id)
+		}
+	}
+	delete(s.users, id)
+	return nil
+}
+
+func (s *MemoryStore) CreateRefreshToken(params CreateRefreshTokenParams) (RefreshToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[params.UserID]; !ok {
+		return RefreshToken{}, fmt.Errorf("%w: refresh token's user %s", errForeignKey, params.UserID)
+	}
+	if _, ok := s.refreshTokens[params.Token]; ok {
+		return RefreshToken{}, fmt.Errorf("%w: refresh token", errUnique)
+	}
+	created := now()
+	rt := RefreshToken{
+		CreateRefreshTokenParams: params,
+		CreatedAt:                created,
+		UpdatedAt:                created,
+	}
+	s.refreshTokens[rt.Token] = rt
+	return rt, nil
+}
+
+func (s *MemoryStore) RevokeRefreshToken(token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rt, ok := s.refreshTokens[token]
+	if !ok {
+		return nil
+	}
+	revokedAt := now()
+	rt.RevokedAt = &revokedAt
+	s.refreshTokens[token] = rt
+	return nil
+}
+
+func (s *MemoryStore) GetRefreshToken(token string) (RefreshToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rt, ok := s.refreshTokens[token]
+	if !ok {
+		return RefreshToken{}, ErrNotFound
+	}
+	rt.RevokedAt = clonePtr(rt.RevokedAt)
+	return rt, nil
+}
+
+func (s *MemoryStore) DeleteRefreshToken(token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.refreshTokens, token)
+	return nil
+}
+
+func (s *MemoryStore) CreateJob(params CreateJobParams) (Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.createJob(params), nil
+}
+
+func (s *MemoryStore) CreateVideoJob(status VideoStatus, params CreateJobParams) (Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if params.VideoID == nil {
+		return Job{}, errors.New("job has no video")
+	}
+	video, ok := s.videos[*params.VideoID]
+	if !ok {
+		return Job{}, ErrNotFound
+	}
+	video.Status = status
+	video.UpdatedAt = now()
+	s.videos[video.ID] = video
+	return s.createJob(params), nil
+}
+
+func (s *MemoryStore) createJob(params CreateJobParams) Job {
+	if params.RunAt.IsZero() {
+		params.RunAt = time.Now()
+	}
+	params.RunAt = params.RunAt.UTC()
+	created := now()
+	job := Job{
+		ID:              uuid.New(),
+		CreatedAt:       created,
+		UpdatedAt:       created,
+		Status:          JobStatusQueued,
+		CreateJobParams: params,
+	}.clone()
+	s.jobs[job.ID] = job
+	return job.clone()
+}
+
+func (s *MemoryStore) GetJob(id uuid.UUID) (Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return Job{}, ErrNotFound
+	}
+	return job.clone(), nil
+}
+
+func (s *MemoryStore) ClaimJob(at, lockedUntil time.Time) (*Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var due, expired *Job
+	for _, job := range s.jobs {
+		switch job.Status {
+		case JobStatusQueued:
+			if job.RunAt.After(at) {
+				continue
+			}
+		case JobStatusRunning:
+			if job.LockedUntil != nil && !job.LockedUntil.Before(at) {
+				continue
+			}
+			if job.Attempts >= job.MaxAttempts {
+				if expired == nil || job.RunAt.Before(expired.RunAt) {
+					expired = &job
+				}
+				continue
+			}
+		default:
+			continue
+		}
+		if due == nil || job.RunAt.Before(due.RunAt) {
+			due = &job
+		}
+	}
+	if expired != nil {
+		lastError := JobLeaseExpired
+		expired.Status = JobStatusFailed
+		expired.LastError = &lastError
+		expired.LockedUntil = nil
+		expired.UpdatedAt = now()
+		s.jobs[expired.ID] = *expired
+		failed := expired.clone()
+		return &failed, nil
+	}
+	if due == nil {
+		return nil, nil
+	}
+	lockedUntil = lockedUntil.UTC()
+	due.Status = JobStatusRunning
+	due.Attempts++
+	due.LockedUntil = &lockedUntil
+	due.UpdatedAt = now()
+	s.jobs[due.ID] = *due
+	claimed := due.clone()
+	return &claimed, nil
+}
+
+func (s *MemoryStore) ExtendJobLease(id uuid.UUID, attempt int, lockedUntil time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok || job.Attempts != attempt || job.Status != JobStatusRunning {
+		return false, nil
+	}
+	lockedUntil = lockedUntil.UTC()
+	job.LockedUntil = &lockedUntil
+	s.jobs[id] = job
+	return true, nil
+}
+
+func (s *MemoryStore) CompleteJob(id uuid.UUID) error {
+	return s.updateJob(id, func(job *Job) {
+		job.Status = JobStatusDone
+		job.LastError = nil
+	})
+}
+
+func (s *MemoryStore) RetryJob(id uuid.UUID, runAt time.Time, lastError string) error {
+	return s.updateJob(id, func(job *Job) {
+		job.Status = JobStatusQueued
+		job.RunAt = runAt.UTC()
+		job.LastError = &lastError
+	})
+}
+
+func (s *MemoryStore) FailJob(id uuid.UUID, lastError string) error {
+	return s.updateJob(id, func(job *Job) {
+		job.Status = JobStatusFailed
+		job.LastError = &lastError
+	})
+}
+
+func (s *MemoryStore) updateJob(id uuid.UUID, update func(job *Job)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return nil
+	}
+	update(&job)
+	job.LockedUntil = nil
+	job.UpdatedAt = now()
+	s.jobs[id] = job
+	return nil
+}
@@ -0,0 +1,363 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Migrations live in migrations/<dialect>/ as NNNN_name.up.sql and
+// NNNN_name.down.sql, with the same versions for every dialect. They're
+// applied in order of NNNN, each in its own transaction, and never edited once
+// released: schema changes always get a new migration.
+//
+//go:embed migrations/*/*.sql
+var migrationFiles embed.FS
+
+var migrationFileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Migration is a schema migration and whether it has been applied.
+type Migration struct {
+	Version int    `json:"version"`
+	Name    string `json:"name"`
+	// AppliedAt is nil for pending migrations.
+	AppliedAt *time.Time `json:"applied_at"`
+	up, down  string
+}
+
+func loadMigrations(d dialect) ([]Migration, error) {
+	dir := path.Join("migrations", string(d))
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int]*Migration{}
+	for _, entry := range entries {
+		match := migrationFileName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("unexpected migration file %s", entry.Name())
+		}
+		version, err := strconv.Atoi(match[1])
+		if err != nil {
+			return nil, err
+		}
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+		if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %d is named both %s and %s", version, m.Name, match[2])
+		}
+		contents, err := fs.ReadFile(migrationFiles, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if match[3] == "up" {
+			m.up = string(contents)
+		} else {
+			m.down = string(contents)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.up == "" || m.down == "" {
+			return nil, fmt.Errorf("migration %04d_%s needs both an up and a down file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	slices.SortFunc(migrations, func(a, b Migration) int { return a.Version - b.Version })
+	return migrations, nil
+}
+
+// MigrationStatus returns every known migration in order, along with any
+// applied ones this build doesn't know about, which means the database was
+// migrated by a newer build.
+func (c Client) MigrationStatus() ([]Migration, error) {
+	return c.withMigrationConn(func(conn migrationConn) ([]Migration, error) {
+		return migrationStatus(conn)
+	})
+}
+
+// MigrateUp applies all pending migrations and returns them.
+func (c Client) MigrateUp() ([]Migration, error) {
+	return c.withMigrationConn(func(conn migrationConn) ([]Migration, error) {
+		migrations, err := migrationStatus(conn)
+		if err != nil {
+			return nil, err
+		}
+		applied := []Migration{}
+		for _, m := range migrations {
+			if m.AppliedAt != nil {
+				continue
+			}
+			if m.up == "" {
+				return applied, fmt.Errorf("migration %04d_%s isn't known to this build", m.Version, m.Name)
+			}
+			err := runMigration(conn, m, m.up, migrationChecks[m.Version], func(tx tx) error {
+				_, err := tx.Exec("INSERT INTO schema_migrations (version, name) VALUES (?, ?)", m.Version, m.Name)
+				return err
+			})
+			if err != nil {
+				return applied, err
+			}
+			applied = append(applied, m)
+		}
+		return applied, nil
+	})
+}
+
+// MigrateDown reverts the latest n applied migrations and returns them.
+func (c Client) MigrateDown(n int) ([]Migration, error) {
+	return c.withMigrationConn(func(conn migrationConn) ([]Migration, error) {
+		migrations, err := migrationStatus(conn)
+		if err != nil {
+			return nil, err
+		}
+		reverted := []Migration{}
+		for i := len(migrations) - 1; i >= 0 && len(reverted) < n; i-- {
+			m := migrations[i]
+			if m.AppliedAt == nil {
+				continue
+			}
+			if m.down == "" {
+				return reverted, fmt.Errorf("migration %04d_%s isn't known to this build", m.Version, m.Name)
+			}
+			err := runMigration(conn, m, m.down, nil, func(tx tx) error {
+				_, err := tx.Exec("DELETE FROM schema_migrations WHERE version = ?", m.Version)
+				return err
+			})
+			if err != nil {
+				return reverted, err
+			}
+			reverted = append(reverted, m)
+		}
+		return reverted, nil
+	})
+}
+
+// migrationConn is the connection migrations run on.
+type migrationConn struct {
+	*sql.Conn
+	dialect dialect
+}
+
+func (conn migrationConn) exec(query string) error {
+	_, err := conn.ExecContext(context.Background(), query)
+	return err
+}
+
+func (conn migrationConn) begin() (tx, error) {
+	sqlTx, err := conn.BeginTx(context.Background(), nil)
+	return tx{sqlTx, conn.dialect}, err
+}
+
+// migrationLock is the Postgres advisory lock that keeps servers starting
+// at the same time from migrating concurrently.
+const migrationLock = 7_352_914
+
+// withMigrationConn runs f on a connection of its own. On SQLite, foreign
+// keys are off on it, since migrations that rebuild a table have to drop it
+// while other tables still reference it; runMigration checks the keys before
+// committing instead. Postgres can alter tables in place and checks keys as
+// usual, but has to be locked against other servers.
+func (c Client) withMigrationConn(f func(conn migrationConn) ([]Migration, error)) ([]Migration, error) {
+	sqlConn, err := c.db.Conn(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer sqlConn.Close()
+	conn := migrationConn{sqlConn, c.db.dialect}
+
+	setup, teardown := "PRAGMA foreign_keys = OFF", "PRAGMA foreign_keys = ON"
+	if conn.dialect == postgres {
+		setup = fmt.Sprintf("SELECT pg_advisory_lock(%d)", migrationLock)
+		teardown = fmt.Sprintf("SELECT pg_advisory_unlock(%d)", migrationLock)
+	}
+	err = conn.exec(setup)
+	if err != nil {
+		return nil, err
+	}
+	migrations, err := f(conn)
+	// The connection goes back to the pool.
+	teardownErr := conn.exec(teardown)
+	if err == nil {
+		err = teardownErr
+	}
+	return migrations, err
+}
+
+func migrationStatus(conn migrationConn) ([]Migration, error) {
+	migrations, err := loadMigrations(conn.dialect)
+	if err != nil {
+		return nil, err
+	}
+	err = createMigrationsTable(conn, migrations[0])
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := conn.QueryContext(context.Background(), "SELECT version, name, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var applied Migration
+		var appliedAt time.Time
+		err := rows.Scan(&applied.Version, &applied.Name, &appliedAt)
+		if err != nil {
+			return nil, err
+		}
+		i := slices.IndexFunc(migrations, func(m Migration) bool { return m.Version == applied.Version })
+		if i < 0 {
+			applied.AppliedAt = &appliedAt
+			migrations = append(migrations, applied)
+			continue
+		}
+		migrations[i].AppliedAt = &appliedAt
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	slices.SortFunc(migrations, func(a, b Migration) int { return a.Version - b.Version })
+	return migrations, nil
+}
+
+// createMigrationsTable creates schema_migrations if it doesn't exist yet. A
+// database that already has tables without it was set up by autoMigrate, which
+// initial replaces, so it's brought up to date and adopted as having initial
+// applied. Rows it can't satisfy foreign keys for are left to later
+// migrations.
+func createMigrationsTable(conn migrationConn, initial Migration) error {
+	hasTable := func(name string) (bool, error) {
+		query := "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?"
+		if conn.dialect == postgres {
+			query = "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = ?"
+		}
+		var count int
+		err := conn.QueryRowContext(context.Background(), conn.dialect.rebind(query), name).Scan(&count)
+		return count > 0, err
+	}
+	hasMigrations, err := hasTable("schema_migrations")
+	if err != nil || hasMigrations {
+		return err
+	}
+	// Only SQLite databases predate migrations.
+	legacy := false
+	if conn.dialect == sqlite {
+		legacy, err = hasTable("videos")
+		if err != nil {
+			return err
+		}
+	}
+
+	tx, err := conn.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	migrationsTable := `
+	CREATE TABLE schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at ` + conn.dialect.timestamp() + ` NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+	`
+	_, err = tx.Exec(migrationsTable)
+	if err != nil {
+		return err
+	}
+	if legacy {
+		_, err = tx.Tx.Exec(initial.up)
+		if err != nil {
+			return err
+		}
+		err = addLegacyColumns(tx)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("INSERT INTO schema_migrations (version, name) VALUES (?, ?)", initial.Version, initial.Name)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// migrationChecks are run before the up migration of the same version, which
+// isn't applied if its check fails.
+var migrationChecks = map[int]func(tx tx) error{
+	foreignKeysMigration: checkOrphanedRows,
+}
+
+// runMigration runs check, if any, statements, one direction of m, and then
+// record in a single transaction. It's rolled back if any of them fails or
+// leaves rows referencing rows that don't exist.
+func runMigration(conn migrationConn, m Migration, statements string, check, record func(tx tx) error) error {
+	tx, err := conn.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if check != nil {
+		err = check(tx)
+		if err != nil {
+			return fmt.Errorf("migration %04d_%s: %w", m.Version, m.Name, err)
+		}
+	}
+	// Migrations are plain SQL without placeholders.
+	_, err = tx.Tx.Exec(statements)
+	if err != nil {
+		return fmt.Errorf("migration %04d_%s: %w", m.Version, m.Name, err)
+	}
+	err = record(tx)
+	if err != nil {
+		return fmt.Errorf("migration %04d_%s: %w", m.Version, m.Name, err)
+	}
+	if conn.dialect == sqlite {
+		err = checkForeignKeys(tx)
+		if err != nil {
+			return fmt.Errorf("migration %04d_%s: %w", m.Version, m.Name, err)
+		}
+	}
+	return tx.Commit()
+}
+
+func checkForeignKeys(tx tx) error {
+	rows, err := tx.Query("PRAGMA foreign_key_check")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	violations := []string{}
+	for rows.Next() {
+		var table, parent string
+		var rowID sql.NullInt64
+		var fkID int
+		err := rows.Scan(&table, &rowID, &parent, &fkID)
+		if err != nil {
+			return err
+		}
+		violations = append(violations, fmt.Sprintf("%s row %d references a missing %s", table, rowID.Int64, parent))
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(violations) > 0 {
+		return fmt.Errorf("foreign key violations: %s", strings.Join(violations, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,7 @@
+DROP TABLE blob_refs;
+DROP TABLE video_versions;
+DROP TABLE jobs;
+DROP TABLE uploads;
+DROP TABLE videos;
+DROP TABLE refresh_tokens;
+DROP TABLE users;
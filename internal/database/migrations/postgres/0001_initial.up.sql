@@ -0,0 +1,96 @@
+CREATE TABLE users (
+	id UUID PRIMARY KEY,
+	created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	password TEXT NOT NULL,
+	email TEXT UNIQUE NOT NULL
+);
+
+CREATE TABLE refresh_tokens (
+	token TEXT PRIMARY KEY,
+	created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	revoked_at TIMESTAMPTZ,
+	user_id UUID NOT NULL REFERENCES users(id),
+	expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE videos (
+	id UUID PRIMARY KEY,
+	created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	title TEXT NOT NULL,
+	description TEXT,
+	thumbnail_url TEXT,
+	video_url TEXT,
+	user_id UUID NOT NULL REFERENCES users(id),
+	status TEXT NOT NULL DEFAULT '',
+	hls_url TEXT,
+	dash_url TEXT,
+	duration_seconds DOUBLE PRECISION NOT NULL DEFAULT 0,
+	width INTEGER NOT NULL DEFAULT 0,
+	height INTEGER NOT NULL DEFAULT 0,
+	video_codec TEXT NOT NULL DEFAULT '',
+	audio_codec TEXT NOT NULL DEFAULT '',
+	bit_rate BIGINT NOT NULL DEFAULT 0,
+	frame_rate DOUBLE PRECISION NOT NULL DEFAULT 0,
+	audio_channel_layout TEXT NOT NULL DEFAULT '',
+	container_format TEXT NOT NULL DEFAULT '',
+	file_size BIGINT NOT NULL DEFAULT 0,
+	thumbnails TEXT NOT NULL DEFAULT '[]',
+	version INTEGER NOT NULL DEFAULT 0,
+	protected BOOLEAN NOT NULL DEFAULT FALSE,
+	url_expiry_seconds INTEGER NOT NULL DEFAULT 0,
+	restrict_ip BOOLEAN NOT NULL DEFAULT FALSE,
+	encryption TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE uploads (
+	id UUID PRIMARY KEY,
+	created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	video_id UUID NOT NULL REFERENCES videos(id),
+	user_id UUID NOT NULL REFERENCES users(id),
+	upload_length BIGINT NOT NULL,
+	upload_offset BIGINT NOT NULL DEFAULT 0,
+	media_type TEXT NOT NULL
+);
+
+CREATE TABLE jobs (
+	id UUID PRIMARY KEY,
+	created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	kind TEXT NOT NULL,
+	video_id UUID,
+	payload TEXT NOT NULL DEFAULT '',
+	status TEXT NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	max_attempts INTEGER NOT NULL,
+	run_at TIMESTAMPTZ NOT NULL,
+	last_error TEXT
+);
+CREATE INDEX jobs_status_run_at ON jobs(status, run_at);
+
+CREATE TABLE video_versions (
+	id UUID PRIMARY KEY,
+	created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	video_id UUID NOT NULL REFERENCES videos(id),
+	version INTEGER NOT NULL,
+	video_url TEXT,
+	hls_url TEXT,
+	dash_url TEXT,
+	metadata TEXT NOT NULL DEFAULT '{}',
+	encryption TEXT NOT NULL DEFAULT '',
+	expires_at TIMESTAMPTZ,
+	deleted_at TIMESTAMPTZ,
+	UNIQUE(video_id, version)
+);
+
+CREATE TABLE blob_refs (
+	key TEXT PRIMARY KEY,
+	created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	hls_key TEXT,
+	dash_key TEXT,
+	encryption TEXT NOT NULL DEFAULT '',
+	ref_count INTEGER NOT NULL
+);
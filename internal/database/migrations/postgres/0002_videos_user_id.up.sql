@@ -0,0 +1,3 @@
+-- Postgres databases were created with videos.user_id already correct, only
+-- the index is new.
+CREATE INDEX videos_user_id ON videos(user_id);
@@ -0,0 +1,5 @@
+-- Released blobs are now kept until their objects are gone. Before, the row
+-- went with the last reference, and the code this reverts to can't tell the
+-- two apart.
+DELETE FROM blob_refs WHERE ref_count <= 0;
+ALTER TABLE blob_refs DROP COLUMN stored;
@@ -0,0 +1,5 @@
+-- A running job is leased to its worker until locked_until, and the worker
+-- keeps extending the lease. Once it runs out the worker is presumed dead and
+-- the job can be claimed again. Jobs running now have no lease and count as
+-- expired.
+ALTER TABLE jobs ADD COLUMN locked_until TIMESTAMPTZ;
@@ -0,0 +1,2 @@
+UPDATE videos SET status = '' WHERE status = 'created';
+ALTER TABLE videos ALTER COLUMN status SET DEFAULT '';
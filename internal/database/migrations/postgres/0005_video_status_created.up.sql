@@ -0,0 +1,6 @@
+-- Videos used to start out with an empty status. Existing videos get the
+-- status they'd have had: ones with media were processed before processing
+-- was tracked.
+ALTER TABLE videos ALTER COLUMN status SET DEFAULT 'created';
+UPDATE videos SET status = 'ready' WHERE status = '' AND video_url IS NOT NULL;
+UPDATE videos SET status = 'created' WHERE status = '';
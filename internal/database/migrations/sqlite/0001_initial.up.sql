@@ -0,0 +1,103 @@
+-- The schema as autoMigrate left it. Tables use IF NOT EXISTS so databases
+-- created by autoMigrate can be brought up to date by the same statements.
+CREATE TABLE IF NOT EXISTS users (
+	id TEXT PRIMARY KEY,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	password TEXT NOT NULL,
+	email TEXT UNIQUE NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+	token TEXT PRIMARY KEY,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	revoked_at TIMESTAMP,
+	user_id TEXT NOT NULL,
+	expires_at TIMESTAMP NOT NULL,
+	FOREIGN KEY(user_id) REFERENCES users(id)
+);
+
+CREATE TABLE IF NOT EXISTS videos (
+	id TEXT PRIMARY KEY,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	title TEXT NOT NULL,
+	description TEXT,
+	thumbnail_url TEXT,
+	video_url TEXT TEXT,
+	user_id INTEGER,
+	status TEXT NOT NULL DEFAULT '',
+	hls_url TEXT,
+	dash_url TEXT,
+	duration_seconds REAL NOT NULL DEFAULT 0,
+	width INTEGER NOT NULL DEFAULT 0,
+	height INTEGER NOT NULL DEFAULT 0,
+	video_codec TEXT NOT NULL DEFAULT '',
+	audio_codec TEXT NOT NULL DEFAULT '',
+	bit_rate INTEGER NOT NULL DEFAULT 0,
+	frame_rate REAL NOT NULL DEFAULT 0,
+	audio_channel_layout TEXT NOT NULL DEFAULT '',
+	container_format TEXT NOT NULL DEFAULT '',
+	file_size INTEGER NOT NULL DEFAULT 0,
+	thumbnails TEXT NOT NULL DEFAULT '[]',
+	version INTEGER NOT NULL DEFAULT 0,
+	protected BOOLEAN NOT NULL DEFAULT FALSE,
+	url_expiry_seconds INTEGER NOT NULL DEFAULT 0,
+	restrict_ip BOOLEAN NOT NULL DEFAULT FALSE,
+	encryption TEXT NOT NULL DEFAULT '',
+	FOREIGN KEY(user_id) REFERENCES users(id)
+);
+
+CREATE TABLE IF NOT EXISTS uploads (
+	id TEXT PRIMARY KEY,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	video_id TEXT NOT NULL,
+	user_id TEXT NOT NULL,
+	upload_length INTEGER NOT NULL,
+	upload_offset INTEGER NOT NULL DEFAULT 0,
+	media_type TEXT NOT NULL,
+	FOREIGN KEY(video_id) REFERENCES videos(id),
+	FOREIGN KEY(user_id) REFERENCES users(id)
+);
+
+CREATE TABLE IF NOT EXISTS jobs (
+	id TEXT PRIMARY KEY,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	kind TEXT NOT NULL,
+	video_id TEXT,
+	payload TEXT NOT NULL DEFAULT '',
+	status TEXT NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	max_attempts INTEGER NOT NULL,
+	run_at TIMESTAMP NOT NULL,
+	last_error TEXT
+);
+CREATE INDEX IF NOT EXISTS jobs_status_run_at ON jobs(status, run_at);
+
+CREATE TABLE IF NOT EXISTS video_versions (
+	id TEXT PRIMARY KEY,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	video_id TEXT NOT NULL,
+	version INTEGER NOT NULL,
+	video_url TEXT,
+	hls_url TEXT,
+	dash_url TEXT,
+	metadata TEXT NOT NULL DEFAULT '{}',
+	encryption TEXT NOT NULL DEFAULT '',
+	expires_at TIMESTAMP,
+	deleted_at TIMESTAMP,
+	UNIQUE(video_id, version),
+	FOREIGN KEY(video_id) REFERENCES videos(id)
+);
+
+CREATE TABLE IF NOT EXISTS blob_refs (
+	key TEXT PRIMARY KEY,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	hls_key TEXT,
+	dash_key TEXT,
+	encryption TEXT NOT NULL DEFAULT '',
+	ref_count INTEGER NOT NULL
+);
@@ -0,0 +1,41 @@
+CREATE TABLE videos_old (
+	id TEXT PRIMARY KEY,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	title TEXT NOT NULL,
+	description TEXT,
+	thumbnail_url TEXT,
+	video_url TEXT TEXT,
+	user_id INTEGER,
+	status TEXT NOT NULL DEFAULT '',
+	hls_url TEXT,
+	dash_url TEXT,
+	duration_seconds REAL NOT NULL DEFAULT 0,
+	width INTEGER NOT NULL DEFAULT 0,
+	height INTEGER NOT NULL DEFAULT 0,
+	video_codec TEXT NOT NULL DEFAULT '',
+	audio_codec TEXT NOT NULL DEFAULT '',
+	bit_rate INTEGER NOT NULL DEFAULT 0,
+	frame_rate REAL NOT NULL DEFAULT 0,
+	audio_channel_layout TEXT NOT NULL DEFAULT '',
+	container_format TEXT NOT NULL DEFAULT '',
+	file_size INTEGER NOT NULL DEFAULT 0,
+	thumbnails TEXT NOT NULL DEFAULT '[]',
+	version INTEGER NOT NULL DEFAULT 0,
+	protected BOOLEAN NOT NULL DEFAULT FALSE,
+	url_expiry_seconds INTEGER NOT NULL DEFAULT 0,
+	restrict_ip BOOLEAN NOT NULL DEFAULT FALSE,
+	encryption TEXT NOT NULL DEFAULT '',
+	FOREIGN KEY(user_id) REFERENCES users(id)
+);
+
+INSERT INTO videos_old SELECT
+	id, created_at, updated_at, title, description, thumbnail_url, video_url,
+	user_id, status, hls_url, dash_url, duration_seconds, width, height,
+	video_codec, audio_codec, bit_rate, frame_rate, audio_channel_layout,
+	container_format, file_size, thumbnails, version, protected,
+	url_expiry_seconds, restrict_ip, encryption
+FROM videos;
+
+DROP TABLE videos;
+ALTER TABLE videos_old RENAME TO videos;
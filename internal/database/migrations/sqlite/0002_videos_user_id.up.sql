@@ -0,0 +1,76 @@
+-- videos.user_id was declared INTEGER and nullable although it holds user
+-- UUIDs, and video_url was declared "TEXT TEXT". SQLite can't change a
+-- column's type, so the table is rebuilt.
+--
+-- Foreign keys are enforced from now on, so rows that would violate them go
+-- first: videos without an existing owner, which no one can reach through
+-- the API anyway, and everything pointing at missing rows. `tubely gc` finds
+-- the media they leave behind in storage.
+DELETE FROM videos
+WHERE user_id IS NULL OR user_id NOT IN (SELECT id FROM users);
+
+UPDATE blob_refs
+SET ref_count = ref_count - (
+	SELECT COUNT(*) FROM video_versions
+	WHERE video_versions.video_url = blob_refs.key
+		AND video_versions.deleted_at IS NULL
+		AND video_versions.video_id NOT IN (SELECT id FROM videos)
+);
+DELETE FROM blob_refs WHERE ref_count <= 0;
+
+DELETE FROM video_versions WHERE video_id NOT IN (SELECT id FROM videos);
+DELETE FROM uploads
+WHERE video_id NOT IN (SELECT id FROM videos)
+	OR user_id NOT IN (SELECT id FROM users);
+DELETE FROM refresh_tokens WHERE user_id NOT IN (SELECT id FROM users);
+
+CREATE TABLE videos_new (
+	id TEXT PRIMARY KEY,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	title TEXT NOT NULL,
+	description TEXT,
+	thumbnail_url TEXT,
+	video_url TEXT,
+	user_id TEXT NOT NULL,
+	status TEXT NOT NULL DEFAULT '',
+	hls_url TEXT,
+	dash_url TEXT,
+	duration_seconds REAL NOT NULL DEFAULT 0,
+	width INTEGER NOT NULL DEFAULT 0,
+	height INTEGER NOT NULL DEFAULT 0,
+	video_codec TEXT NOT NULL DEFAULT '',
+	audio_codec TEXT NOT NULL DEFAULT '',
+	bit_rate INTEGER NOT NULL DEFAULT 0,
+	frame_rate REAL NOT NULL DEFAULT 0,
+	audio_channel_layout TEXT NOT NULL DEFAULT '',
+	container_format TEXT NOT NULL DEFAULT '',
+	file_size INTEGER NOT NULL DEFAULT 0,
+	thumbnails TEXT NOT NULL DEFAULT '[]',
+	version INTEGER NOT NULL DEFAULT 0,
+	protected BOOLEAN NOT NULL DEFAULT FALSE,
+	url_expiry_seconds INTEGER NOT NULL DEFAULT 0,
+	restrict_ip BOOLEAN NOT NULL DEFAULT FALSE,
+	encryption TEXT NOT NULL DEFAULT '',
+	FOREIGN KEY(user_id) REFERENCES users(id)
+);
+
+INSERT INTO videos_new (
+	id, created_at, updated_at, title, description, thumbnail_url, video_url,
+	user_id, status, hls_url, dash_url, duration_seconds, width, height,
+	video_codec, audio_codec, bit_rate, frame_rate, audio_channel_layout,
+	container_format, file_size, thumbnails, version, protected,
+	url_expiry_seconds, restrict_ip, encryption
+)
+SELECT
+	id, created_at, updated_at, title, description, thumbnail_url, video_url,
+	CAST(user_id AS TEXT), status, hls_url, dash_url, duration_seconds, width,
+	height, video_codec, audio_codec, bit_rate, frame_rate,
+	audio_channel_layout, container_format, file_size, thumbnails, version,
+	protected, url_expiry_seconds, restrict_ip, encryption
+FROM videos;
+
+DROP TABLE videos;
+ALTER TABLE videos_new RENAME TO videos;
+
+CREATE INDEX videos_user_id ON videos(user_id);
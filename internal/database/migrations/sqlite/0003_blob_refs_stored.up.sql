@@ -0,0 +1,4 @@
+-- Blobs are recorded before their objects are uploaded, so an in-flight
+-- delete of the same content can't remove them; stored says whether the
+-- upload has finished. Existing blobs were recorded after it.
+ALTER TABLE blob_refs ADD COLUMN stored BOOLEAN NOT NULL DEFAULT TRUE;
@@ -0,0 +1 @@
+UPDATE videos SET status = '' WHERE status = 'created';
@@ -0,0 +1,6 @@
+-- Videos used to start out with an empty status. CreateVideo now sets
+-- 'created' (SQLite can't change a column's default without rebuilding the
+-- table), and existing videos get the status they'd have had: ones with
+-- media were processed before processing was tracked.
+UPDATE videos SET status = 'ready' WHERE status = '' AND video_url IS NOT NULL;
+UPDATE videos SET status = 'created' WHERE status = '';
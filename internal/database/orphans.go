@@ -0,0 +1,152 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// foreignKeysMigration is the migration from which SQLite enforces foreign
+// keys. Databases that predate it may hold rows violating them, which it
+// refuses to drop on its own: see PurgeOrphanedRows. The migration was
+// released deleting them itself, and still does, but checkOrphanedRows runs
+// first and finds the same rows, so by the time it's applied there's nothing
+// left for it to delete.
+const foreignKeysMigration = 2
+
+// OrphanedRowsError is returned by MigrateUp when rows reference rows that
+// don't exist, so foreign keys can't be enforced. Rows describes them.
+type OrphanedRowsError struct {
+	Rows []string
+}
+
+func (e *OrphanedRowsError) Error() string {
+	return fmt.Sprintf("%d rows reference missing rows, review them and delete them with `tubely migrate purge-orphans`:\n\t%s",
+		len(e.Rows), strings.Join(e.Rows, "\n\t"))
+}
+
+// ownedVideos selects the videos whose owner exists. Everything hanging off
+// the others goes with them.
+const ownedVideos = `SELECT id FROM videos WHERE user_id IN (SELECT id FROM users)`
+
+// orphanQueries find the rows PurgeOrphanedRows deletes. Each selects the
+// values its format describes a row with.
+var orphanQueries = []struct {
+	query, format string
+}{
+	{
+		`SELECT id, COALESCE(CAST(user_id AS TEXT), '') FROM videos
+		WHERE user_id IS NULL OR user_id NOT IN (SELECT id FROM users)`,
+		"video %s: owner %q doesn't exist",
+	},
+	{
+		`SELECT id, version, video_id FROM video_versions
+		WHERE video_id NOT IN (` + ownedVideos + `)`,
+		"video version %s (%s): video %s doesn't exist or is orphaned",
+	},
+	{
+		`SELECT id, video_id, user_id FROM uploads
+		WHERE video_id NOT IN (` + ownedVideos + `) OR user_id NOT IN (SELECT id FROM users)`,
+		"upload %s: video %s or user %s doesn't exist or is orphaned",
+	},
+	{
+		// Tokens are secrets, so only their user is shown.
+		`SELECT user_id FROM refresh_tokens
+		WHERE user_id NOT IN (SELECT id FROM users)`,
+		"refresh token: user %s doesn't exist",
+	},
+}
+
+// purgeOrphans deletes the rows orphanQueries find, children first. The blobs
+// of deleted versions are released, and left for `tubely gc -delete` to
+// delete once nothing references them.
+const purgeOrphans = `
+UPDATE blob_refs
+SET ref_count = ref_count - (
+	SELECT COUNT(*) FROM video_versions
+	WHERE video_versions.video_url = blob_refs.key
+		AND video_versions.deleted_at IS NULL
+		AND video_versions.video_id NOT IN (` + ownedVideos + `)
+)
+WHERE ref_count > 0;
+
+DELETE FROM video_versions WHERE video_id NOT IN (` + ownedVideos + `);
+DELETE FROM uploads
+WHERE video_id NOT IN (` + ownedVideos + `)
+	OR user_id NOT IN (SELECT id FROM users);
+DELETE FROM videos
+WHERE user_id IS NULL OR user_id NOT IN (SELECT id FROM users);
+DELETE FROM refresh_tokens WHERE user_id NOT IN (SELECT id FROM users);
+`
+
+// orphanedRows describes the rows referencing rows that don't exist.
+func orphanedRows(tx tx) ([]string, error) {
+	orphans := []string{}
+	for _, q := range orphanQueries {
+		rows, err := tx.Query(q.query)
+		if err != nil {
+			return nil, err
+		}
+		columns, err := rows.Columns()
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		values := make([]sql.NullString, len(columns))
+		dest := make([]any, len(columns))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		for rows.Next() {
+			if err := rows.Scan(dest...); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			args := make([]any, len(values))
+			for i, v := range values {
+				args[i] = v.String
+			}
+			orphans = append(orphans, fmt.Sprintf(q.format, args...))
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return orphans, nil
+}
+
+// checkOrphanedRows fails with an OrphanedRowsError if there are any.
+func checkOrphanedRows(tx tx) error {
+	orphans, err := orphanedRows(tx)
+	if err != nil {
+		return err
+	}
+	if len(orphans) > 0 {
+		return &OrphanedRowsError{Rows: orphans}
+	}
+	return nil
+}
+
+// PurgeOrphanedRows deletes the rows an OrphanedRowsError reported: videos
+// whose owner doesn't exist, and everything pointing at them or at other
+// missing rows. It returns what it deleted. `tubely gc` finds the media they
+// leave behind in storage.
+func (c Client) PurgeOrphanedRows() ([]string, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	orphans, err := orphanedRows(tx)
+	if err != nil || len(orphans) == 0 {
+		return orphans, err
+	}
+	// No placeholders, like migrations.
+	if _, err := tx.Tx.Exec(purgeOrphans); err != nil {
+		return nil, err
+	}
+	return orphans, tx.Commit()
+}
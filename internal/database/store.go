@@ -0,0 +1,85 @@
+package database
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// VideoStore keeps videos along with what hangs off them: their versions,
+// the blobs those share, and uploads in progress.
+type VideoStore interface {
+	GetVideos(userID uuid.UUID) ([]Video, error)
+	GetAllVideos() ([]Video, error)
+	CreateVideo(params CreateVideoParams) (Video, error)
+	GetVideo(id uuid.UUID) (Video, error)
+	UpdateVideo(video Video) error
+	DeleteVideo(id uuid.UUID) ([]VideoVersion, error)
+	UpdateVideoStatus(id uuid.UUID, status VideoStatus) error
+	UpdateVideoAccess(id uuid.UUID, access VideoAccess) error
+	UpdateVideoThumbnails(id uuid.UUID, thumbnailURL *string, thumbnails Thumbnails) error
+
+	CreateVideoVersion(params CreateVideoVersionParams) (VideoVersion, error)
+	GetVideoVersions(videoID uuid.UUID) ([]VideoVersion, error)
+	GetVideoVersion(videoID uuid.UUID, version int) (VideoVersion, error)
+	GetVideoVersionByID(id uuid.UUID) (VideoVersion, error)
+	ExpireVideoVersion(id uuid.UUID, expiresAt *time.Time) error
+	ReleaseVideoVersion(id uuid.UUID) (bool, error)
+
+	GetBlob(key string) (Blob, error)
+	GetReleasedBlobs() ([]Blob, error)
+	AcquireBlob(blob Blob) (Blob, error)
+	MarkBlobStored(blob Blob) error
+	ReleaseBlob(key string) (bool, error)
+	ForgetBlob(key string) error
+
+	CreateUpload(params CreateUploadParams) (Upload, error)
+	GetUpload(id uuid.UUID) (Upload, error)
+	GetExpiredUploads(updatedBefore time.Time) ([]Upload, error)
+	UpdateUploadOffset(id uuid.UUID, from, to int64) (bool, error)
+	DeleteUpload(id uuid.UUID) error
+}
+
+type UserStore interface {
+	GetUsers() ([]User, error)
+	GetUserByEmail(email string) (User, error)
+	GetUserByRefreshToken(token string) (*User, error)
+	CreateUser(params CreateUserParams) (*User, error)
+	GetUser(id uuid.UUID) (*User, error)
+	DeleteUser(id uuid.UUID) error
+}
+
+type RefreshTokenStore interface {
+	CreateRefreshToken(params CreateRefreshTokenParams) (RefreshToken, error)
+	RevokeRefreshToken(token string) error
+	GetRefreshToken(token string) (RefreshToken, error)
+	DeleteRefreshToken(token string) error
+}
+
+// JobStore is the queue background work runs from.
+type JobStore interface {
+	CreateJob(params CreateJobParams) (Job, error)
+	CreateVideoJob(status VideoStatus, params CreateJobParams) (Job, error)
+	GetJob(id uuid.UUID) (Job, error)
+	ClaimJob(now, lockedUntil time.Time) (*Job, error)
+	ExtendJobLease(id uuid.UUID, attempt int, lockedUntil time.Time) (bool, error)
+	CompleteJob(id uuid.UUID) error
+	RetryJob(id uuid.UUID, runAt time.Time, lastError string) error
+	FailJob(id uuid.UUID, lastError string) error
+}
+
+// Store is everything the server keeps. Client and MemoryStore implement it,
+// and both have to pass storetest.Run.
+type Store interface {
+	VideoStore
+	UserStore
+	RefreshTokenStore
+	JobStore
+	// Reset deletes everything.
+	Reset() error
+}
+
+var (
+	_ Store = Client{}
+	_ Store = (*MemoryStore)(nil)
+)
@@ -0,0 +1,137 @@
+package database_test
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database/storetest"
+	"github.com/google/uuid"
+)
+
+func TestClient(t *testing.T) {
+	client := migratedClient(t, filepath.Join(t.TempDir(), "tubely.db"))
+	storetest.Run(t, client)
+}
+
+// TestPostgres runs against the database at DB_URL, and empties it, so point
+// it at a scratch database:
+//
+//	DB_URL=postgres://localhost/tubely_test?sslmode=disable go test ./internal/database
+func TestPostgres(t *testing.T) {
+	dataSource := os.Getenv("DB_URL")
+	if dataSource == "" {
+		t.Skip("DB_URL isn't set")
+	}
+	client := migratedClient(t, dataSource)
+	storetest.Run(t, client)
+}
+
+func TestMemoryStore(t *testing.T) {
+	storetest.Run(t, database.NewMemoryStore())
+}
+
+// migratedClient opens dataSource and runs every migration down and up
+// again on it, so the down migrations get exercised too.
+func migratedClient(t *testing.T, dataSource string) database.Client {
+	t.Helper()
+	client, err := database.NewClient(dataSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.MigrateUp(); err != nil {
+		t.Fatalf("MigrateUp: %v", err)
+	}
+	if err := client.Reset(); err != nil {
+		t.Fatalf("Reset: %v", err)
+	}
+	migrations, err := client.MigrationStatus()
+	if err != nil {
+		t.Fatalf("MigrationStatus: %v", err)
+	}
+	reverted, err := client.MigrateDown(len(migrations))
+	if err != nil {
+		t.Fatalf("MigrateDown: %v", err)
+	}
+	if len(reverted) != len(migrations) {
+		t.Fatalf("MigrateDown reverted %d of %d migrations", len(reverted), len(migrations))
+	}
+	applied, err := client.MigrateUp()
+	if err != nil {
+		t.Fatalf("MigrateUp after MigrateDown: %v", err)
+	}
+	if len(applied) != len(migrations) {
+		t.Fatalf("MigrateUp applied %d of %d migrations", len(applied), len(migrations))
+	}
+	return client
+}
+
+// TestOrphanedRows migrates a database from before foreign keys were
+// enforced, which has to stop at rows violating them until they're purged.
+func TestOrphanedRows(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tubely.db")
+	client := migratedClient(t, path)
+	migrations, err := client.MigrationStatus()
+	if err != nil {
+		t.Fatalf("MigrationStatus: %v", err)
+	}
+	if _, err := client.MigrateDown(len(migrations) - 1); err != nil {
+		t.Fatalf("MigrateDown: %v", err)
+	}
+
+	userID, ownedID, orphanID := uuid.New(), uuid.New(), uuid.New()
+	raw, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	for _, stmt := range []struct {
+		query string
+		args  []any
+	}{
+		{"INSERT INTO users (id, password, email) VALUES (?, 'password', 'a@example.com')", []any{userID}},
+		{"INSERT INTO videos (id, title, description, user_id) VALUES (?, 'owned', '', ?)", []any{ownedID, userID}},
+		{"INSERT INTO videos (id, title, description, user_id) VALUES (?, 'orphan', '', NULL)", []any{orphanID}},
+		{"INSERT INTO video_versions (id, video_id, version, video_url) VALUES (?, ?, 1, 'shared.mp4')", []any{uuid.New(), ownedID}},
+		{"INSERT INTO video_versions (id, video_id, version, video_url) VALUES (?, ?, 1, 'shared.mp4')", []any{uuid.New(), orphanID}},
+		{"INSERT INTO blob_refs (key, ref_count) VALUES ('shared.mp4', 2)", nil},
+		{"INSERT INTO refresh_tokens (token, user_id, expires_at) VALUES ('token', ?, CURRENT_TIMESTAMP)", []any{uuid.New()}},
+	} {
+		if _, err := raw.Exec(stmt.query, stmt.args...); err != nil {
+			t.Fatalf("%s: %v", stmt.query, err)
+		}
+	}
+
+	_, err = client.MigrateUp()
+	var orphaned *database.OrphanedRowsError
+	if !errors.As(err, &orphaned) || len(orphaned.Rows) != 3 {
+		t.Fatalf("MigrateUp with orphaned rows returned %v, want the video, its version and the token", err)
+	}
+	if _, err := client.GetVideo(orphanID); err != nil {
+		t.Errorf("MigrateUp deleted the orphaned video: %v", err)
+	}
+
+	purged, err := client.PurgeOrphanedRows()
+	if err != nil {
+		t.Fatalf("PurgeOrphanedRows: %v", err)
+	}
+	if len(purged) != len(orphaned.Rows) {
+		t.Errorf("PurgeOrphanedRows deleted %q, want %q", purged, orphaned.Rows)
+	}
+	if _, err := client.MigrateUp(); err != nil {
+		t.Fatalf("MigrateUp after PurgeOrphanedRows: %v", err)
+	}
+	if _, err := client.GetVideo(orphanID); !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("GetVideo of the purged video returned %v", err)
+	}
+	if _, err := client.GetVideo(ownedID); err != nil {
+		t.Errorf("GetVideo of the owned video: %v", err)
+	}
+	blob, err := client.GetBlob("shared.mp4")
+	if err != nil || blob.RefCount != 1 {
+		t.Errorf("GetBlob after purging one of its versions returned %+v, %v", blob, err)
+	}
+}
@@ -0,0 +1,638 @@
+// Package storetest checks that implementations of database.Store behave
+// alike.
+package storetest
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// Run exercises every method of store in subtests, failing those where it
+// doesn't behave like Client, the reference implementation. It resets the
+// store before each subtest, so it must not hold anything worth keeping.
+//
+// A test only needs to call it with a fresh store:
+//
+//	func TestMemoryStore(t *testing.T) {
+//		storetest.Run(t, database.NewMemoryStore())
+//	}
+func Run(t *testing.T, store database.Store) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, store database.Store)
+	}{
+		{"users", testUsers},
+		{"refresh tokens", testRefreshTokens},
+		{"videos", testVideos},
+		{"video versions", testVideoVersions},
+		{"blobs", testBlobs},
+		{"uploads", testUploads},
+		{"delete video", testDeleteVideo},
+		{"jobs", testJobs},
+		{"job lease expired", testJobLeaseExpired},
+		{"create video job", testCreateVideoJob},
+		{"reset", testReset},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := store.Reset(); err != nil {
+				t.Fatalf("Reset: %v", err)
+			}
+			tt.test(t, store)
+		})
+	}
+}
+
+// must stops the test if err isn't nil.
+func must(t *testing.T, err error, what string) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("%s: %v", what, err)
+	}
+}
+
+func createUser(t *testing.T, store database.Store, email string) database.User {
+	t.Helper()
+	user, err := store.CreateUser(database.CreateUserParams{Email: email, Password: "hash"})
+	must(t, err, "CreateUser")
+	if user == nil {
+		t.Fatalf("CreateUser returned no user")
+	}
+	return *user
+}
+
+func createVideo(t *testing.T, store database.Store, userID uuid.UUID, title string) database.Video {
+	t.Helper()
+	video, err := store.CreateVideo(database.CreateVideoParams{Title: title, Description: "description", UserID: userID})
+	must(t, err, "CreateVideo")
+	return video
+}
+
+func testUsers(t *testing.T, store database.Store) {
+	user := createUser(t, store, "a@example.com")
+	if user.ID == uuid.Nil || user.Email != "a@example.com" || user.Password != "hash" || user.CreatedAt.IsZero() {
+		t.Errorf("CreateUser returned %+v", user)
+	}
+	if _, err := store.CreateUser(database.CreateUserParams{Email: "a@example.com", Password: "hash"}); err == nil {
+		t.Errorf("CreateUser allowed a duplicate email")
+	}
+
+	got, err := store.GetUser(user.ID)
+	must(t, err, "GetUser")
+	if got == nil || got.ID != user.ID || got.Email != user.Email {
+		t.Errorf("GetUser returned %+v, want %+v", got, user)
+	}
+	got, err = store.GetUser(uuid.New())
+	if got != nil || !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("GetUser of a missing user returned %+v, %v", got, err)
+	}
+
+	byEmail, err := store.GetUserByEmail("a@example.com")
+	must(t, err, "GetUserByEmail")
+	if byEmail.ID != user.ID || byEmail.Password != "hash" {
+		t.Errorf("GetUserByEmail returned %+v, want %+v", byEmail, user)
+	}
+	byEmail, err = store.GetUserByEmail("missing@example.com")
+	if byEmail.ID != uuid.Nil || !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("GetUserByEmail of a missing email returned %+v, %v", byEmail, err)
+	}
+
+	other := createUser(t, store, "b@example.com")
+	users, err := store.GetUsers()
+	must(t, err, "GetUsers")
+	if len(users) != 2 {
+		t.Errorf("GetUsers returned %d users, want 2", len(users))
+	}
+
+	must(t, store.DeleteUser(other.ID), "DeleteUser")
+	got, err = store.GetUser(other.ID)
+	if got != nil || !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("GetUser of a deleted user returned %+v, %v", got, err)
+	}
+	createVideo(t, store, user.ID, "video")
+	if err := store.DeleteUser(user.ID); err == nil {
+		t.Errorf("DeleteUser deleted a user with videos")
+	}
+}
+
+func testRefreshTokens(t *testing.T, store database.Store) {
+	user := createUser(t, store, "a@example.com")
+	expiresAt := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	rt, err := store.CreateRefreshToken(database.CreateRefreshTokenParams{Token: "token", UserID: user.ID, ExpiresAt: expiresAt})
+	must(t, err, "CreateRefreshToken")
+	if rt.Token != "token" || rt.UserID != user.ID || !rt.ExpiresAt.Equal(expiresAt) || rt.RevokedAt != nil {
+		t.Errorf("CreateRefreshToken returned %+v", rt)
+	}
+	if _, err := store.CreateRefreshToken(database.CreateRefreshTokenParams{Token: "other", UserID: uuid.New(), ExpiresAt: expiresAt}); err == nil {
+		t.Errorf("CreateRefreshToken allowed a missing user")
+	}
+
+	owner, err := store.GetUserByRefreshToken("token")
+	must(t, err, "GetUserByRefreshToken")
+	if owner == nil || owner.ID != user.ID {
+		t.Errorf("GetUserByRefreshToken returned %+v, want %+v", owner, user)
+	}
+	owner, err = store.GetUserByRefreshToken("missing")
+	if owner != nil || !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("GetUserByRefreshToken of a missing token returned %+v, %v", owner, err)
+	}
+
+	must(t, store.RevokeRefreshToken("token"), "RevokeRefreshToken")
+	rt, err = store.GetRefreshToken("token")
+	must(t, err, "GetRefreshToken")
+	if rt.RevokedAt == nil {
+		t.Errorf("GetRefreshToken of a revoked token returned %+v", rt)
+	}
+
+	must(t, store.DeleteRefreshToken("token"), "DeleteRefreshToken")
+	rt, err = store.GetRefreshToken("token")
+	if rt.Token != "" || !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("GetRefreshToken of a deleted token returned %+v, %v", rt, err)
+	}
+}
+
+func testVideos(t *testing.T, store database.Store) {
+	user := createUser(t, store, "a@example.com")
+	other := createUser(t, store, "b@example.com")
+	if _, err := store.CreateVideo(database.CreateVideoParams{Title: "orphan", UserID: uuid.New()}); err == nil {
+		t.Errorf("CreateVideo allowed a missing user")
+	}
+
+	video := createVideo(t, store, user.ID, "first")
+	if video.ID == uuid.Nil || video.Title != "first" || video.Description != "description" || video.UserID != user.ID ||
+		video.Status != database.VideoStatusCreated || video.Version != 0 || video.Thumbnails == nil || len(video.Thumbnails) != 0 || video.VideoURL != nil {
+		t.Errorf("CreateVideo returned %+v", video)
+	}
+	createVideo(t, store, user.ID, "second")
+	createVideo(t, store, other.ID, "other's")
+
+	videos, err := store.GetVideos(user.ID)
+	must(t, err, "GetVideos")
+	if len(videos) != 2 {
+		t.Errorf("GetVideos returned %d videos, want 2", len(videos))
+	}
+	for _, v := range videos {
+		if v.UserID != user.ID {
+			t.Errorf("GetVideos returned another user's video %+v", v)
+		}
+	}
+	all, err := store.GetAllVideos()
+	must(t, err, "GetAllVideos")
+	if len(all) != 3 {
+		t.Errorf("GetAllVideos returned %d videos, want 3", len(all))
+	}
+
+	key := "landscape/abc.mp4"
+	thumbnail := "thumbnails/abc.jpg"
+	video.Title = "renamed"
+	video.VideoURL = &key
+	video.ThumbnailURL = &thumbnail
+	video.Thumbnails = database.Thumbnails{{URL: thumbnail, Width: 320, Height: 180, MediaType: "image/jpeg"}}
+	video.Metadata = database.VideoMetadata{DurationSeconds: 1.5, Width: 1920, Height: 1080, VideoCodec: "h264", FileSize: 42}
+	video.Version = 3
+	video.Encryption = "sse-s3"
+	video.Status = database.VideoStatusFailed
+	must(t, store.UpdateVideo(video), "UpdateVideo")
+
+	got, err := store.GetVideo(video.ID)
+	must(t, err, "GetVideo")
+	if got.Title != "renamed" || got.VideoURL == nil || *got.VideoURL != key || got.ThumbnailURL == nil || *got.ThumbnailURL != thumbnail ||
+		len(got.Thumbnails) != 1 || got.Thumbnails[0] != video.Thumbnails[0] || got.Metadata != video.Metadata ||
+		got.Version != 3 || got.Encryption != "sse-s3" {
+		t.Errorf("GetVideo after UpdateVideo returned %+v", got)
+	}
+	if got.Status != database.VideoStatusCreated {
+		t.Errorf("UpdateVideo changed the status to %q", got.Status)
+	}
+
+	must(t, store.UpdateVideoStatus(video.ID, database.VideoStatusReady), "UpdateVideoStatus")
+	access := database.VideoAccess{Protected: true, URLExpirySeconds: 60, RestrictIP: true}
+	must(t, store.UpdateVideoAccess(video.ID, access), "UpdateVideoAccess")
+	got, err = store.GetVideo(video.ID)
+	must(t, err, "GetVideo")
+	if got.Status != database.VideoStatusReady || got.Access != access {
+		t.Errorf("GetVideo after UpdateVideoStatus and UpdateVideoAccess returned %+v", got)
+	}
+
+	// A thumbnail saved from a stale copy leaves the media alone.
+	newThumbnail := "thumbnails/def.jpg"
+	newThumbnails := database.Thumbnails{{URL: newThumbnail, Width: 640, Height: 360, MediaType: "image/jpeg"}}
+	must(t, store.UpdateVideoThumbnails(video.ID, &newThumbnail, newThumbnails), "UpdateVideoThumbnails")
+	got, err = store.GetVideo(video.ID)
+	must(t, err, "GetVideo")
+	if got.ThumbnailURL == nil || *got.ThumbnailURL != newThumbnail || len(got.Thumbnails) != 1 || got.Thumbnails[0] != newThumbnails[0] {
+		t.Errorf("GetVideo after UpdateVideoThumbnails returned thumbnail %v, %+v", got.ThumbnailURL, got.Thumbnails)
+	}
+	if got.VideoURL == nil || *got.VideoURL != key || got.Version != 3 || got.Title != "renamed" || got.Status != database.VideoStatusReady {
+		t.Errorf("UpdateVideoThumbnails changed more than the thumbnail: %+v", got)
+	}
+	must(t, store.UpdateVideoThumbnails(video.ID, nil, nil), "UpdateVideoThumbnails")
+	got, err = store.GetVideo(video.ID)
+	must(t, err, "GetVideo")
+	if got.ThumbnailURL != nil || got.Thumbnails == nil || len(got.Thumbnails) != 0 {
+		t.Errorf("GetVideo after clearing the thumbnail returned %v, %+v", got.ThumbnailURL, got.Thumbnails)
+	}
+
+	got, err = store.GetVideo(uuid.New())
+	if got.ID != uuid.Nil || !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("GetVideo of a missing video returned %+v, %v", got, err)
+	}
+}
+
+func testVideoVersions(t *testing.T, store database.Store) {
+	user := createUser(t, store, "a@example.com")
+	video := createVideo(t, store, user.ID, "video")
+	if _, err := store.CreateVideoVersion(database.CreateVideoVersionParams{VideoID: uuid.New()}); err == nil {
+		t.Errorf("CreateVideoVersion allowed a missing video")
+	}
+
+	key := "landscape/abc.mp4"
+	metadata := database.VideoMetadata{Width: 640, Height: 360}
+	first, err := store.CreateVideoVersion(database.CreateVideoVersionParams{VideoID: video.ID, VideoURL: &key, Metadata: metadata, Encryption: "sse-kms"})
+	must(t, err, "CreateVideoVersion")
+	second, err := store.CreateVideoVersion(database.CreateVideoVersionParams{VideoID: video.ID})
+	must(t, err, "CreateVideoVersion")
+	if first.Version != 1 || second.Version != 2 {
+		t.Errorf("CreateVideoVersion numbered versions %d and %d, want 1 and 2", first.Version, second.Version)
+	}
+	if first.VideoURL == nil || *first.VideoURL != key || first.Metadata != metadata || first.Encryption != "sse-kms" ||
+		first.ExpiresAt != nil || first.DeletedAt != nil {
+		t.Errorf("CreateVideoVersion returned %+v", first)
+	}
+
+	versions, err := store.GetVideoVersions(video.ID)
+	must(t, err, "GetVideoVersions")
+	if len(versions) != 2 || versions[0].Version != 2 || versions[1].Version != 1 {
+		t.Errorf("GetVideoVersions returned %+v, want versions 2 and 1", versions)
+	}
+	got, err := store.GetVideoVersion(video.ID, 1)
+	must(t, err, "GetVideoVersion")
+	if got.ID != first.ID {
+		t.Errorf("GetVideoVersion returned %+v, want %+v", got, first)
+	}
+	got, err = store.GetVideoVersion(video.ID, 3)
+	if got.ID != uuid.Nil || !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("GetVideoVersion of a missing version returned %+v, %v", got, err)
+	}
+
+	expiresAt := time.Now().Add(time.Hour).Truncate(time.Second)
+	must(t, store.ExpireVideoVersion(first.ID, &expiresAt), "ExpireVideoVersion")
+	got, err = store.GetVideoVersionByID(first.ID)
+	must(t, err, "GetVideoVersionByID")
+	if got.ExpiresAt == nil || !got.ExpiresAt.Equal(expiresAt) {
+		t.Errorf("GetVideoVersionByID after ExpireVideoVersion returned %+v", got)
+	}
+	must(t, store.ExpireVideoVersion(first.ID, nil), "ExpireVideoVersion")
+	got, err = store.GetVideoVersionByID(first.ID)
+	must(t, err, "GetVideoVersionByID")
+	if got.ExpiresAt != nil {
+		t.Errorf("ExpireVideoVersion with nil left expires_at at %v", got.ExpiresAt)
+	}
+
+	// The version's media isn't a blob, so it's unreferenced right away.
+	unreferenced, err := store.ReleaseVideoVersion(first.ID)
+	must(t, err, "ReleaseVideoVersion")
+	if !unreferenced {
+		t.Errorf("ReleaseVideoVersion kept media no blob references")
+	}
+	got, err = store.GetVideoVersionByID(first.ID)
+	must(t, err, "GetVideoVersionByID")
+	if got.DeletedAt == nil {
+		t.Errorf("ReleaseVideoVersion didn't mark the version deleted")
+	}
+	unreferenced, err = store.ReleaseVideoVersion(first.ID)
+	if unreferenced || err != nil {
+		t.Errorf("releasing a version twice returned %v, %v", unreferenced, err)
+	}
+}
+
+func testBlobs(t *testing.T, store database.Store) {
+	blob, err := store.AcquireBlob(database.Blob{Key: "landscape/abc.mp4", Encryption: "sse-s3"})
+	must(t, err, "AcquireBlob")
+	if blob.RefCount != 1 || blob.Stored || blob.HLSKey != nil || blob.Encryption != "sse-s3" {
+		t.Errorf("AcquireBlob of a new blob returned %+v", blob)
+	}
+	hls := "landscape/abc/hls/master.m3u8"
+	blob.HLSKey = &hls
+	must(t, store.MarkBlobStored(blob), "MarkBlobStored")
+	blob, err = store.AcquireBlob(database.Blob{Key: "landscape/abc.mp4", Encryption: "sse-kms"})
+	must(t, err, "AcquireBlob")
+	if blob.RefCount != 2 || !blob.Stored || blob.HLSKey == nil || *blob.HLSKey != hls || blob.DASHKey != nil || blob.Encryption != "sse-s3" {
+		t.Errorf("acquiring a stored blob returned %+v, want it unchanged but for the count", blob)
+	}
+
+	// Versions hold references too.
+	user := createUser(t, store, "a@example.com")
+	video := createVideo(t, store, user.ID, "video")
+	version, err := store.CreateVideoVersion(database.CreateVideoVersionParams{VideoID: video.ID, VideoURL: &blob.Key})
+	must(t, err, "CreateVideoVersion")
+
+	unreferenced, err := store.ReleaseBlob(blob.Key)
+	must(t, err, "ReleaseBlob")
+	if unreferenced {
+		t.Errorf("ReleaseBlob reported a blob with references left unreferenced")
+	}
+	must(t, store.ForgetBlob(blob.Key), "ForgetBlob")
+	if _, err := store.GetBlob(blob.Key); err != nil {
+		t.Errorf("ForgetBlob forgot a blob with references left: %v", err)
+	}
+	unreferenced, err = store.ReleaseVideoVersion(version.ID)
+	must(t, err, "ReleaseVideoVersion")
+	if !unreferenced {
+		t.Errorf("ReleaseVideoVersion kept a blob without references")
+	}
+
+	// The released blob stays until its objects are deleted, and can't be
+	// taken up again meanwhile.
+	released, err := store.GetBlob(blob.Key)
+	must(t, err, "GetBlob")
+	if released.RefCount != 0 {
+		t.Errorf("GetBlob of a released blob returned %+v", released)
+	}
+	if _, err := store.AcquireBlob(blob); !errors.Is(err, database.ErrBlobReleased) {
+		t.Errorf("AcquireBlob of a released blob returned %v, want ErrBlobReleased", err)
+	}
+	unreferenced, err = store.ReleaseBlob(blob.Key)
+	must(t, err, "ReleaseBlob")
+	if !unreferenced {
+		t.Errorf("releasing a released blob again returned false")
+	}
+	blobs, err := store.GetReleasedBlobs()
+	must(t, err, "GetReleasedBlobs")
+	if len(blobs) != 1 || blobs[0].Key != blob.Key || blobs[0].RefCount != 0 {
+		t.Errorf("GetReleasedBlobs returned %+v", blobs)
+	}
+
+	must(t, store.ForgetBlob(blob.Key), "ForgetBlob")
+	got, err := store.GetBlob(blob.Key)
+	if got.Key != "" || !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("GetBlob of a forgotten blob returned %+v, %v", got, err)
+	}
+	blob, err = store.AcquireBlob(database.Blob{Key: "landscape/abc.mp4"})
+	must(t, err, "AcquireBlob")
+	if blob.RefCount != 1 || blob.Stored {
+		t.Errorf("AcquireBlob of a forgotten blob returned %+v", blob)
+	}
+
+	unreferenced, err = store.ReleaseBlob("missing")
+	if !unreferenced || err != nil {
+		t.Errorf("ReleaseBlob of a missing blob returned %v, %v", unreferenced, err)
+	}
+}
+
+func testUploads(t *testing.T, store database.Store) {
+	user := createUser(t, store, "a@example.com")
+	video := createVideo(t, store, user.ID, "video")
+	if _, err := store.CreateUpload(database.CreateUploadParams{VideoID: uuid.New(), UserID: user.ID, Length: 10, MediaType: "video/mp4"}); err == nil {
+		t.Errorf("CreateUpload allowed a missing video")
+	}
+
+	upload, err := store.CreateUpload(database.CreateUploadParams{VideoID: video.ID, UserID: user.ID, Length: 10, MediaType: "video/mp4"})
+	must(t, err, "CreateUpload")
+	if upload.ID == uuid.Nil || upload.Offset != 0 || upload.Length != 10 || upload.VideoID != video.ID || upload.MediaType != "video/mp4" {
+		t.Errorf("CreateUpload returned %+v", upload)
+	}
+
+	moved, err := store.UpdateUploadOffset(upload.ID, 0, 4)
+	must(t, err, "UpdateUploadOffset")
+	if !moved {
+		t.Errorf("UpdateUploadOffset didn't move the offset from 0")
+	}
+	moved, err = store.UpdateUploadOffset(upload.ID, 0, 8)
+	must(t, err, "UpdateUploadOffset")
+	if moved {
+		t.Errorf("UpdateUploadOffset moved an offset that had already moved")
+	}
+	got, err := store.GetUpload(upload.ID)
+	must(t, err, "GetUpload")
+	if got.Offset != 4 {
+		t.Errorf("GetUpload returned offset %d, want 4", got.Offset)
+	}
+
+	expired, err := store.GetExpiredUploads(got.UpdatedAt.Add(-time.Hour))
+	must(t, err, "GetExpiredUploads")
+	if len(expired) != 0 {
+		t.Errorf("GetExpiredUploads before the last write returned %+v", expired)
+	}
+	expired, err = store.GetExpiredUploads(got.UpdatedAt.Add(time.Hour))
+	must(t, err, "GetExpiredUploads")
+	if len(expired) != 1 || expired[0].ID != upload.ID || expired[0].Offset != 4 {
+		t.Errorf("GetExpiredUploads after the last write returned %+v, want the upload", expired)
+	}
+
+	must(t, store.DeleteUpload(upload.ID), "DeleteUpload")
+	got, err = store.GetUpload(upload.ID)
+	if got.ID != uuid.Nil || !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("GetUpload of a deleted upload returned %+v, %v", got, err)
+	}
+}
+
+func testDeleteVideo(t *testing.T, store database.Store) {
+	user := createUser(t, store, "a@example.com")
+	video := createVideo(t, store, user.ID, "video")
+	// The first version's media is shared with another video, the second's
+	// isn't and the third's was released before.
+	shared := database.Blob{Key: "landscape/shared.mp4"}
+	own := database.Blob{Key: "landscape/own.mp4"}
+	for _, blob := range []database.Blob{shared, shared, own} {
+		_, err := store.AcquireBlob(blob)
+		must(t, err, "AcquireBlob")
+	}
+	version, err := store.CreateVideoVersion(database.CreateVideoVersionParams{VideoID: video.ID, VideoURL: &shared.Key})
+	must(t, err, "CreateVideoVersion")
+	ownVersion, err := store.CreateVideoVersion(database.CreateVideoVersionParams{VideoID: video.ID, VideoURL: &own.Key})
+	must(t, err, "CreateVideoVersion")
+	oldVersion, err := store.CreateVideoVersion(database.CreateVideoVersionParams{VideoID: video.ID})
+	must(t, err, "CreateVideoVersion")
+	_, err = store.ReleaseVideoVersion(oldVersion.ID)
+	must(t, err, "ReleaseVideoVersion")
+	upload, err := store.CreateUpload(database.CreateUploadParams{VideoID: video.ID, UserID: user.ID, Length: 10, MediaType: "video/mp4"})
+	must(t, err, "CreateUpload")
+
+	released, err := store.DeleteVideo(video.ID)
+	must(t, err, "DeleteVideo")
+	if len(released) != 1 || released[0].ID != ownVersion.ID {
+		t.Errorf("DeleteVideo released %+v, want only version %d", released, ownVersion.Version)
+	}
+	if blob, err := store.GetBlob(shared.Key); err != nil || blob.RefCount != 1 {
+		t.Errorf("DeleteVideo left shared blob %+v, %v, want one reference", blob, err)
+	}
+	if blob, err := store.GetBlob(own.Key); err != nil || blob.RefCount != 0 {
+		t.Errorf("DeleteVideo left blob %+v, %v, want it released", blob, err)
+	}
+	if got, err := store.GetVideo(video.ID); got.ID != uuid.Nil || !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("GetVideo of a deleted video returned %+v, %v", got, err)
+	}
+	if got, err := store.GetVideoVersionByID(version.ID); got.ID != uuid.Nil || !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("DeleteVideo left version %+v, %v", got, err)
+	}
+	if got, err := store.GetUpload(upload.ID); got.ID != uuid.Nil || !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("DeleteVideo left upload %+v, %v", got, err)
+	}
+	must(t, store.DeleteUser(user.ID), "DeleteUser after deleting their video")
+}
+
+func testJobs(t *testing.T, store database.Store) {
+	start := time.Now()
+	later, err := store.CreateJob(database.CreateJobParams{Kind: "later", Payload: "{}", MaxAttempts: 3, RunAt: start.Add(time.Hour)})
+	must(t, err, "CreateJob")
+	if later.Status != database.JobStatusQueued || later.Attempts != 0 || later.Kind != "later" || later.MaxAttempts != 3 || later.VideoID != nil {
+		t.Errorf("CreateJob returned %+v", later)
+	}
+	videoID := uuid.New()
+	due, err := store.CreateJob(database.CreateJobParams{Kind: "due", VideoID: &videoID, MaxAttempts: 3})
+	must(t, err, "CreateJob")
+	if due.RunAt.IsZero() || due.VideoID == nil || *due.VideoID != videoID {
+		t.Errorf("CreateJob without a run time returned %+v", due)
+	}
+
+	claimedAt := start.Add(time.Minute)
+	claimed, err := store.ClaimJob(claimedAt, claimedAt.Add(10*time.Minute))
+	must(t, err, "ClaimJob")
+	if claimed == nil || claimed.ID != due.ID || claimed.Status != database.JobStatusRunning || claimed.Attempts != 1 || claimed.LockedUntil == nil {
+		t.Fatalf("ClaimJob returned %+v, want the due job running", claimed)
+	}
+	claimed, err = store.ClaimJob(claimedAt, claimedAt.Add(10*time.Minute))
+	if claimed != nil || err != nil {
+		t.Errorf("ClaimJob with nothing due returned %+v, %v", claimed, err)
+	}
+
+	extended, err := store.ExtendJobLease(due.ID, 1, claimedAt.Add(20*time.Minute))
+	must(t, err, "ExtendJobLease")
+	if !extended {
+		t.Errorf("ExtendJobLease of the running attempt returned false")
+	}
+	extended, err = store.ExtendJobLease(due.ID, 2, claimedAt.Add(20*time.Minute))
+	if extended || err != nil {
+		t.Errorf("ExtendJobLease of another attempt returned %v, %v", extended, err)
+	}
+	claimed, err = store.ClaimJob(claimedAt.Add(15*time.Minute), claimedAt.Add(25*time.Minute))
+	if claimed != nil || err != nil {
+		t.Errorf("ClaimJob within the extended lease returned %+v, %v", claimed, err)
+	}
+	claimed, err = store.ClaimJob(claimedAt.Add(30*time.Minute), claimedAt.Add(40*time.Minute))
+	must(t, err, "ClaimJob")
+	if claimed == nil || claimed.ID != due.ID || claimed.Attempts != 2 {
+		t.Fatalf("ClaimJob after the lease ran out returned %+v, want the due job again", claimed)
+	}
+	extended, err = store.ExtendJobLease(due.ID, 1, claimedAt.Add(50*time.Minute))
+	if extended || err != nil {
+		t.Errorf("ExtendJobLease of the lost attempt returned %v, %v", extended, err)
+	}
+
+	must(t, store.RetryJob(due.ID, start.Add(2*time.Hour), "boom"), "RetryJob")
+	got, err := store.GetJob(due.ID)
+	must(t, err, "GetJob")
+	if got.Status != database.JobStatusQueued || got.LastError == nil || *got.LastError != "boom" || !got.RunAt.After(later.RunAt) || got.LockedUntil != nil {
+		t.Errorf("GetJob after RetryJob returned %+v", got)
+	}
+	claimed, err = store.ClaimJob(start.Add(3*time.Hour), start.Add(4*time.Hour))
+	must(t, err, "ClaimJob")
+	if claimed == nil || claimed.ID != later.ID {
+		t.Errorf("ClaimJob returned %+v, want the job that's been due longest", claimed)
+	}
+
+	must(t, store.CompleteJob(later.ID), "CompleteJob")
+	got, err = store.GetJob(later.ID)
+	must(t, err, "GetJob")
+	if got.Status != database.JobStatusDone || got.LastError != nil {
+		t.Errorf("GetJob after CompleteJob returned %+v", got)
+	}
+	must(t, store.FailJob(due.ID, "gave up"), "FailJob")
+	got, err = store.GetJob(due.ID)
+	must(t, err, "GetJob")
+	if got.Status != database.JobStatusFailed || got.LastError == nil || *got.LastError != "gave up" {
+		t.Errorf("GetJob after FailJob returned %+v", got)
+	}
+
+	got, err = store.GetJob(uuid.New())
+	if got.ID != uuid.Nil || !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("GetJob of a missing job returned %+v, %v", got, err)
+	}
+}
+
+func testJobLeaseExpired(t *testing.T, store database.Store) {
+	start := time.Now()
+	job, err := store.CreateJob(database.CreateJobParams{Kind: "job", MaxAttempts: 2, RunAt: start})
+	must(t, err, "CreateJob")
+
+	claimedAt := start.Add(time.Minute)
+	for attempt := 1; attempt <= 2; attempt++ {
+		claimed, err := store.ClaimJob(claimedAt, claimedAt.Add(time.Minute))
+		must(t, err, "ClaimJob")
+		if claimed == nil || claimed.ID != job.ID || claimed.Status != database.JobStatusRunning || claimed.Attempts != attempt {
+			t.Fatalf("ClaimJob for attempt %d returned %+v", attempt, claimed)
+		}
+		// The worker dies, its lease runs out.
+		claimedAt = claimedAt.Add(2 * time.Minute)
+	}
+
+	failed, err := store.ClaimJob(claimedAt, claimedAt.Add(time.Minute))
+	must(t, err, "ClaimJob")
+	if failed == nil || failed.ID != job.ID || failed.Status != database.JobStatusFailed || failed.Attempts != 2 ||
+		failed.LastError == nil || *failed.LastError != database.JobLeaseExpired || failed.LockedUntil != nil {
+		t.Fatalf("ClaimJob after the last lease ran out returned %+v, want the job failed", failed)
+	}
+	got, err := store.GetJob(job.ID)
+	must(t, err, "GetJob")
+	if got.Status != database.JobStatusFailed || got.Attempts != 2 {
+		t.Errorf("GetJob of the expired job returned %+v", got)
+	}
+	claimed, err := store.ClaimJob(claimedAt.Add(time.Hour), claimedAt.Add(2*time.Hour))
+	if claimed != nil || err != nil {
+		t.Errorf("ClaimJob after the job failed returned %+v, %v", claimed, err)
+	}
+}
+
+func testCreateVideoJob(t *testing.T, store database.Store) {
+	user := createUser(t, store, "a@example.com")
+	video := createVideo(t, store, user.ID, "video")
+	job, err := store.CreateVideoJob(database.VideoStatusUploaded, database.CreateJobParams{Kind: "process", VideoID: &video.ID, MaxAttempts: 3})
+	must(t, err, "CreateVideoJob")
+	if job.Status != database.JobStatusQueued || job.VideoID == nil || *job.VideoID != video.ID || job.Kind != "process" {
+		t.Errorf("CreateVideoJob returned %+v", job)
+	}
+	got, err := store.GetVideo(video.ID)
+	must(t, err, "GetVideo")
+	if got.Status != database.VideoStatusUploaded {
+		t.Errorf("GetVideo after CreateVideoJob returned status %q, want uploaded", got.Status)
+	}
+
+	missing := uuid.New()
+	job, err = store.CreateVideoJob(database.VideoStatusUploaded, database.CreateJobParams{Kind: "process", VideoID: &missing, MaxAttempts: 3})
+	if !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("CreateVideoJob for a missing video returned %+v, %v", job, err)
+	}
+	// Only the first job was queued.
+	claimed, err := store.ClaimJob(time.Now().Add(time.Minute), time.Now().Add(time.Hour))
+	must(t, err, "ClaimJob")
+	if claimed == nil || *claimed.VideoID != video.ID {
+		t.Errorf("ClaimJob returned %+v, want the video's job", claimed)
+	}
+	claimed, err = store.ClaimJob(time.Now().Add(time.Minute), time.Now().Add(time.Hour))
+	if claimed != nil || err != nil {
+		t.Errorf("ClaimJob returned %+v, %v after the only job was claimed", claimed, err)
+	}
+}
+
+func testReset(t *testing.T, store database.Store) {
+	user := createUser(t, store, "a@example.com")
+	video := createVideo(t, store, user.ID, "video")
+	_, err := store.CreateJob(database.CreateJobParams{Kind: "job", MaxAttempts: 1})
+	must(t, err, "CreateJob")
+
+	must(t, store.Reset(), "Reset")
+	if got, err := store.GetUser(user.ID); got != nil || !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("GetUser after Reset returned %+v, %v", got, err)
+	}
+	if got, err := store.GetVideo(video.ID); got.ID != uuid.Nil || !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("GetVideo after Reset returned %+v, %v", got, err)
+	}
+	if claimed, err := store.ClaimJob(time.Now().Add(time.Hour), time.Now().Add(2*time.Hour)); claimed != nil || err != nil {
+		t.Errorf("ClaimJob after Reset returned %+v, %v", claimed, err)
+	}
+}
@@ -0,0 +1,221 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// VideoVersion is one upload of a video's media. The video's own URLs are
+// always those of its current version; older versions are kept until their
+// retention runs out so they can be rolled back to.
+type VideoVersion struct {
+	ID        uuid.UUID `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Version   int       `json:"version"`
+	// ExpiresAt is when a superseded version's media will be deleted. It's
+	// nil for the current version.
+	ExpiresAt *time.Time `json:"expires_at"`
+	// DeletedAt is set once the media is gone; the version can't be rolled
+	// back to after that.
+	DeletedAt *time.Time `json:"deleted_at"`
+	CreateVideoVersionParams
+}
+
+type CreateVideoVersionParams struct {
+	VideoID  uuid.UUID     `json:"video_id"`
+	VideoURL *string       `json:"video_url"`
+	HLSURL   *string       `json:"hls_url"`
+	DASHURL  *string       `json:"dash_url"`
+	Metadata VideoMetadata `json:"metadata"`
+	// Encryption is how the media is encrypted at rest, see Video.
+	Encryption string `json:"encryption"`
+}
+
+const videoVersionColumns = `
+		id,
+		created_at,
+		video_id,
+		version,
+		video_url,
+		hls_url,
+		dash_url,
+		metadata,
+		encryption,
+		expires_at,
+		deleted_at`
+
+func scanVideoVersion(row interface{ Scan(...any) error }) (VideoVersion, error) {
+	var version VideoVersion
+	var metadata string
+	err := row.Scan(
+		&version.ID,
+		&version.CreatedAt,
+		&version.VideoID,
+		&version.Version,
+		&version.VideoURL,
+		&version.HLSURL,
+		&version.DASHURL,
+		&metadata,
+		&version.Encryption,
+		&version.ExpiresAt,
+		&version.DeletedAt)
+	if err != nil {
+		return VideoVersion{}, err
+	}
+	err = json.Unmarshal([]byte(metadata), &version.Metadata)
+	return version, err
+}
+
+// CreateVideoVersion records new media for a video, numbered one past its
+// latest version.
+func (c Client) CreateVideoVersion(params CreateVideoVersionParams) (VideoVersion, error) {
+	metadata, err := json.Marshal(params.Metadata)
+	if err != nil {
+		return VideoVersion{}, err
+	}
+	id := uuid.New()
+	query := `
+	INSERT INTO video_versions (
+		id,
+		created_at,
+		video_id,
+		version,
+		video_url,
+		hls_url,
+		dash_url,
+		metadata,
+		encryption
+	) VALUES (
+		?,
+		CURRENT_TIMESTAMP,
+		?,
+		(SELECT COALESCE(MAX(version), 0) + 1 FROM video_versions WHERE video_id = ?),
+		?, ?, ?, ?, ?
+	)
+	`
+	_, err = c.db.Exec(query, id, params.VideoID, params.VideoID, params.VideoURL, params.HLSURL, params.DASHURL, string(metadata), params.Encryption)
+	if err != nil {
+		return VideoVersion{}, err
+	}
+
+	return c.GetVideoVersionByID(id)
+}
+
+func (c Client) GetVideoVersions(videoID uuid.UUID) ([]VideoVersion, error) {
+	return queryVideoVersions(c.db, videoID)
+}
+
+// queryVideoVersions gets a video's versions through a db or a tx.
+func queryVideoVersions(q interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+}, videoID uuid.UUID) ([]VideoVersion, error) {
+	query := `SELECT` + videoVersionColumns + `
+	FROM video_versions
+	WHERE video_id = ?
+	ORDER BY version DESC
+	`
+
+	rows, err := q.Query(query, videoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := []VideoVersion{}
+	for rows.Next() {
+		version, err := scanVideoVersion(rows)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, version)
+	}
+
+	return versions, rows.Err()
+}
+
+func (c Client) GetVideoVersion(videoID uuid.UUID, version int) (VideoVersion, error) {
+	query := `SELECT` + videoVersionColumns + `
+	FROM video_versions
+	WHERE video_id = ? AND version = ?
+	`
+	return c.getVideoVersion(query, videoID, version)
+}
+
+func (c Client) GetVideoVersionByID(id uuid.UUID) (VideoVersion, error) {
+	query := `SELECT` + videoVersionColumns + `
+	FROM video_versions
+	WHERE id = ?
+	`
+	return c.getVideoVersion(query, id)
+}
+
+func (c Client) getVideoVersion(query string, args ...any) (VideoVersion, error) {
+	version, err := scanVideoVersion(c.db.QueryRow(query, args...))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return VideoVersion{}, ErrNotFound
+		}
+		return VideoVersion{}, err
+	}
+
+	return version, nil
+}
+
+// ExpireVideoVersion schedules when a version's media may be deleted. A nil
+// expiresAt keeps it indefinitely, as for the current version.
+func (c Client) ExpireVideoVersion(id uuid.UUID, expiresAt *time.Time) error {
+	if expiresAt != nil {
+		utc := expiresAt.UTC()
+		expiresAt = &utc
+	}
+	query := `
+	UPDATE video_versions
+	SET expires_at = ?
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, expiresAt, id)
+	return err
+}
+
+// ReleaseVideoVersion marks a version's media deleted and drops its reference
+// to the blob holding it. It reports whether the media is now unreferenced and
+// should be deleted from storage, and its blob forgotten, which is never the
+// case if the version was already released.
+func (c Client) ReleaseVideoVersion(id uuid.UUID) (bool, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	unreferenced, err := releaseVideoVersion(tx, id)
+	if err != nil {
+		return false, err
+	}
+	return unreferenced, tx.Commit()
+}
+
+func releaseVideoVersion(tx tx, id uuid.UUID) (bool, error) {
+	var videoURL sql.NullString
+	query := `
+	UPDATE video_versions
+	SET deleted_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND deleted_at IS NULL
+	RETURNING video_url
+	`
+	err := tx.QueryRow(query, id).Scan(&videoURL)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !videoURL.Valid {
+		return true, nil
+	}
+	return releaseBlob(tx, videoURL.String)
+}
@@ -2,44 +2,208 @@ package database
 
 import (
 	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/google/uuid"
 )
 
+type VideoStatus string
+
+const (
+	// VideoStatusCreated is a video no media has been uploaded for yet.
+	VideoStatusCreated    VideoStatus = "created"
+	VideoStatusUploaded   VideoStatus = "uploaded"
+	VideoStatusProcessing VideoStatus = "processing"
+	VideoStatusReady      VideoStatus = "ready"
+	VideoStatusFailed     VideoStatus = "failed"
+)
+
+// Video's thumbnail and media URLs hold storage keys, which are turned into
+// URLs when they're sent to a client. Rows from before that may still hold
+// full URLs.
 type Video struct {
-	ID           uuid.UUID `json:"id"`
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
-	ThumbnailURL *string   `json:"thumbnail_url"`
-	VideoURL     *string   `json:"video_url"`
+	ID           uuid.UUID     `json:"id"`
+	CreatedAt    time.Time     `json:"created_at"`
+	UpdatedAt    time.Time     `json:"updated_at"`
+	ThumbnailURL *string       `json:"thumbnail_url"`
+	Thumbnails   Thumbnails    `json:"thumbnails"`
+	VideoURL     *string       `json:"video_url"`
+	HLSURL       *string       `json:"hls_url"`
+	DASHURL      *string       `json:"dash_url"`
+	Status       VideoStatus   `json:"status"`
+	Metadata     VideoMetadata `json:"metadata"`
+	// Version is the number of the VideoVersion the URLs belong to, 0 until
+	// media has been uploaded.
+	Version int `json:"version"`
+	// Encryption is the server-side encryption the current version's media
+	// was stored with, "" for none.
+	Encryption string      `json:"encryption"`
+	Access     VideoAccess `json:"access"`
 	CreateVideoParams
 }
 
+// VideoMetadata describes the stored media as reported by ffprobe. It's all
+// zero until the video has been processed.
+type VideoMetadata struct {
+	DurationSeconds    float64 `json:"duration_seconds"`
+	Width              int     `json:"width"`
+	Height             int     `json:"height"`
+	VideoCodec         string  `json:"video_codec"`
+	AudioCodec         string  `json:"audio_codec"`
+	BitRate            int64   `json:"bit_rate"`
+	FrameRate          float64 `json:"frame_rate"`
+	AudioChannelLayout string  `json:"audio_channel_layout"`
+	ContainerFormat    string  `json:"container_format"`
+	FileSize           int64   `json:"file_size"`
+}
+
+// VideoAccess controls who can watch a video. Protected videos are only
+// served through signed URLs.
+type VideoAccess struct {
+	Protected bool `json:"protected"`
+	// URLExpirySeconds is how long signed URLs stay valid, 0 for the
+	// server's default.
+	URLExpirySeconds int `json:"url_expiry_seconds"`
+	// RestrictIP limits signed URLs to the IP address they were issued to.
+	RestrictIP bool `json:"restrict_ip"`
+}
+
+// ThumbnailVariant is one resized encoding of a video's thumbnail.
+type ThumbnailVariant struct {
+	URL       string `json:"url"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	MediaType string `json:"media_type"`
+}
+
+// Thumbnails is stored as a JSON array, since it's only ever read and
+// written as a whole.
+type Thumbnails []ThumbnailVariant
+
+func (t Thumbnails) Value() (driver.Value, error) {
+	if t == nil {
+		t = Thumbnails{}
+	}
+	b, err := json.Marshal(t)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (t *Thumbnails) Scan(src any) error {
+	var b []byte
+	switch v := src.(type) {
+	case nil:
+		*t = Thumbnails{}
+		return nil
+	case string:
+		b = []byte(v)
+	case []byte:
+		b = v
+	default:
+		return fmt.Errorf("can't scan %T into Thumbnails", src)
+	}
+	variants := Thumbnails{}
+	if err := json.Unmarshal(b, &variants); err != nil {
+		return err
+	}
+	*t = variants
+	return nil
+}
+
 type CreateVideoParams struct {
 	Title       string    `json:"title"`
 	Description string    `json:"description"`
 	UserID      uuid.UUID `json:"user_id"`
 }
 
-func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
-	query := `
-	SELECT
+const videoColumns = `
 		id,
 		created_at,
 		updated_at,
 		title,
 		description,
 		thumbnail_url,
+		thumbnails,
 		video_url,
-		user_id
+		hls_url,
+		dash_url,
+		user_id,
+		status,
+		duration_seconds,
+		width,
+		height,
+		video_codec,
+		audio_codec,
+		bit_rate,
+		frame_rate,
+		audio_channel_layout,
+		container_format,
+		file_size,
+		version,
+		encryption,
+		protected,
+		url_expiry_seconds,
+		restrict_ip`
+
+func scanVideo(row interface{ Scan(...any) error }) (Video, error) {
+	var video Video
+	err := row.Scan(
+		&video.ID,
+		&video.CreatedAt,
+		&video.UpdatedAt,
+		&video.Title,
+		&video.Description,
+		&video.ThumbnailURL,
+		&video.Thumbnails,
+		&video.VideoURL,
+		&video.HLSURL,
+		&video.DASHURL,
+		&video.UserID,
+		&video.Status,
+		&video.Metadata.DurationSeconds,
+		&video.Metadata.Width,
+		&video.Metadata.Height,
+		&video.Metadata.VideoCodec,
+		&video.Metadata.AudioCodec,
+		&video.Metadata.BitRate,
+		&video.Metadata.FrameRate,
+		&video.Metadata.AudioChannelLayout,
+		&video.Metadata.ContainerFormat,
+		&video.Metadata.FileSize,
+		&video.Version,
+		&video.Encryption,
+		&video.Access.Protected,
+		&video.Access.URLExpirySeconds,
+		&video.Access.RestrictIP)
+	return video, err
+}
+
+func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
+	query := `SELECT` + videoColumns + `
 	FROM videos
 	WHERE user_id = ?
 	ORDER BY created_at DESC
 	`
+	return c.queryVideos(query, userID)
+}
+
+// GetAllVideos returns every user's videos, for maintenance tasks.
+func (c Client) GetAllVideos() ([]Video, error) {
+	query := `SELECT` + videoColumns + `
+	FROM videos
+	ORDER BY created_at
+	`
+	return c.queryVideos(query)
+}
 
-	rows, err := c.db.Query(query, userID)
+func (c Client) queryVideos(query string, args ...any) ([]Video, error) {
+	rows, err := c.db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -47,23 +211,14 @@ func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
 
 	videos := []Video{}
 	for rows.Next() {
-		var video Video
-		if err := rows.Scan(
-			&video.ID,
-			&video.CreatedAt,
-			&video.UpdatedAt,
-			&video.Title,
-			&video.Description,
-			&video.ThumbnailURL,
-			&video.VideoURL,
-			&video.UserID,
-		); err != nil {
+		video, err := scanVideo(rows)
+		if err != nil {
 			return nil, err
 		}
 		videos = append(videos, video)
 	}
 
-	return videos, nil
+	return videos, rows.Err()
 }
 
 func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
@@ -75,10 +230,11 @@ func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
 		updated_at,
 		title,
 		description,
-		user_id
-	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?)
+		user_id,
+		status
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?)
 	`
-	_, err := c.db.Exec(query, id, params.Title, params.Description, params.UserID)
+	_, err := c.db.Exec(query, id, params.Title, params.Description, params.UserID, VideoStatusCreated)
 	if err != nil {
 		return Video{}, err
 	}
@@ -87,33 +243,15 @@ func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
 }
 
 func (c Client) GetVideo(id uuid.UUID) (Video, error) {
-	query := `
-	SELECT
-		id,
-		created_at,
-		updated_at,
-		title,
-		description,
-		thumbnail_url,
-		video_url,
-		user_id
+	query := `SELECT` + videoColumns + `
 	FROM videos
 	WHERE id = ?
 	`
 
-	var video Video
-	err := c.db.QueryRow(query, id).Scan(
-		&video.ID,
-		&video.CreatedAt,
-		&video.UpdatedAt,
-		&video.Title,
-		&video.Description,
-		&video.ThumbnailURL,
-		&video.VideoURL,
-		&video.UserID)
+	video, err := scanVideo(c.db.QueryRow(query, id))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return Video{}, nil
+			return Video{}, ErrNotFound
 		}
 		return Video{}, err
 	}
@@ -128,8 +266,23 @@ func (c Client) UpdateVideo(video Video) error {
 		title = ?,
 		description = ?,
 		thumbnail_url = ?,
+		thumbnails = ?,
 		video_url = ?,
-		user_id = ?
+		hls_url = ?,
+		dash_url = ?,
+		user_id = ?,
+		duration_seconds = ?,
+		width = ?,
+		height = ?,
+		video_codec = ?,
+		audio_codec = ?,
+		bit_rate = ?,
+		frame_rate = ?,
+		audio_channel_layout = ?,
+		container_format = ?,
+		file_size = ?,
+		version = ?,
+		encryption = ?
 	WHERE id = ?
 	`
 
@@ -138,18 +291,110 @@ func (c Client) UpdateVideo(video Video) error {
 		video.Title,
 		video.Description,
 		&video.ThumbnailURL,
+		video.Thumbnails,
 		&video.VideoURL,
+		&video.HLSURL,
+		&video.DASHURL,
 		video.UserID,
+		video.Metadata.DurationSeconds,
+		video.Metadata.Width,
+		video.Metadata.Height,
+		video.Metadata.VideoCodec,
+		video.Metadata.AudioCodec,
+		video.Metadata.BitRate,
+		video.Metadata.FrameRate,
+		video.Metadata.AudioChannelLayout,
+		video.Metadata.ContainerFormat,
+		video.Metadata.FileSize,
+		video.Version,
+		video.Encryption,
 		video.ID,
 	)
 	return err
 }
 
-func (c Client) DeleteVideo(id uuid.UUID) error {
+// DeleteVideo deletes a video along with its version history and unfinished
+// uploads, releasing the versions' media. It returns the versions whose media
+// is now unreferenced and should be deleted from storage, which mustn't
+// happen before the video is gone.
+func (c Client) DeleteVideo(id uuid.UUID) ([]VideoVersion, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	versions, err := queryVideoVersions(tx, id)
+	if err != nil {
+		return nil, err
+	}
+	released := []VideoVersion{}
+	for _, version := range versions {
+		unreferenced, err := releaseVideoVersion(tx, version.ID)
+		if err != nil {
+			return nil, err
+		}
+		if unreferenced {
+			released = append(released, version)
+		}
+	}
+	_, err = tx.Exec("DELETE FROM video_versions WHERE video_id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec("DELETE FROM uploads WHERE video_id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec("DELETE FROM videos WHERE id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	return released, tx.Commit()
+}
+
+// UpdateVideoStatus is kept apart from UpdateVideo so that edits made while a
+// video is being processed can't clobber the status the worker sets.
+func (c Client) UpdateVideoStatus(id uuid.UUID, status VideoStatus) error {
+	query := `
+	UPDATE videos
+	SET
+		status = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, status, id)
+	return err
+}
+
+// UpdateVideoThumbnails is kept apart from UpdateVideo, like
+// UpdateVideoStatus, so a thumbnail rendered from a stale copy of the video
+// can't undo a new version or rollback made meanwhile.
+func (c Client) UpdateVideoThumbnails(id uuid.UUID, thumbnailURL *string, thumbnails Thumbnails) error {
+	query := `
+	UPDATE videos
+	SET
+		thumbnail_url = ?,
+		thumbnails = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, thumbnailURL, thumbnails, id)
+	return err
+}
+
+// UpdateVideoAccess is kept apart from UpdateVideo, like UpdateVideoStatus,
+// so a video being processed can't undo an access change.
+func (c Client) UpdateVideoAccess(id uuid.UUID, access VideoAccess) error {
 	query := `
-	DELETE FROM videos
+	UPDATE videos
+	SET
+		protected = ?,
+		url_expiry_seconds = ?,
+		restrict_ip = ?,
+		updated_at = CURRENT_TIMESTAMP
 	WHERE id = ?
 	`
-	_, err := c.db.Exec(query, id)
+	_, err := c.db.Exec(query, access.Protected, access.URLExpirySeconds, access.RestrictIP, id)
 	return err
 }
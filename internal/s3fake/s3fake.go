@@ -0,0 +1,502 @@
+// Package s3fake is an in-memory stand-in for S3, good enough for the
+// requests Tubely makes: objects, listings and multipart uploads, addressed
+// path-style (http://host/bucket/key). Buckets spring into existence on first
+// use and signatures aren't checked, so any credentials and presigned URLs
+// work. Nothing is persisted.
+package s3fake
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	xmlns           = "http://s3.amazonaws.com/doc/2006-03-01/"
+	maxKeys         = 1000
+	timestampFormat = "2006-01-02T15:04:05.000Z"
+)
+
+type object struct {
+	data         []byte
+	contentType  string
+	etag         string
+	lastModified time.Time
+}
+
+type multipartUpload struct {
+	bucket      string
+	key         string
+	contentType string
+	initiated   time.Time
+	parts       map[int]object
+}
+
+// Server implements the S3 REST API as an http.Handler.
+type Server struct {
+	mu      sync.Mutex
+	buckets map[string]map[string]object
+	uploads map[string]*multipartUpload
+}
+
+func New() *Server {
+	return &Server{
+		buckets: map[string]map[string]object{},
+		uploads: map[string]*multipartUpload{},
+	}
+}
+
+type s3Error struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	// HEAD responses can't have a body; the SDK goes by the status.
+	if r.Method == http.MethodHead {
+		w.WriteHeader(status)
+		return
+	}
+	writeXML(w, status, s3Error{Code: code, Message: message})
+}
+
+func writeXML(w http.ResponseWriter, status int, v any) {
+	body, err := xml.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	w.Write(body)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Browsers upload to presigned URLs directly.
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Expose-Headers", "ETag")
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, PUT, POST, DELETE")
+		w.Header().Set("Access-Control-Allow-Headers", "*")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket == "" {
+		writeError(w, r, http.StatusNotImplemented, "NotImplemented", "Only path-style requests to a bucket are supported")
+		return
+	}
+	if strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		writeError(w, r, http.StatusNotImplemented, "NotImplemented", "Chunked payload signing isn't supported")
+		return
+	}
+	query := r.URL.Query()
+
+	switch {
+	case key == "" && r.Method == http.MethodGet && query.Has("uploads"):
+		s.listMultipartUploads(w, r, bucket)
+	case key == "" && r.Method == http.MethodGet:
+		s.listObjects(w, r, bucket)
+	case key == "":
+		writeError(w, r, http.StatusNotImplemented, "NotImplemented", "Bucket operations aren't supported")
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		s.createMultipartUpload(w, r, bucket, key)
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		s.completeMultipartUpload(w, r, bucket, key, query.Get("uploadId"))
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		s.uploadPart(w, r, bucket, key, query.Get("uploadId"), query.Get("partNumber"))
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		s.abortMultipartUpload(w, r, bucket, key, query.Get("uploadId"))
+	case r.Method == http.MethodPut:
+		s.putObject(w, r, bucket, key)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		s.getObject(w, r, bucket, key)
+	case r.Method == http.MethodDelete:
+		s.deleteObject(w, bucket, key)
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed", r.Method+" isn't supported")
+	}
+}
+
+func newObject(data []byte, contentType string) object {
+	sum := md5.Sum(data)
+	if contentType == "" {
+		contentType = "binary/octet-stream"
+	}
+	return object{
+		data:         data,
+		contentType:  contentType,
+		etag:         `"` + hex.EncodeToString(sum[:]) + `"`,
+		lastModified: time.Now().UTC().Truncate(time.Millisecond),
+	}
+}
+
+func (s *Server) putObject(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+	obj := newObject(data, r.Header.Get("Content-Type"))
+
+	s.mu.Lock()
+	if s.buckets[bucket] == nil {
+		s.buckets[bucket] = map[string]object{}
+	}
+	s.buckets[bucket][key] = obj
+	s.mu.Unlock()
+
+	w.Header().Set("ETag", obj.etag)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) getObject(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	s.mu.Lock()
+	obj, ok := s.buckets[bucket][key]
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+		return
+	}
+	w.Header().Set("Content-Type", obj.contentType)
+	w.Header().Set("ETag", obj.etag)
+	// ServeContent handles Range requests and HEAD.
+	http.ServeContent(w, r, "", obj.lastModified, bytes.NewReader(obj.data))
+}
+
+func (s *Server) deleteObject(w http.ResponseWriter, bucket, key string) {
+	s.mu.Lock()
+	delete(s.buckets[bucket], key)
+	s.mu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type listBucketResult struct {
+	XMLName               xml.Name       `xml:"ListBucketResult"`
+	Xmlns                 string         `xml:"xmlns,attr"`
+	Name                  string         `xml:"Name"`
+	Prefix                string         `xml:"Prefix"`
+	KeyCount              int            `xml:"KeyCount"`
+	MaxKeys               int            `xml:"MaxKeys"`
+	IsTruncated           bool           `xml:"IsTruncated"`
+	ContinuationToken     string         `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string         `xml:"NextContinuationToken,omitempty"`
+	Contents              []listContents `xml:"Contents"`
+}
+
+type listContents struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int    `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+// listObjects is ListObjectsV2. Continuation tokens are simply the last key
+// of the previous page.
+func (s *Server) listObjects(w http.ResponseWriter, r *http.Request, bucket string) {
+	query := r.URL.Query()
+	if query.Get("list-type") != "2" {
+		writeError(w, r, http.StatusNotImplemented, "NotImplemented", "Only ListObjectsV2 is supported")
+		return
+	}
+	prefix := query.Get("prefix")
+	limit := maxKeys
+	if v := query.Get("max-keys"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeError(w, r, http.StatusBadRequest, "InvalidArgument", "Invalid max-keys")
+			return
+		}
+		limit = min(n, maxKeys)
+	}
+	after := query.Get("start-after")
+	if token := query.Get("continuation-token"); token != "" {
+		after = token
+	}
+
+	result := listBucketResult{
+		Xmlns:             xmlns,
+		Name:              bucket,
+		Prefix:            prefix,
+		MaxKeys:           limit,
+		ContinuationToken: query.Get("continuation-token"),
+	}
+	s.mu.Lock()
+	keys := []string{}
+	for key := range s.buckets[bucket] {
+		if strings.HasPrefix(key, prefix) && key > after {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	if len(keys) > limit {
+		keys = keys[:limit]
+		result.IsTruncated = true
+		if limit > 0 {
+			result.NextContinuationToken = keys[limit-1]
+		}
+	}
+	for _, key := range keys {
+		obj := s.buckets[bucket][key]
+		result.Contents = append(result.Contents, listContents{
+			Key:          key,
+			LastModified: obj.lastModified.Format(timestampFormat),
+			ETag:         obj.etag,
+			Size:         len(obj.data),
+			StorageClass: "STANDARD",
+		})
+	}
+	s.mu.Unlock()
+	result.KeyCount = len(result.Contents)
+	writeXML(w, http.StatusOK, result)
+}
+
+type initiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadID string   `xml:"UploadId"`
+}
+
+func (s *Server) createMultipartUpload(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		writeError(w, r, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	uploadID := hex.EncodeToString(idBytes)
+
+	s.mu.Lock()
+	s.uploads[uploadID] = &multipartUpload{
+		bucket:      bucket,
+		key:         key,
+		contentType: r.Header.Get("Content-Type"),
+		initiated:   time.Now().UTC().Truncate(time.Millisecond),
+		parts:       map[int]object{},
+	}
+	s.mu.Unlock()
+
+	writeXML(w, http.StatusOK, initiateMultipartUploadResult{
+		Xmlns:    xmlns,
+		Bucket:   bucket,
+		Key:      key,
+		UploadID: uploadID,
+	})
+}
+
+type listMultipartUploadsResult struct {
+	XMLName            xml.Name       `xml:"ListMultipartUploadsResult"`
+	Xmlns              string         `xml:"xmlns,attr"`
+	Bucket             string         `xml:"Bucket"`
+	KeyMarker          string         `xml:"KeyMarker"`
+	UploadIDMarker     string         `xml:"UploadIdMarker"`
+	NextKeyMarker      string         `xml:"NextKeyMarker,omitempty"`
+	NextUploadIDMarker string         `xml:"NextUploadIdMarker,omitempty"`
+	Prefix             string         `xml:"Prefix"`
+	MaxUploads         int            `xml:"MaxUploads"`
+	IsTruncated        bool           `xml:"IsTruncated"`
+	Uploads            []listedUpload `xml:"Upload"`
+}
+
+type listedUpload struct {
+	Key          string `xml:"Key"`
+	UploadID     string `xml:"UploadId"`
+	Initiated    string `xml:"Initiated"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+// listMultipartUploads lists the uploads in progress ordered by key and
+// upload ID, which is also what the markers go by.
+func (s *Server) listMultipartUploads(w http.ResponseWriter, r *http.Request, bucket string) {
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+	limit := maxKeys
+	if v := query.Get("max-uploads"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeError(w, r, http.StatusBadRequest, "InvalidArgument", "Invalid max-uploads")
+			return
+		}
+		limit = min(n, maxKeys)
+	}
+	keyMarker, idMarker := query.Get("key-marker"), query.Get("upload-id-marker")
+
+	result := listMultipartUploadsResult{
+		Xmlns:          xmlns,
+		Bucket:         bucket,
+		KeyMarker:      keyMarker,
+		UploadIDMarker: idMarker,
+		Prefix:         prefix,
+		MaxUploads:     limit,
+	}
+	s.mu.Lock()
+	ids := []string{}
+	for id, upload := range s.uploads {
+		if upload.bucket != bucket || !strings.HasPrefix(upload.key, prefix) {
+			continue
+		}
+		if upload.key < keyMarker || (upload.key == keyMarker && (idMarker == "" || id <= idMarker)) {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	slices.SortFunc(ids, func(a, b string) int {
+		if c := strings.Compare(s.uploads[a].key, s.uploads[b].key); c != 0 {
+			return c
+		}
+		return strings.Compare(a, b)
+	})
+	if len(ids) > limit {
+		ids = ids[:limit]
+		result.IsTruncated = true
+		if limit > 0 {
+			result.NextKeyMarker = s.uploads[ids[limit-1]].key
+			result.NextUploadIDMarker = ids[limit-1]
+		}
+	}
+	for _, id := range ids {
+		upload := s.uploads[id]
+		result.Uploads = append(result.Uploads, listedUpload{
+			Key:          upload.key,
+			UploadID:     id,
+			Initiated:    upload.initiated.Format(timestampFormat),
+			StorageClass: "STANDARD",
+		})
+	}
+	s.mu.Unlock()
+	writeXML(w, http.StatusOK, result)
+}
+
+// upload returns the upload with the given ID if it's for bucket and key.
+// The caller holds s.mu.
+func (s *Server) upload(bucket, key, uploadID string) *multipartUpload {
+	upload := s.uploads[uploadID]
+	if upload == nil || upload.bucket != bucket || upload.key != key {
+		return nil
+	}
+	return upload
+}
+
+func (s *Server) uploadPart(w http.ResponseWriter, r *http.Request, bucket, key, uploadID, partNumber string) {
+	n, err := strconv.Atoi(partNumber)
+	if err != nil || n < 1 || n > 10000 {
+		writeError(w, r, http.StatusBadRequest, "InvalidArgument", "Part number must be between 1 and 10000")
+		return
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+	part := newObject(data, "")
+
+	s.mu.Lock()
+	upload := s.upload(bucket, key, uploadID)
+	if upload != nil {
+		upload.parts[n] = part
+	}
+	s.mu.Unlock()
+	if upload == nil {
+		writeError(w, r, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist.")
+		return
+	}
+	w.Header().Set("ETag", part.etag)
+	w.WriteHeader(http.StatusOK)
+}
+
+type completeMultipartUpload struct {
+	Parts []struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	} `xml:"Part"`
+}
+
+type completeMultipartUploadResult struct {
+	XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Bucket  string   `xml:"Bucket"`
+	Key     string   `xml:"Key"`
+	ETag    string   `xml:"ETag"`
+}
+
+func (s *Server) completeMultipartUpload(w http.ResponseWriter, r *http.Request, bucket, key, uploadID string) {
+	var req completeMultipartUpload
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, "MalformedXML", err.Error())
+		return
+	}
+	if len(req.Parts) == 0 {
+		writeError(w, r, http.StatusBadRequest, "MalformedXML", "No parts given")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	upload := s.upload(bucket, key, uploadID)
+	if upload == nil {
+		writeError(w, r, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist.")
+		return
+	}
+	var data []byte
+	sums := []byte{}
+	for i, p := range req.Parts {
+		if i > 0 && p.PartNumber <= req.Parts[i-1].PartNumber {
+			writeError(w, r, http.StatusBadRequest, "InvalidPartOrder", "Parts must be in ascending order")
+			return
+		}
+		part, ok := upload.parts[p.PartNumber]
+		if !ok || part.etag != `"`+strings.Trim(p.ETag, `"`)+`"` {
+			writeError(w, r, http.StatusBadRequest, "InvalidPart", fmt.Sprintf("Part %d wasn't uploaded or its ETag doesn't match", p.PartNumber))
+			return
+		}
+		data = append(data, part.data...)
+		sum, _ := hex.DecodeString(strings.Trim(part.etag, `"`))
+		sums = append(sums, sum...)
+	}
+
+	obj := newObject(data, upload.contentType)
+	// Multipart ETags are the MD5 of the parts' MD5s plus the part count.
+	sum := md5.Sum(sums)
+	obj.etag = fmt.Sprintf(`"%s-%d"`, hex.EncodeToString(sum[:]), len(req.Parts))
+	if s.buckets[bucket] == nil {
+		s.buckets[bucket] = map[string]object{}
+	}
+	s.buckets[bucket][key] = obj
+	delete(s.uploads, uploadID)
+
+	writeXML(w, http.StatusOK, completeMultipartUploadResult{
+		Xmlns:  xmlns,
+		Bucket: bucket,
+		Key:    key,
+		ETag:   obj.etag,
+	})
+}
+
+func (s *Server) abortMultipartUpload(w http.ResponseWriter, r *http.Request, bucket, key, uploadID string) {
+	s.mu.Lock()
+	upload := s.upload(bucket, key, uploadID)
+	if upload != nil {
+		delete(s.uploads, uploadID)
+	}
+	s.mu.Unlock()
+	if upload == nil {
+		writeError(w, r, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist.")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
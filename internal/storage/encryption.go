@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// SSEMode is how S3 encrypts objects at rest.
+type SSEMode string
+
+const (
+	SSENone SSEMode = ""
+	// SSES3 uses keys managed by S3.
+	SSES3 SSEMode = "sse-s3"
+	// SSEKMS uses a KMS key, the account's AWS managed key unless one is
+	// configured.
+	SSEKMS SSEMode = "sse-kms"
+	// SSEC uses a key we provide with every request. S3 doesn't keep it,
+	// so objects can't be read without it, not even through CloudFront.
+	SSEC SSEMode = "sse-c"
+)
+
+func ParseSSEMode(s string) (SSEMode, error) {
+	switch s {
+	case "", "none":
+		return SSENone, nil
+	case string(SSES3), string(SSEKMS), string(SSEC):
+		return SSEMode(s), nil
+	}
+	return SSENone, fmt.Errorf("unknown encryption %q, expected \"none\", \"sse-s3\", \"sse-kms\" or \"sse-c\"", s)
+}
+
+// Encryption configures server-side encryption.
+type Encryption struct {
+	// Mode is what new objects are encrypted with.
+	Mode SSEMode
+	// KMSKeyID is the key for SSEKMS. Empty means the AWS managed key.
+	KMSKeyID string
+	// CustomerKey is the 256-bit master key for SSEC. Each object is
+	// encrypted with its own key derived from it, since presigned requests
+	// hand the object's key to clients. It's also needed to read objects
+	// written with SSEC after Mode has changed.
+	CustomerKey []byte
+}
+
+// Encrypter is implemented by stores that encrypt objects at rest. Since the
+// mode can change between deployments, it's recorded with every object, and
+// objects are read through WithEncryption with the mode they were written
+// with.
+type Encrypter interface {
+	Encryption() SSEMode
+	// WithEncryption returns the store set up to read and write objects
+	// encrypted with mode.
+	WithEncryption(mode SSEMode) (BlobStore, error)
+}
+
+func (e Encryption) validate() error {
+	if _, err := ParseSSEMode(string(e.Mode)); err != nil {
+		return err
+	}
+	if e.Mode == SSEC && e.CustomerKey == nil {
+		return fmt.Errorf("%s needs a customer key", SSEC)
+	}
+	if e.CustomerKey != nil && len(e.CustomerKey) != 32 {
+		return fmt.Errorf("customer keys must be 256 bits, got %d", len(e.CustomerKey)*8)
+	}
+	return nil
+}
+
+// serverSide returns the encryption parameters of requests that create
+// objects. SSE-C is sent as customer parameters instead.
+func (e Encryption) serverSide() (types.ServerSideEncryption, *string) {
+	switch e.Mode {
+	case SSES3:
+		return types.ServerSideEncryptionAes256, nil
+	case SSEKMS:
+		if e.KMSKeyID == "" {
+			return types.ServerSideEncryptionAwsKms, nil
+		}
+		return types.ServerSideEncryptionAwsKms, aws.String(e.KMSKeyID)
+	}
+	return "", nil
+}
+
+// sseCustomer holds the SSE-C parameters that every request touching an
+// object's data has to carry.
+type sseCustomer struct {
+	algorithm, key, keyMD5 *string
+}
+
+// customer returns the SSE-C parameters for the object at key. Its key is an
+// HMAC of the object key under the master key: whoever is handed a presigned
+// request, headers included, can read that object and no other, and the
+// master key never leaves the server.
+func (e Encryption) customer(key string) sseCustomer {
+	if e.Mode != SSEC {
+		return sseCustomer{}
+	}
+	mac := hmac.New(sha256.New, e.CustomerKey)
+	mac.Write([]byte(key))
+	objectKey := mac.Sum(nil)
+	sum := md5.Sum(objectKey)
+	return sseCustomer{
+		algorithm: aws.String("AES256"),
+		key:       aws.String(base64.StdEncoding.EncodeToString(objectKey)),
+		keyMD5:    aws.String(base64.StdEncoding.EncodeToString(sum[:])),
+	}
+}
@@ -0,0 +1,161 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+var testCustomerKey = bytes.Repeat([]byte{7}, 32)
+
+func TestParseSSEMode(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    SSEMode
+		wantErr bool
+	}{
+		{"", SSENone, false},
+		{"none", SSENone, false},
+		{"sse-s3", SSES3, false},
+		{"sse-kms", SSEKMS, false},
+		{"sse-c", SSEC, false},
+		{"aes256", SSENone, true},
+		{"SSE-S3", SSENone, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseSSEMode(tt.in)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("ParseSSEMode(%q) = %q, %v; want %q, error %t", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestEncryptionValidate(t *testing.T) {
+	tests := []struct {
+		name       string
+		encryption Encryption
+		wantErr    bool
+	}{
+		{"none", Encryption{}, false},
+		{"sse-s3", Encryption{Mode: SSES3}, false},
+		{"sse-kms", Encryption{Mode: SSEKMS, KMSKeyID: "alias/videos"}, false},
+		{"sse-c", Encryption{Mode: SSEC, CustomerKey: testCustomerKey}, false},
+		{"sse-c without a key", Encryption{Mode: SSEC}, true},
+		{"sse-c with a short key", Encryption{Mode: SSEC, CustomerKey: testCustomerKey[:16]}, true},
+		// Kept around to read older SSE-C objects.
+		{"sse-s3 with a customer key", Encryption{Mode: SSES3, CustomerKey: testCustomerKey}, false},
+		{"unknown mode", Encryption{Mode: "rot13"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.encryption.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() = %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEncryptionServerSide(t *testing.T) {
+	tests := []struct {
+		name       string
+		encryption Encryption
+		sse        types.ServerSideEncryption
+		kmsKeyID   *string
+	}{
+		{"none", Encryption{}, "", nil},
+		{"sse-s3", Encryption{Mode: SSES3}, types.ServerSideEncryptionAes256, nil},
+		{"sse-kms", Encryption{Mode: SSEKMS}, types.ServerSideEncryptionAwsKms, nil},
+		{"sse-kms with a key", Encryption{Mode: SSEKMS, KMSKeyID: "alias/videos"}, types.ServerSideEncryptionAwsKms, aws.String("alias/videos")},
+		// Sent as customer parameters instead.
+		{"sse-c", Encryption{Mode: SSEC, CustomerKey: testCustomerKey}, "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sse, kmsKeyID := tt.encryption.serverSide()
+			if sse != tt.sse || aws.ToString(kmsKeyID) != aws.ToString(tt.kmsKeyID) {
+				t.Errorf("serverSide() = %q, %v; want %q, %v", sse, aws.ToString(kmsKeyID), tt.sse, aws.ToString(tt.kmsKeyID))
+			}
+		})
+	}
+}
+
+func TestEncryptionCustomer(t *testing.T) {
+	for _, mode := range []SSEMode{SSENone, SSES3, SSEKMS} {
+		c := Encryption{Mode: mode, CustomerKey: testCustomerKey}.customer("videos/a.mp4")
+		if c != (sseCustomer{}) {
+			t.Errorf("%q sends customer parameters", mode)
+		}
+	}
+
+	e := Encryption{Mode: SSEC, CustomerKey: testCustomerKey}
+	c := e.customer("videos/a.mp4")
+	if aws.ToString(c.algorithm) != "AES256" {
+		t.Errorf("algorithm = %q, want AES256", aws.ToString(c.algorithm))
+	}
+	key, err := base64.StdEncoding.DecodeString(aws.ToString(c.key))
+	if err != nil || len(key) != 32 {
+		t.Fatalf("key %q isn't a base64 256-bit key: %v", aws.ToString(c.key), err)
+	}
+	if bytes.Equal(key, testCustomerKey) {
+		t.Errorf("the master key is sent as the object's key")
+	}
+	sum := md5.Sum(key)
+	if aws.ToString(c.keyMD5) != base64.StdEncoding.EncodeToString(sum[:]) {
+		t.Errorf("key MD5 %q doesn't match the key", aws.ToString(c.keyMD5))
+	}
+
+	if again := e.customer("videos/a.mp4"); *again.key != *c.key {
+		t.Errorf("the same object got a different key")
+	}
+	if other := e.customer("videos/b.mp4"); *other.key == *c.key {
+		t.Errorf("two objects share a key")
+	}
+	otherMaster := Encryption{Mode: SSEC, CustomerKey: bytes.Repeat([]byte{8}, 32)}
+	if other := otherMaster.customer("videos/a.mp4"); *other.key == *c.key {
+		t.Errorf("two master keys derive the same object key")
+	}
+}
+
+func TestS3StorePresignSSEC(t *testing.T) {
+	client := s3.New(s3.Options{
+		Region:      "us-east-1",
+		Credentials: credentials.NewStaticCredentialsProvider("test", "test", ""),
+	})
+	store, err := NewS3Store(client, "test-bucket", S3Options{Encryption: Encryption{Mode: SSEC, CustomerKey: testCustomerKey}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	get, err := store.PresignGet(ctx, "videos/a.mp4", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	put, err := store.PresignPut(ctx, "staging/b", "video/mp4", 1<<20, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	master := base64.StdEncoding.EncodeToString(testCustomerKey)
+	for name, req := range map[string]PresignedRequest{"GET": get, "PUT": put} {
+		key := req.Header["X-Amz-Server-Side-Encryption-Customer-Key"]
+		if key == "" {
+			t.Errorf("presigned %s has no customer key: %v", name, req.Header)
+		}
+		for header, value := range req.Header {
+			if value == master {
+				t.Errorf("presigned %s carries the master key in %s", name, header)
+			}
+		}
+	}
+	if get.Header["X-Amz-Server-Side-Encryption-Customer-Key"] == put.Header["X-Amz-Server-Side-Encryption-Customer-Key"] {
+		t.Errorf("two objects were presigned with the same key")
+	}
+}
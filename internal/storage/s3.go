@@ -0,0 +1,476 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+const (
+	// S3 rejects multipart parts smaller than 5 MiB (except the last one)
+	// and uploads with more than 10,000 parts.
+	MinPartSize = 5 << 20
+	maxParts    = 10000
+
+	DefaultPartSize    = 16 << 20
+	DefaultConcurrency = 4
+)
+
+type S3Options struct {
+	// PartSize is the size of each multipart part. Objects smaller than
+	// one part are sent with a single PutObject.
+	PartSize int64
+	// Concurrency is the number of parts uploaded in parallel. At most
+	// PartSize*Concurrency bytes are held in memory per upload.
+	Concurrency int
+	Encryption  Encryption
+}
+
+type S3Store struct {
+	client      *s3.Client
+	bucket      string
+	partSize    int64
+	concurrency int
+	encryption  Encryption
+}
+
+func NewS3Store(client *s3.Client, bucket string, opts S3Options) (*S3Store, error) {
+	if opts.PartSize == 0 {
+		opts.PartSize = DefaultPartSize
+	}
+	if opts.PartSize < MinPartSize {
+		opts.PartSize = MinPartSize
+	}
+	if opts.Concurrency < 1 {
+		opts.Concurrency = DefaultConcurrency
+	}
+	if err := opts.Encryption.validate(); err != nil {
+		return nil, err
+	}
+	return &S3Store{
+		client:      client,
+		bucket:      bucket,
+		partSize:    opts.PartSize,
+		concurrency: opts.Concurrency,
+		encryption:  opts.Encryption,
+	}, nil
+}
+
+func (s *S3Store) Encryption() SSEMode {
+	return s.encryption.Mode
+}
+
+func (s *S3Store) WithEncryption(mode SSEMode) (BlobStore, error) {
+	if mode == s.encryption.Mode {
+		return s, nil
+	}
+	c := *s
+	c.encryption.Mode = mode
+	if err := c.encryption.validate(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (s *S3Store) Put(ctx context.Context, key string, body io.Reader, contentType string) error {
+	// The first part is read into a buffer that only grows as far as the
+	// object does: most objects (playlists, segments, thumbnails) are far
+	// smaller than a part and shouldn't each cost one.
+	var first bytes.Buffer
+	_, err := io.CopyN(&first, body, s.partSize)
+	if err == io.EOF {
+		sse, kmsKeyID := s.encryption.serverSide()
+		c := s.encryption.customer(key)
+		_, err = s.client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:               aws.String(s.bucket),
+			Key:                  aws.String(key),
+			Body:                 bytes.NewReader(first.Bytes()),
+			ContentType:          aws.String(contentType),
+			ServerSideEncryption: sse,
+			SSEKMSKeyId:          kmsKeyID,
+			SSECustomerAlgorithm: c.algorithm,
+			SSECustomerKey:       c.key,
+			SSECustomerKeyMD5:    c.keyMD5,
+		})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	return s.putMultipart(ctx, key, first.Bytes(), body, contentType)
+}
+
+// putMultipart streams body to S3 in parts of s.partSize, starting with the
+// already read first part. Buffers are recycled so memory stays bounded no
+// matter how large the object is. Any failure aborts the upload so S3 doesn't
+// keep (and bill for) the incomplete parts.
+func (s *S3Store) putMultipart(ctx context.Context, key string, first []byte, body io.Reader, contentType string) (err error) {
+	id, err := s.CreateMultipartUpload(ctx, key, contentType)
+	if err != nil {
+		return err
+	}
+	uploadID := aws.String(id)
+	c := s.encryption.customer(key)
+	defer func() {
+		if err == nil {
+			return
+		}
+		_, abortErr := s.client.AbortMultipartUpload(context.WithoutCancel(ctx), &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(s.bucket),
+			Key:      aws.String(key),
+			UploadId: uploadID,
+		})
+		if abortErr != nil {
+			err = errors.Join(err, fmt.Errorf("couldn't abort multipart upload: %w", abortErr))
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		parts     []types.CompletedPart
+		uploadErr error
+	)
+	// free holds one slot per allowed in-flight part; a nil slot means the
+	// buffer hasn't been allocated yet.
+	free := make(chan []byte, s.concurrency)
+	for i := 0; i < s.concurrency-1; i++ {
+		free <- nil
+	}
+
+	uploadPart := func(partNumber int32, buf []byte, n int) {
+		defer wg.Done()
+		out, err := s.client.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket:     aws.String(s.bucket),
+			Key:        aws.String(key),
+			UploadId:   uploadID,
+			PartNumber: aws.Int32(partNumber),
+			Body:       bytes.NewReader(buf[:n]),
+
+			SSECustomerAlgorithm: c.algorithm,
+			SSECustomerKey:       c.key,
+			SSECustomerKeyMD5:    c.keyMD5,
+		})
+		mu.Lock()
+		if err != nil {
+			if uploadErr == nil {
+				uploadErr = fmt.Errorf("couldn't upload part %d: %w", partNumber, err)
+			}
+			cancel()
+		} else {
+			parts = append(parts, types.CompletedPart{
+				ETag:       out.ETag,
+				PartNumber: aws.Int32(partNumber),
+			})
+		}
+		mu.Unlock()
+		free <- buf
+	}
+
+	buf, n := first, len(first)
+	var readErr error
+	for partNumber := int32(1); ; partNumber++ {
+		if partNumber > maxParts {
+			readErr = fmt.Errorf("object exceeds %d parts of %d bytes", maxParts, s.partSize)
+			break
+		}
+		wg.Add(1)
+		go uploadPart(partNumber, buf, n)
+		if n < len(buf) {
+			break
+		}
+
+		select {
+		case buf = <-free:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		if buf == nil {
+			buf = make([]byte, s.partSize)
+		}
+		n, readErr = io.ReadFull(body, buf)
+		if readErr == io.EOF {
+			readErr = nil
+			break
+		}
+		if readErr == io.ErrUnexpectedEOF {
+			readErr = nil
+		}
+		if readErr != nil {
+			break
+		}
+	}
+	wg.Wait()
+
+	if readErr != nil {
+		return readErr
+	}
+	if uploadErr != nil {
+		return uploadErr
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	sort.Slice(parts, func(i, j int) bool {
+		return aws.ToInt32(parts[i].PartNumber) < aws.ToInt32(parts[j].PartNumber)
+	})
+	_, err = s.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.bucket),
+		Key:             aws.String(key),
+		UploadId:        uploadID,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+
+		SSECustomerAlgorithm: c.algorithm,
+		SSECustomerKey:       c.key,
+		SSECustomerKeyMD5:    c.keyMD5,
+	})
+	return err
+}
+
+func (s *S3Store) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	c := s.encryption.customer(key)
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket:               aws.String(s.bucket),
+		Key:                  aws.String(key),
+		SSECustomerAlgorithm: c.algorithm,
+		SSECustomerKey:       c.key,
+		SSECustomerKeyMD5:    c.keyMD5,
+	})
+	if err != nil {
+		return nil, mapS3Error(err)
+	}
+	return out.Body, nil
+}
+
+func (s *S3Store) Delete(ctx context.Context, key string) error {
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	return err
+}
+
+func (s *S3Store) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	c := s.encryption.customer(key)
+	out, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:               aws.String(s.bucket),
+		Key:                  aws.String(key),
+		SSECustomerAlgorithm: c.algorithm,
+		SSECustomerKey:       c.key,
+		SSECustomerKeyMD5:    c.keyMD5,
+	})
+	if err != nil {
+		return ObjectInfo{}, mapS3Error(err)
+	}
+	return ObjectInfo{
+		Key:          key,
+		Size:         aws.ToInt64(out.ContentLength),
+		ContentType:  aws.ToString(out.ContentType),
+		LastModified: aws.ToTime(out.LastModified),
+	}, nil
+}
+
+func (s *S3Store) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	objects := []ObjectInfo{}
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range page.Contents {
+			objects = append(objects, ObjectInfo{
+				Key:          aws.ToString(obj.Key),
+				Size:         aws.ToInt64(obj.Size),
+				LastModified: aws.ToTime(obj.LastModified),
+			})
+		}
+	}
+	return objects, nil
+}
+
+// PresignGet returns a request that lets whoever holds it GET key until it
+// expires. It's computed locally, no request is made to S3. For SSE-C
+// objects the request includes the key headers.
+func (s *S3Store) PresignGet(ctx context.Context, key string, expiry time.Duration) (PresignedRequest, error) {
+	c := s.encryption.customer(key)
+	req, err := s3.NewPresignClient(s.client).PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket:               aws.String(s.bucket),
+		Key:                  aws.String(key),
+		SSECustomerAlgorithm: c.algorithm,
+		SSECustomerKey:       c.key,
+		SSECustomerKeyMD5:    c.keyMD5,
+	}, s3.WithPresignExpires(expiry))
+	if err != nil {
+		return PresignedRequest{}, err
+	}
+	return presignedRequest(req), nil
+}
+
+// presignedRequest drops Host from the signed headers, clients set it from
+// the URL anyway.
+func presignedRequest(req *v4.PresignedHTTPRequest) PresignedRequest {
+	presigned := PresignedRequest{URL: req.URL}
+	for name, values := range req.SignedHeader {
+		if http.CanonicalHeaderKey(name) == "Host" || len(values) == 0 {
+			continue
+		}
+		if presigned.Header == nil {
+			presigned.Header = map[string]string{}
+		}
+		presigned.Header[http.CanonicalHeaderKey(name)] = values[0]
+	}
+	return presigned
+}
+
+func mapS3Error(err error) error {
+	var noSuchKey *types.NoSuchKey
+	var notFound *types.NotFound
+	var noSuchUpload *types.NoSuchUpload
+	if errors.As(err, &noSuchKey) || errors.As(err, &notFound) || errors.As(err, &noSuchUpload) {
+		return ErrNotFound
+	}
+	// Not every operation models these errors, e.g. CompleteMultipartUpload
+	// reports an unknown upload as a generic API error.
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "NoSuchKey", "NotFound", "NoSuchUpload":
+			return ErrNotFound
+		}
+	}
+	return err
+}
+
+func (s *S3Store) PresignPut(ctx context.Context, key, contentType string, size int64, expiry time.Duration) (PresignedRequest, error) {
+	sse, kmsKeyID := s.encryption.serverSide()
+	c := s.encryption.customer(key)
+	req, err := s3.NewPresignClient(s.client).PresignPutObject(ctx, &s3.PutObjectInput{
+		Bucket:               aws.String(s.bucket),
+		Key:                  aws.String(key),
+		ContentType:          aws.String(contentType),
+		ContentLength:        aws.Int64(size),
+		ServerSideEncryption: sse,
+		SSEKMSKeyId:          kmsKeyID,
+		SSECustomerAlgorithm: c.algorithm,
+		SSECustomerKey:       c.key,
+		SSECustomerKeyMD5:    c.keyMD5,
+	}, s3.WithPresignExpires(expiry))
+	if err != nil {
+		return PresignedRequest{}, err
+	}
+	return presignedRequest(req), nil
+}
+
+func (s *S3Store) CreateMultipartUpload(ctx context.Context, key, contentType string) (string, error) {
+	sse, kmsKeyID := s.encryption.serverSide()
+	c := s.encryption.customer(key)
+	out, err := s.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:               aws.String(s.bucket),
+		Key:                  aws.String(key),
+		ContentType:          aws.String(contentType),
+		ServerSideEncryption: sse,
+		SSEKMSKeyId:          kmsKeyID,
+		SSECustomerAlgorithm: c.algorithm,
+		SSECustomerKey:       c.key,
+		SSECustomerKeyMD5:    c.keyMD5,
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(out.UploadId), nil
+}
+
+func (s *S3Store) PresignUploadPart(ctx context.Context, key, uploadID string, partNumber int32, expiry time.Duration) (PresignedRequest, error) {
+	c := s.encryption.customer(key)
+	req, err := s3.NewPresignClient(s.client).PresignUploadPart(ctx, &s3.UploadPartInput{
+		Bucket:               aws.String(s.bucket),
+		Key:                  aws.String(key),
+		UploadId:             aws.String(uploadID),
+		PartNumber:           aws.Int32(partNumber),
+		SSECustomerAlgorithm: c.algorithm,
+		SSECustomerKey:       c.key,
+		SSECustomerKeyMD5:    c.keyMD5,
+	}, s3.WithPresignExpires(expiry))
+	if err != nil {
+		return PresignedRequest{}, err
+	}
+	return presignedRequest(req), nil
+}
+
+func (s *S3Store) CompleteMultipartUpload(ctx context.Context, key, uploadID string, parts []CompletedPart) error {
+	completed := make([]types.CompletedPart, 0, len(parts))
+	for _, p := range parts {
+		completed = append(completed, types.CompletedPart{
+			PartNumber: aws.Int32(p.PartNumber),
+			ETag:       aws.String(p.ETag),
+		})
+	}
+	sort.Slice(completed, func(i, j int) bool {
+		return *completed[i].PartNumber < *completed[j].PartNumber
+	})
+	c := s.encryption.customer(key)
+	_, err := s.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.bucket),
+		Key:             aws.String(key),
+		UploadId:        aws.String(uploadID),
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: completed},
+
+		SSECustomerAlgorithm: c.algorithm,
+		SSECustomerKey:       c.key,
+		SSECustomerKeyMD5:    c.keyMD5,
+	})
+	return mapS3Error(err)
+}
+
+func (s *S3Store) AbortMultipartUpload(ctx context.Context, key, uploadID string) error {
+	_, err := s.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+	})
+	return mapS3Error(err)
+}
+
+func (s *S3Store) ListMultipartUploads(ctx context.Context, prefix string) ([]MultipartUpload, error) {
+	uploads := []MultipartUpload{}
+	paginator := s3.NewListMultipartUploadsPaginator(s.client, &s3.ListMultipartUploadsInput{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, upload := range page.Uploads {
+			uploads = append(uploads, MultipartUpload{
+				Key:       aws.ToString(upload.Key),
+				UploadID:  aws.ToString(upload.UploadId),
+				Initiated: aws.ToTime(upload.Initiated),
+			})
+		}
+	}
+	return uploads, nil
+}
@@ -0,0 +1,232 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/s3fake"
+)
+
+// s3Requests counts the requests made to the fake S3 by kind.
+type s3Requests struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func (r *s3Requests) count(kind string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.counts[kind]
+}
+
+func requestKind(req *http.Request) string {
+	query := req.URL.Query()
+	switch {
+	case req.Method == http.MethodPost && query.Has("uploads"):
+		return "create"
+	case req.Method == http.MethodPut && query.Has("partNumber"):
+		return "part"
+	case req.Method == http.MethodPost && query.Has("uploadId"):
+		return "complete"
+	case req.Method == http.MethodDelete && query.Has("uploadId"):
+		return "abort"
+	}
+	return req.Method
+}
+
+// newTestS3Store returns a store over a fake S3 with the smallest part size
+// S3 allows. reject, if set, fails the requests it returns true for.
+func newTestS3Store(t *testing.T, reject func(*http.Request) bool) (*S3Store, *s3Requests) {
+	t.Helper()
+	fake := s3fake.New()
+	requests := &s3Requests{counts: map[string]int{}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.mu.Lock()
+		requests.counts[requestKind(r)]++
+		requests.mu.Unlock()
+		if reject != nil && reject(r) {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusForbidden)
+			io.WriteString(w, `<Error><Code>AccessDenied</Code><Message>Access Denied</Message></Error>`)
+			return
+		}
+		fake.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	client := s3.New(s3.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(server.URL),
+		UsePathStyle: true,
+		Credentials:  credentials.NewStaticCredentialsProvider("test", "test", ""),
+	})
+	store, err := NewS3Store(client, "test-bucket", S3Options{PartSize: MinPartSize, Concurrency: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, requests
+}
+
+// testData returns n bytes that differ from part to part, so parts put
+// together in the wrong order don't go unnoticed.
+func testData(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i / 4099)
+	}
+	return data
+}
+
+func TestS3StorePut(t *testing.T) {
+	tests := []struct {
+		name  string
+		size  int
+		parts int
+	}{
+		{"empty", 0, 0},
+		{"small", 1 << 10, 0},
+		{"just under a part", MinPartSize - 1, 0},
+		{"exactly a part", MinPartSize, 1},
+		{"several parts", 2*MinPartSize + MinPartSize/2, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, requests := newTestS3Store(t, nil)
+			ctx := context.Background()
+			data := testData(tt.size)
+
+			if err := store.Put(ctx, "videos/a.mp4", bytes.NewReader(data), "video/mp4"); err != nil {
+				t.Fatal(err)
+			}
+			if got := requests.count("part"); got != tt.parts {
+				t.Errorf("uploaded %d parts, want %d", got, tt.parts)
+			}
+			if tt.parts == 0 && requests.count("create") != 0 {
+				t.Errorf("an object smaller than a part went multipart")
+			}
+
+			body, err := store.Get(ctx, "videos/a.mp4")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer body.Close()
+			got, err := io.ReadAll(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("got %d bytes back, not the %d put", len(got), len(data))
+			}
+			info, err := store.Stat(ctx, "videos/a.mp4")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.ContentType != "video/mp4" {
+				t.Errorf("Content-Type = %q, want video/mp4", info.ContentType)
+			}
+		})
+	}
+}
+
+// failingReader fails with err where r would have ended.
+type failingReader struct {
+	r   io.Reader
+	err error
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if err == io.EOF {
+		return n, f.err
+	}
+	return n, err
+}
+
+func TestS3StorePutAborts(t *testing.T) {
+	errBody := errors.New("connection reset")
+	tests := []struct {
+		name    string
+		body    func() io.Reader
+		reject  func(*http.Request) bool
+		wantErr error
+	}{
+		{
+			name: "body fails",
+			body: func() io.Reader {
+				return &failingReader{r: bytes.NewReader(testData(MinPartSize + 1<<10)), err: errBody}
+			},
+			wantErr: errBody,
+		},
+		{
+			name: "part rejected",
+			body: func() io.Reader { return bytes.NewReader(testData(3 * MinPartSize)) },
+			reject: func(r *http.Request) bool {
+				return requestKind(r) == "part" && r.URL.Query().Get("partNumber") == "2"
+			},
+		},
+		{
+			name: "complete rejected",
+			body: func() io.Reader { return bytes.NewReader(testData(MinPartSize + 1<<10)) },
+			reject: func(r *http.Request) bool {
+				return requestKind(r) == "complete"
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, requests := newTestS3Store(t, tt.reject)
+			ctx := context.Background()
+
+			err := store.Put(ctx, "videos/a.mp4", tt.body(), "video/mp4")
+			if err == nil {
+				t.Fatal("Put succeeded")
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("Put returned %v, want %v", err, tt.wantErr)
+			}
+			if strings.Contains(err.Error(), "abort") {
+				t.Errorf("abort failed: %v", err)
+			}
+			if got := requests.count("abort"); got != 1 {
+				t.Errorf("aborted %d times, want once", got)
+			}
+			if _, err := store.Stat(ctx, "videos/a.mp4"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Stat after a failed Put: %v, want ErrNotFound", err)
+			}
+		})
+	}
+}
+
+func TestS3StorePresignPut(t *testing.T) {
+	store, _ := newTestS3Store(t, nil)
+	req, err := store.PresignPut(context.Background(), "staging/a", "video/mp4", 12345, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(req.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := strings.Split(u.Query().Get("X-Amz-SignedHeaders"), ";")
+	for _, header := range []string{"content-length", "content-type"} {
+		if !slices.Contains(signed, header) {
+			t.Errorf("%s isn't signed, only %v", header, signed)
+		}
+	}
+	if req.Header["Content-Length"] != "12345" || req.Header["Content-Type"] != "video/mp4" {
+		t.Errorf("presigned headers %v, want the declared size and type", req.Header)
+	}
+}
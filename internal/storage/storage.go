@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+var ErrNotFound = errors.New("object not found")
+
+type ObjectInfo struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	ContentType  string    `json:"content_type"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+// BlobStore is the place media objects live. Keys are slash separated and
+// never start with a slash, e.g. "landscape/abc123.mp4".
+type BlobStore interface {
+	Put(ctx context.Context, key string, body io.Reader, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+	Stat(ctx context.Context, key string) (ObjectInfo, error)
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+}
+
+// PresignedRequest is a request that anyone holding it can make until it
+// expires. Header holds the headers that were signed along with the URL,
+// which have to be sent exactly as they are.
+type PresignedRequest struct {
+	URL    string            `json:"url"`
+	Header map[string]string `json:"headers,omitempty"`
+}
+
+// Presigner is implemented by stores that can grant temporary access to
+// objects in a private bucket.
+type Presigner interface {
+	PresignGet(ctx context.Context, key string, expiry time.Duration) (PresignedRequest, error)
+}
+
+// DirectUploader is implemented by stores that clients can upload to
+// directly with presigned requests, without the bytes passing through us.
+// Objects larger than one request allows are uploaded in parts.
+type DirectUploader interface {
+	// PresignPut signs size in as the Content-Length, so the request can't
+	// upload more than was declared.
+	PresignPut(ctx context.Context, key, contentType string, size int64, expiry time.Duration) (PresignedRequest, error)
+	CreateMultipartUpload(ctx context.Context, key, contentType string) (string, error)
+	PresignUploadPart(ctx context.Context, key, uploadID string, partNumber int32, expiry time.Duration) (PresignedRequest, error)
+	CompleteMultipartUpload(ctx context.Context, key, uploadID string, parts []CompletedPart) error
+	AbortMultipartUpload(ctx context.Context, key, uploadID string) error
+	// ListMultipartUploads returns the uploads under prefix that were
+	// started but neither completed nor aborted.
+	ListMultipartUploads(ctx context.Context, prefix string) ([]MultipartUpload, error)
+}
+
+type MultipartUpload struct {
+	Key       string
+	UploadID  string
+	Initiated time.Time
+}
+
+type CompletedPart struct {
+	PartNumber int32  `json:"part_number"`
+	ETag       string `json:"etag"`
+}
@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// URLBuilder turns storage keys into public URLs. Every asset class (videos,
+// thumbnails, ...) has its own base URL, which can point at the app server,
+// a bucket's virtual-host or path-style endpoint, or a CDN, so the domain
+// serving an asset can change without touching the keys stored for it.
+type URLBuilder struct {
+	bases map[string]string
+	// legacy holds older base URLs per class. Records saved before keys
+	// were stored hold absolute URLs under one of these.
+	legacy map[string][]string
+}
+
+func NewURLBuilder() *URLBuilder {
+	return &URLBuilder{
+		bases:  map[string]string{},
+		legacy: map[string][]string{},
+	}
+}
+
+// SetBase sets the base URL assets of class are served from, e.g.
+// "https://cdn.example.com/videos".
+func (b *URLBuilder) SetBase(class, base string) error {
+	u, err := url.Parse(base)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("base URL for %s must be absolute, got %q", class, base)
+	}
+	b.bases[class] = strings.TrimSuffix(base, "/")
+	return nil
+}
+
+// AddLegacyBase registers a base URL that absolute URLs in old records may
+// start with, so their keys can still be recovered.
+func (b *URLBuilder) AddLegacyBase(class, base string) {
+	b.legacy[class] = append(b.legacy[class], strings.TrimSuffix(base, "/"))
+}
+
+// Base returns the base URL of class.
+func (b *URLBuilder) Base(class string) string {
+	return b.bases[class]
+}
+
+// URL returns the public URL of ref, a stored reference of the given class.
+// Absolute URLs from old records are moved to the current base if they're
+// under a known one, and returned as they are otherwise.
+func (b *URLBuilder) URL(class, ref string) string {
+	key, ok := b.Key(class, ref)
+	if !ok {
+		return ref
+	}
+	segments := strings.Split(key, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return b.bases[class] + "/" + strings.Join(segments, "/")
+}
+
+// Key returns the storage key ref refers to. That's ref itself unless it's an
+// absolute URL from an old record, in which case it reports false if the URL
+// isn't under any of the class's base URLs.
+func (b *URLBuilder) Key(class, ref string) (string, bool) {
+	if !IsAbsoluteRef(ref) {
+		return ref, ref != ""
+	}
+	for _, base := range append([]string{b.bases[class]}, b.legacy[class]...) {
+		if base == "" || !strings.HasPrefix(ref, base+"/") {
+			continue
+		}
+		key, err := url.PathUnescape(strings.TrimPrefix(ref, base+"/"))
+		if err != nil || key == "" {
+			return "", false
+		}
+		return key, true
+	}
+	return "", false
+}
+
+// IsAbsoluteRef reports whether a stored reference is a full URL rather than
+// a storage key.
+func IsAbsoluteRef(ref string) bool {
+	return strings.Contains(ref, "://")
+}
@@ -0,0 +1,108 @@
+package storage
+
+import "testing"
+
+func newTestURLBuilder(t *testing.T) *URLBuilder {
+	t.Helper()
+	b := NewURLBuilder()
+	for class, base := range map[string]string{
+		"videos":     "https://cdn.example.com/videos/",
+		"thumbnails": "http://localhost:8091/assets",
+	} {
+		if err := b.SetBase(class, base); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b.AddLegacyBase("videos", "https://tubely.s3.us-east-1.amazonaws.com/")
+	b.AddLegacyBase("videos", "https://s3.us-east-1.amazonaws.com/tubely")
+	return b
+}
+
+func TestURLBuilderURL(t *testing.T) {
+	b := newTestURLBuilder(t)
+	tests := []struct {
+		name  string
+		class string
+		ref   string
+		want  string
+	}{
+		{"key", "videos", "landscape/a.mp4", "https://cdn.example.com/videos/landscape/a.mp4"},
+		{"thumbnail key", "thumbnails", "a/640w.jpg", "http://localhost:8091/assets/a/640w.jpg"},
+		{"escaped key", "videos", "landscape/a b#1?.mp4", "https://cdn.example.com/videos/landscape/a%20b%231%3F.mp4"},
+		{"empty", "videos", "", ""},
+		{"current base", "videos", "https://cdn.example.com/videos/landscape/a.mp4", "https://cdn.example.com/videos/landscape/a.mp4"},
+		{"virtual-host legacy base", "videos", "https://tubely.s3.us-east-1.amazonaws.com/landscape/a.mp4", "https://cdn.example.com/videos/landscape/a.mp4"},
+		{"path-style legacy base", "videos", "https://s3.us-east-1.amazonaws.com/tubely/portrait/b%20c.mp4", "https://cdn.example.com/videos/portrait/b%20c.mp4"},
+		{"unknown host", "videos", "https://elsewhere.example.com/a.mp4", "https://elsewhere.example.com/a.mp4"},
+		{"other class's base", "thumbnails", "https://cdn.example.com/videos/landscape/a.mp4", "https://cdn.example.com/videos/landscape/a.mp4"},
+		{"base without a key", "videos", "https://cdn.example.com/videos/", "https://cdn.example.com/videos/"},
+		{"base as a prefix", "videos", "https://cdn.example.com/videos-old/a.mp4", "https://cdn.example.com/videos-old/a.mp4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := b.URL(tt.class, tt.ref); got != tt.want {
+				t.Errorf("URL(%q, %q) = %q, want %q", tt.class, tt.ref, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestURLBuilderKey(t *testing.T) {
+	b := newTestURLBuilder(t)
+	tests := []struct {
+		name   string
+		class  string
+		ref    string
+		want   string
+		wantOK bool
+	}{
+		{"key", "videos", "landscape/a.mp4", "landscape/a.mp4", true},
+		{"empty", "videos", "", "", false},
+		{"current base", "videos", "https://cdn.example.com/videos/landscape/a.mp4", "landscape/a.mp4", true},
+		{"legacy base", "videos", "https://tubely.s3.us-east-1.amazonaws.com/landscape/a%20b.mp4", "landscape/a b.mp4", true},
+		{"unknown host", "videos", "https://elsewhere.example.com/a.mp4", "", false},
+		{"legacy base of another class", "thumbnails", "https://tubely.s3.us-east-1.amazonaws.com/a.jpg", "", false},
+		{"bad escape", "videos", "https://cdn.example.com/videos/a%zz.mp4", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := b.Key(tt.class, tt.ref)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("Key(%q, %q) = %q, %v, want %q, %v", tt.class, tt.ref, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestURLBuilderSetBase(t *testing.T) {
+	tests := []struct {
+		base    string
+		wantErr bool
+	}{
+		{"https://cdn.example.com", false},
+		{"http://localhost:8091/assets/", false},
+		{"cdn.example.com/videos", true},
+		{"/assets", true},
+		{"", true},
+		{"https://", true},
+	}
+	for _, tt := range tests {
+		b := NewURLBuilder()
+		err := b.SetBase("videos", tt.base)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("SetBase(%q) returned %v", tt.base, err)
+		}
+		if err != nil && b.Base("videos") != "" {
+			t.Errorf("SetBase(%q) failed but set the base to %q", tt.base, b.Base("videos"))
+		}
+	}
+
+	// Bases are per class.
+	b := newTestURLBuilder(t)
+	if got := b.Base("videos"); got != "https://cdn.example.com/videos" {
+		t.Errorf("videos base = %q", got)
+	}
+	if got := b.Base("thumbnails"); got != "http://localhost:8091/assets" {
+		t.Errorf("thumbnails base = %q", got)
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	jobKindProcessVideo = "process_video"
+
+	jobPollInterval = 5 * time.Second
+	maxJobBackoff   = time.Hour
+	// jobLease is how long a claimed job stays with its worker without a
+	// heartbeat. Workers renew it every quarter lease while the job runs,
+	// so only jobs whose worker died are claimed again.
+	jobLease = 2 * time.Minute
+)
+
+type jobQueueConfig struct {
+	workers      int
+	maxAttempts  int
+	retryBackoff time.Duration
+	// wake nudges idle workers when a job is enqueued so they don't wait
+	// for the next poll.
+	wake chan struct{}
+}
+
+type processVideoPayload struct {
+	Path      string `json:"path"`
+	MediaType string `json:"media_type"`
+}
+
+// enqueueVideoProcessing hands an uploaded file over to the workers. From here
+// on the job owns the file at path and removes it once it's done with it. The
+// video is only marked uploaded along with the job being queued.
+func (cfg *apiConfig) enqueueVideoProcessing(videoID uuid.UUID, path, mediaType string) error {
+	payload, err := json.Marshal(processVideoPayload{
+		Path:      path,
+		MediaType: mediaType,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = cfg.db.CreateVideoJob(database.VideoStatusUploaded, database.CreateJobParams{
+		Kind:        jobKindProcessVideo,
+		VideoID:     &videoID,
+		Payload:     string(payload),
+		MaxAttempts: cfg.jobs.maxAttempts,
+		RunAt:       time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	cfg.wakeJobWorkers()
+	return nil
+}
+
+func (cfg *apiConfig) enqueueJob(kind string, videoID *uuid.UUID, payload string, runAt time.Time) error {
+	_, err := cfg.db.CreateJob(database.CreateJobParams{
+		Kind:        kind,
+		VideoID:     videoID,
+		Payload:     payload,
+		MaxAttempts: cfg.jobs.maxAttempts,
+		RunAt:       runAt,
+	})
+	if err != nil {
+		return err
+	}
+	cfg.wakeJobWorkers()
+	return nil
+}
+
+// wakeJobWorkers lets an idle worker know a job was enqueued.
+func (cfg *apiConfig) wakeJobWorkers() {
+	select {
+	case cfg.jobs.wake <- struct{}{}:
+	default:
+	}
+}
+
+// startJobWorkers starts the worker pool. Jobs left running by a process
+// that died are picked up again once their lease runs out, so servers
+// sharing a database don't take each other's jobs.
+func (cfg *apiConfig) startJobWorkers(ctx context.Context) error {
+	for i := 0; i < cfg.jobs.workers; i++ {
+		go cfg.jobWorker(ctx)
+	}
+	return nil
+}
+
+func (cfg *apiConfig) jobWorker(ctx context.Context) {
+	ticker := time.NewTicker(jobPollInterval)
+	defer ticker.Stop()
+	for {
+		now := time.Now()
+		job, err := cfg.db.ClaimJob(now, now.Add(jobLease))
+		if err != nil {
+			log.Printf("Couldn't claim job: %v", err)
+		}
+		if job != nil {
+			cfg.runJob(ctx, *job)
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-cfg.jobs.wake:
+		}
+	}
+}
+
+func (cfg *apiConfig) runJob(ctx context.Context, job database.Job) {
+	if job.Status == database.JobStatusFailed {
+		// Claimed after its worker died on the last attempt.
+		log.Printf("Job %s (%s) attempt %d/%d failed: %s", job.ID, job.Kind, job.Attempts, job.MaxAttempts, database.JobLeaseExpired)
+		cfg.jobFailed(job)
+		return
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	go cfg.renewJobLease(ctx, cancel, job)
+
+	var err error
+	switch job.Kind {
+	case jobKindProcessVideo:
+		err = cfg.processVideoJob(ctx, job)
+	case jobKindDeleteObject:
+		err = cfg.deleteObjectJob(ctx, job)
+	case jobKindRetireVersion:
+		err = cfg.retireVersionJob(ctx, job)
+	default:
+		err = fmt.Errorf("unknown job kind %q", job.Kind)
+	}
+	if errors.Is(context.Cause(ctx), errJobLeaseLost) {
+		// Another worker has the job now and records how it went.
+		log.Printf("Job %s (%s) attempt %d lost its lease", job.ID, job.Kind, job.Attempts)
+		return
+	}
+	if err == nil {
+		if err := cfg.db.CompleteJob(job.ID); err != nil {
+			log.Printf("Couldn't complete job %s: %v", job.ID, err)
+		}
+		return
+	}
+
+	log.Printf("Job %s (%s) attempt %d/%d failed: %v", job.ID, job.Kind, job.Attempts, job.MaxAttempts, err)
+	if job.Attempts < job.MaxAttempts {
+		err = cfg.db.RetryJob(job.ID, time.Now().Add(cfg.jobBackoff(job.Attempts)), err.Error())
+	} else {
+		cfg.jobFailed(job)
+		err = cfg.db.FailJob(job.ID, err.Error())
+	}
+	if err != nil {
+		log.Printf("Couldn't update job %s: %v", job.ID, err)
+	}
+}
+
+var errJobLeaseLost = errors.New("job lease lost")
+
+// renewJobLease extends the job's lease until ctx is done. If the lease
+// can't be extended the job is cancelled with errJobLeaseLost.
+func (cfg *apiConfig) renewJobLease(ctx context.Context, cancel context.CancelCauseFunc, job database.Job) {
+	ticker := time.NewTicker(jobLease / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		extended, err := cfg.db.ExtendJobLease(job.ID, job.Attempts, time.Now().Add(jobLease))
+		if err != nil {
+			// The lease outlasts a few missed heartbeats.
+			log.Printf("Couldn't extend the lease of job %s: %v", job.ID, err)
+			continue
+		}
+		if !extended {
+			cancel(errJobLeaseLost)
+			return
+		}
+	}
+}
+
+// jobBackoff doubles the delay with every attempt.
+func (cfg *apiConfig) jobBackoff(attempts int) time.Duration {
+	backoff := cfg.jobs.retryBackoff
+	for i := 1; i < attempts && backoff < maxJobBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, maxJobBackoff)
+}
+
+// jobFailed cleans up after a job that has run out of attempts.
+func (cfg *apiConfig) jobFailed(job database.Job) {
+	if job.Kind == jobKindDeleteObject {
+		log.Printf("Giving up on deleting %s, the object is leaked", job.Payload)
+		return
+	}
+	if job.Kind != jobKindProcessVideo || job.VideoID == nil {
+		return
+	}
+	if err := cfg.db.UpdateVideoStatus(*job.VideoID, database.VideoStatusFailed); err != nil {
+		log.Printf("Couldn't mark video %s as failed: %v", *job.VideoID, err)
+	}
+	var payload processVideoPayload
+	if err := json.Unmarshal([]byte(job.Payload), &payload); err == nil {
+		removeFile(payload.Path)
+	}
+}
+
+func (cfg *apiConfig) processVideoJob(ctx context.Context, job database.Job) error {
+	var payload processVideoPayload
+	if err := json.Unmarshal([]byte(job.Payload), &payload); err != nil {
+		return err
+	}
+	if job.VideoID == nil {
+		return fmt.Errorf("job %s has no video", job.ID)
+	}
+
+	video, err := cfg.db.GetVideo(*job.VideoID)
+	if errors.Is(err, database.ErrNotFound) {
+		// The video was deleted while it waited in the queue.
+		removeFile(payload.Path)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	err = cfg.db.UpdateVideoStatus(video.ID, database.VideoStatusProcessing)
+	if err != nil {
+		return err
+	}
+	video, err = cfg.storeVideo(ctx, video.ID, payload.Path)
+	if errors.Is(err, database.ErrNotFound) {
+		removeFile(payload.Path)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if video.ThumbnailURL == nil {
+		// A missing thumbnail isn't worth failing (and reprocessing) the
+		// whole video over.
+		if _, err := cfg.generateThumbnail(ctx, video, payload.Path); err != nil {
+			log.Printf("Couldn't generate thumbnail for video %s: %v", video.ID, err)
+		}
+	}
+	err = cfg.db.UpdateVideoStatus(video.ID, database.VideoStatusReady)
+	if err != nil {
+		return err
+	}
+	removeFile(payload.Path)
+	return nil
+}
+
+func removeFile(path string) {
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("Couldn't remove %s: %v", path, err)
+	}
+}
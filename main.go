@@ -2,29 +2,82 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/cloudfront"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	awsConfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/joho/godotenv"
-	_ "github.com/lib/pq"
 )
 
 type apiConfig struct {
-	db               database.Client
-	jwtSecret        string
-	platform         string
-	filepathRoot     string
-	assetsRoot       string
-	s3Bucket         string
-	s3Region         string
-	s3CfDistribution string
-	port             string
-	s3Client         *s3.Client
+	db           database.Store
+	jwtSecret    string
+	platform     string
+	filepathRoot string
+	assetsRoot   string
+	uploadsRoot  string
+	// uploadExpiry is how long a resumable upload is kept after its last
+	// chunk.
+	uploadExpiry time.Duration
+	// directUploadExpiry is how long the presigned URLs of a direct upload
+	// are valid. Multipart uploads left incomplete after that are aborted
+	// by gc.
+	directUploadExpiry time.Duration
+	// uploadLocks holds the IDs of the resumable uploads requests are
+	// writing to.
+	uploadLocks    sync.Map
+	port           string
+	videoStore     storage.BlobStore
+	thumbnailStore storage.BlobStore
+	// urls builds the public URLs of stored objects. The database only
+	// holds their keys.
+	urls             *storage.URLBuilder
+	jobs             jobQueueConfig
+	renditionLadder  []int
+	streamingFormats streamingFormats
+	// allowedVideoTypes are the MIME types accepted for video uploads.
+	allowedVideoTypes []string
+	// thumbnailFrameOffset is where generated thumbnails start looking for
+	// a frame.
+	thumbnailFrameOffset time.Duration
+	// thumbnailWidths are the sizes every thumbnail is resized to.
+	thumbnailWidths []int
+	// videoVersionRetention is how long replaced media is kept around.
+	videoVersionRetention time.Duration
+	// privateVideos means the bucket isn't public and videos are only
+	// handed out as presigned URLs that expire after presignExpiry.
+	privateVideos bool
+	presignExpiry time.Duration
+	cloudfront    cloudfrontConfig
+}
+
+// cloudfrontConfig signs URLs for protected videos. signer is nil when no
+// key pair is configured.
+type cloudfrontConfig struct {
+	signer *cloudfront.Signer
+	// urlExpiry is the default lifetime of signed URLs and cookies.
+	urlExpiry time.Duration
+	// cookieDomain is the Domain of signed cookies. It has to cover both
+	// this server and the distribution for browsers to send them.
+	cookieDomain string
 }
 
 type thumbnail struct {
@@ -35,15 +88,115 @@ type thumbnail struct {
 func main() {
 	godotenv.Load(".env")
 
-	pathToDB := os.Getenv("DB_PATH")
-	if pathToDB == "" {
-		log.Fatal("DB_URL must be set")
+	// The fake S3 and migrations need none of the server's configuration.
+	if len(os.Args) > 1 && os.Args[1] == "fakes3" {
+		if err := runFakeS3(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrate(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
-	db, err := database.NewClient(pathToDB)
+	cfg := loadConfig()
+
+	// Maintenance commands share the server's configuration.
+	if len(os.Args) > 1 {
+		var err error
+		switch os.Args[1] {
+		case "gc":
+			err = cfg.runGC(context.Background(), os.Stdout, os.Args[2:])
+		default:
+			err = fmt.Errorf("unknown command %q", os.Args[1])
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	err := cfg.startJobWorkers(context.Background())
+	if err != nil {
+		log.Fatalf("Couldn't start job workers: %v", err)
+	}
+
+	srv := &http.Server{
+		Addr:    ":" + cfg.port,
+		Handler: cfg.routes(),
+	}
+
+	log.Printf("Serving on: http://localhost:%s/app/\n", cfg.port)
+	log.Fatal(srv.ListenAndServe())
+}
+
+// routes maps every endpoint to its handler.
+func (cfg *apiConfig) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	appHandler := http.StripPrefix("/app", http.FileServer(http.Dir(cfg.filepathRoot)))
+	mux.Handle("/app/", appHandler)
+
+	assetsHandler := http.StripPrefix("/assets", http.FileServer(http.Dir(cfg.assetsRoot)))
+	mux.Handle("/assets/", noCacheMiddleware(assetsHandler))
+
+	mux.HandleFunc("POST /api/login", cfg.handlerLogin)
+	mux.HandleFunc("POST /api/refresh", cfg.handlerRefresh)
+	mux.HandleFunc("POST /api/revoke", cfg.handlerRevoke)
+
+	mux.HandleFunc("POST /api/users", cfg.handlerUsersCreate)
+
+	mux.HandleFunc("POST /api/videos", cfg.handlerVideoMetaCreate)
+	mux.HandleFunc("POST /api/thumbnail_upload/{videoID}", cfg.handlerUploadThumbnail)
+	mux.HandleFunc("POST /api/video_upload/{videoID}", cfg.handlerUploadVideo)
+	mux.HandleFunc("POST /api/videos/{videoID}/upload-url", cfg.handlerDirectUploadCreate)
+	mux.HandleFunc("POST /api/videos/{videoID}/upload-complete", cfg.handlerDirectUploadComplete)
+	mux.HandleFunc("OPTIONS /api/tus/", cfg.handlerTusOptions)
+	mux.HandleFunc("POST /api/tus/videos/{videoID}", cfg.handlerTusCreate)
+	mux.HandleFunc("HEAD /api/tus/uploads/{uploadID}", cfg.handlerTusHead)
+	mux.HandleFunc("PATCH /api/tus/uploads/{uploadID}", cfg.handlerTusPatch)
+	mux.HandleFunc("DELETE /api/tus/uploads/{uploadID}", cfg.handlerTusDelete)
+	mux.HandleFunc("GET /api/videos", cfg.handlerVideosRetrieve)
+	mux.HandleFunc("GET /api/videos/{videoID}", cfg.handlerVideoGet)
+	mux.HandleFunc("DELETE /api/videos/{videoID}", cfg.handlerVideoMetaDelete)
+	mux.HandleFunc("POST /api/videos/{videoID}/thumbnail/from-frame", cfg.handlerThumbnailFromFrame)
+	mux.HandleFunc("PUT /api/videos/{videoID}/access", cfg.handlerVideoAccessUpdate)
+	mux.HandleFunc("GET /api/videos/{videoID}/versions", cfg.handlerVideoVersionsList)
+	mux.HandleFunc("POST /api/videos/{videoID}/versions/{version}/rollback", cfg.handlerVideoVersionRollback)
+
+	mux.HandleFunc("POST /admin/reset", cfg.handlerReset)
+	return mux
+}
+
+// openDatabase connects to DB_URL, a postgres:// URL, or else to the SQLite
+// database at DB_PATH.
+func openDatabase() (database.Client, error) {
+	dataSource := os.Getenv("DB_URL")
+	if dataSource == "" {
+		dataSource = os.Getenv("DB_PATH")
+	}
+	if dataSource == "" {
+		return database.Client{}, errors.New("DB_URL or DB_PATH must be set")
+	}
+	return database.NewClient(dataSource)
+}
+
+// loadConfig reads the configuration from the environment, exiting on
+// anything missing or invalid.
+func loadConfig() apiConfig {
+	db, err := openDatabase()
 	if err != nil {
 		log.Fatalf("Couldn't connect to database: %v", err)
 	}
+	applied, err := db.MigrateUp()
+	if err != nil {
+		log.Fatalf("Couldn't migrate database: %v", err)
+	}
+	for _, m := range applied {
+		log.Printf("Applied migration %04d_%s", m.Version, m.Name)
+	}
 
 	jwtSecret := os.Getenv("JWT_SECRET")
 	if jwtSecret == "" {
@@ -65,6 +218,111 @@ func main() {
 		log.Fatal("ASSETS_ROOT environment variable is not set")
 	}
 
+	port := os.Getenv("PORT")
+	if port == "" {
+		log.Fatal("PORT environment variable is not set")
+	}
+
+	uploadsRoot := os.Getenv("UPLOADS_ROOT")
+	if uploadsRoot == "" {
+		uploadsRoot = filepath.Join(os.TempDir(), "tubely-uploads")
+	}
+	err = os.MkdirAll(uploadsRoot, 0755)
+	if err != nil {
+		log.Fatalf("Couldn't create uploads directory: %v", err)
+	}
+
+	thumbnailStore, err := storage.NewLocalStore(assetsRoot)
+	if err != nil {
+		log.Fatalf("Couldn't create assets directory: %v", err)
+	}
+
+	privateVideos := os.Getenv("S3_PRIVATE_BUCKET") == "true"
+
+	var videoStore storage.BlobStore
+	storageBackend := os.Getenv("STORAGE_BACKEND")
+	switch storageBackend {
+	case "", "s3":
+		store := newS3VideoStore()
+		// Nothing but presigned requests can carry the key, so SSE-C
+		// videos can't be served publicly or through CloudFront.
+		if store.Encryption() == storage.SSEC && !privateVideos {
+			log.Fatal("S3_SSE=sse-c requires S3_PRIVATE_BUCKET=true")
+		}
+		videoStore = store
+	case "local":
+		if privateVideos {
+			log.Fatal("S3_PRIVATE_BUCKET requires the s3 STORAGE_BACKEND")
+		}
+		if os.Getenv("S3_SSE") != "" && os.Getenv("S3_SSE") != "none" {
+			log.Fatal("S3_SSE requires the s3 STORAGE_BACKEND")
+		}
+		videoStore = thumbnailStore
+	default:
+		log.Fatalf("Unknown STORAGE_BACKEND %q, expected \"s3\" or \"local\"", storageBackend)
+	}
+
+	urls, err := newURLBuilder(storageBackend, port)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	renditionLadder, err := parseRenditionLadder(os.Getenv("RENDITION_LADDER"))
+	if err != nil {
+		log.Fatalf("Invalid RENDITION_LADDER: %v", err)
+	}
+
+	thumbnailWidths, err := parseThumbnailWidths(os.Getenv("THUMBNAIL_WIDTHS"))
+	if err != nil {
+		log.Fatalf("Invalid THUMBNAIL_WIDTHS: %v", err)
+	}
+
+	streamingFormats, err := parseStreamingFormats(os.Getenv("STREAMING_FORMATS"))
+	if err != nil {
+		log.Fatalf("Invalid STREAMING_FORMATS: %v", err)
+	}
+
+	allowedVideoTypes := []string{"video/mp4", "video/quicktime", "video/webm", "video/x-matroska"}
+	if value := os.Getenv("ALLOWED_VIDEO_TYPES"); value != "" {
+		allowedVideoTypes = strings.Split(strings.ReplaceAll(value, " ", ""), ",")
+	}
+
+	return apiConfig{
+		db:                    db,
+		jwtSecret:             jwtSecret,
+		platform:              platform,
+		filepathRoot:          filepathRoot,
+		assetsRoot:            assetsRoot,
+		uploadsRoot:           uploadsRoot,
+		uploadExpiry:          envDuration("UPLOAD_EXPIRY", 24*time.Hour),
+		directUploadExpiry:    envDuration("DIRECT_UPLOAD_EXPIRY", time.Hour),
+		port:                  port,
+		videoStore:            videoStore,
+		thumbnailStore:        thumbnailStore,
+		urls:                  urls,
+		renditionLadder:       renditionLadder,
+		streamingFormats:      streamingFormats,
+		allowedVideoTypes:     allowedVideoTypes,
+		thumbnailFrameOffset:  envDuration("THUMBNAIL_FRAME_OFFSET", 3*time.Second),
+		thumbnailWidths:       thumbnailWidths,
+		videoVersionRetention: envDuration("VIDEO_VERSION_RETENTION", 7*24*time.Hour),
+		privateVideos:         privateVideos,
+		presignExpiry:         envDuration("PRESIGN_EXPIRY", 15*time.Minute),
+		cloudfront: cloudfrontConfig{
+			signer:       newCloudFrontSigner(),
+			urlExpiry:    envDuration("CLOUDFRONT_URL_EXPIRY", time.Hour),
+			cookieDomain: os.Getenv("CLOUDFRONT_COOKIE_DOMAIN"),
+		},
+		jobs: jobQueueConfig{
+			workers:      envInt("JOB_WORKERS", 2),
+			maxAttempts:  envInt("JOB_MAX_ATTEMPTS", 3),
+			retryBackoff: envDuration("JOB_RETRY_BACKOFF", 30*time.Second),
+			wake:         make(chan struct{}, 1),
+		},
+	}
+}
+
+func newS3VideoStore() *storage.S3Store {
 	s3Bucket := os.Getenv("S3_BUCKET")
 	if s3Bucket == "" {
 		log.Fatal("S3_BUCKET environment variable is not set")
@@ -75,68 +333,180 @@ func main() {
 		log.Fatal("S3_REGION environment variable is not set")
 	}
 
-	s3CfDistribution := os.Getenv("S3_CF_DISTRO")
-	if s3CfDistribution == "" {
-		log.Fatal("S3_CF_DISTRO environment variable is not set")
+	awsOptions := []func(*awsConfig.LoadOptions) error{awsConfig.WithRegion(s3Region)}
+	// Static credentials are mostly for S3-compatible servers like MinIO;
+	// without them the SDK's usual chain (~/.aws, env, instance roles) is
+	// used.
+	if accessKeyID := os.Getenv("S3_ACCESS_KEY_ID"); accessKeyID != "" {
+		provider := credentials.NewStaticCredentialsProvider(accessKeyID, os.Getenv("S3_SECRET_ACCESS_KEY"), "")
+		awsOptions = append(awsOptions, awsConfig.WithCredentialsProvider(provider))
 	}
-
-	port := os.Getenv("PORT")
-	if port == "" {
-		log.Fatal("PORT environment variable is not set")
+	if os.Getenv("S3_INSECURE_SKIP_VERIFY") == "true" {
+		log.Print("Warning: S3_INSECURE_SKIP_VERIFY is set, TLS certificates of the S3 endpoint aren't checked")
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		awsOptions = append(awsOptions, awsConfig.WithHTTPClient(&http.Client{Transport: transport}))
 	}
-
-	awsCfg, err := awsConfig.LoadDefaultConfig(context.Background())
+	awsCfg, err := awsConfig.LoadDefaultConfig(context.Background(), awsOptions...)
 	if err != nil {
 		log.Fatalf("Couldn't initialize AWS Config")
+	}
+	endpoint := os.Getenv("S3_ENDPOINT")
+	s3Client := s3.NewFromConfig(awsCfg, func(o *s3.Options) {
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+		}
+		o.UsePathStyle = os.Getenv("S3_FORCE_PATH_STYLE") == "true"
+	})
 
+	s3Options := storage.S3Options{
+		PartSize:    int64(envInt("S3_PART_SIZE_MB", storage.DefaultPartSize>>20)) << 20,
+		Concurrency: envInt("S3_UPLOAD_CONCURRENCY", storage.DefaultConcurrency),
 	}
-	awsCfg.Region = s3Region
-	s3Client := s3.NewFromConfig(awsCfg)
-	cfg := apiConfig{
-		db:               db,
-		jwtSecret:        jwtSecret,
-		platform:         platform,
-		filepathRoot:     filepathRoot,
-		assetsRoot:       assetsRoot,
-		s3Bucket:         s3Bucket,
-		s3Region:         s3Region,
-		s3CfDistribution: s3CfDistribution,
-		port:             port,
-		s3Client:         s3Client,
+	if s3Options.PartSize < storage.MinPartSize {
+		log.Fatalf("S3_PART_SIZE_MB must be at least %d", storage.MinPartSize>>20)
 	}
 
-	err = cfg.ensureAssetsDir()
+	s3Options.Encryption = loadEncryption()
+
+	store, err := storage.NewS3Store(s3Client, s3Bucket, s3Options)
 	if err != nil {
-		log.Fatalf("Couldn't create assets directory: %v", err)
+		log.Fatalf("Invalid S3 encryption settings: %v", err)
 	}
+	return store
+}
 
-	mux := http.NewServeMux()
-	appHandler := http.StripPrefix("/app", http.FileServer(http.Dir(filepathRoot)))
-	mux.Handle("/app/", appHandler)
+// loadEncryption reads the server-side encryption new videos are stored
+// with. The SSE-C key stays needed as long as any video was stored with it.
+func loadEncryption() storage.Encryption {
+	mode, err := storage.ParseSSEMode(os.Getenv("S3_SSE"))
+	if err != nil {
+		log.Fatalf("Invalid S3_SSE: %v", err)
+	}
+	encryption := storage.Encryption{
+		Mode:     mode,
+		KMSKeyID: os.Getenv("S3_SSE_KMS_KEY_ID"),
+	}
+	if value := os.Getenv("S3_SSE_C_KEY"); value != "" {
+		encryption.CustomerKey, err = base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			log.Fatal("S3_SSE_C_KEY must be base64")
+		}
+	}
+	return encryption
+}
 
-	assetsHandler := http.StripPrefix("/assets", http.FileServer(http.Dir(assetsRoot)))
-	mux.Handle("/assets/", noCacheMiddleware(assetsHandler))
+// newURLBuilder sets up where each kind of asset is served from.
+// THUMBNAIL_BASE_URL and VIDEO_BASE_URL override the defaults: this server
+// for thumbnails and local videos, and the CloudFront distribution, or the
+// bucket itself without one, for videos in S3.
+func newURLBuilder(storageBackend, port string) (*storage.URLBuilder, error) {
+	urls := storage.NewURLBuilder()
+	assetsURL := "http://localhost:" + port + "/assets"
 
-	mux.HandleFunc("POST /api/login", cfg.handlerLogin)
-	mux.HandleFunc("POST /api/refresh", cfg.handlerRefresh)
-	mux.HandleFunc("POST /api/revoke", cfg.handlerRevoke)
+	thumbnailBase := os.Getenv("THUMBNAIL_BASE_URL")
+	if thumbnailBase == "" {
+		thumbnailBase = assetsURL
+	}
+	if err := urls.SetBase(thumbnailStoreName, thumbnailBase); err != nil {
+		return nil, err
+	}
 
-	mux.HandleFunc("POST /api/users", cfg.handlerUsersCreate)
+	videoBase := os.Getenv("VIDEO_BASE_URL")
+	if videoBase == "" {
+		videoBase = thumbnailBase
+		if storageBackend != "local" {
+			var err error
+			videoBase, err = defaultS3BaseURL()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := urls.SetBase(videoStoreName, videoBase); err != nil {
+		return nil, err
+	}
 
-	mux.HandleFunc("POST /api/videos", cfg.handlerVideoMetaCreate)
-	mux.HandleFunc("POST /api/thumbnail_upload/{videoID}", cfg.handlerUploadThumbnail)
-	mux.HandleFunc("POST /api/video_upload/{videoID}", cfg.handlerUploadVideo)
-	mux.HandleFunc("GET /api/videos", cfg.handlerVideosRetrieve)
-	mux.HandleFunc("GET /api/videos/{videoID}", cfg.handlerVideoGet)
-	mux.HandleFunc("DELETE /api/videos/{videoID}", cfg.handlerVideoMetaDelete)
+	// Records from before keys were stored hold full URLs under the bases
+	// that used to be hard-coded.
+	urls.AddLegacyBase(thumbnailStoreName, assetsURL)
+	urls.AddLegacyBase(videoStoreName, assetsURL)
+	if bucket := os.Getenv("S3_BUCKET"); bucket != "" {
+		urls.AddLegacyBase(videoStoreName, "s3://"+bucket)
+	}
+	if distribution := os.Getenv("S3_CF_DISTRO"); distribution != "" {
+		urls.AddLegacyBase(videoStoreName, fmt.Sprintf("https://%s.cloudfront.net", distribution))
+	}
+	return urls, nil
+}
 
-	mux.HandleFunc("POST /admin/reset", cfg.handlerReset)
+// defaultS3BaseURL is where the bucket's objects are publicly readable:
+// through CloudFront if there's a distribution, otherwise from the bucket,
+// addressed the same way the client addresses it.
+func defaultS3BaseURL() (string, error) {
+	if distribution := os.Getenv("S3_CF_DISTRO"); distribution != "" {
+		return fmt.Sprintf("https://%s.cloudfront.net", distribution), nil
+	}
+	bucket := os.Getenv("S3_BUCKET")
+	endpoint := os.Getenv("S3_ENDPOINT")
+	if endpoint == "" {
+		return fmt.Sprintf("https://%s.s3.%s.amazonaws.com", bucket, os.Getenv("S3_REGION")), nil
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return "", fmt.Errorf("S3_ENDPOINT must be an absolute URL, got %q", endpoint)
+	}
+	if os.Getenv("S3_FORCE_PATH_STYLE") == "true" {
+		return strings.TrimSuffix(endpoint, "/") + "/" + bucket, nil
+	}
+	u.Host = bucket + "." + u.Host
+	return strings.TrimSuffix(u.String(), "/"), nil
+}
 
-	srv := &http.Server{
-		Addr:    ":" + port,
-		Handler: mux,
+// newCloudFrontSigner loads the key pair protected videos are signed with,
+// if one is configured.
+func newCloudFrontSigner() *cloudfront.Signer {
+	keyPairID := os.Getenv("CLOUDFRONT_KEY_PAIR_ID")
+	keyFile := os.Getenv("CLOUDFRONT_PRIVATE_KEY_FILE")
+	if keyPairID == "" && keyFile == "" {
+		return nil
+	}
+	if keyPairID == "" || keyFile == "" {
+		log.Fatal("CLOUDFRONT_KEY_PAIR_ID and CLOUDFRONT_PRIVATE_KEY_FILE must be set together")
+	}
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		log.Fatalf("Couldn't read CloudFront private key: %v", err)
+	}
+	key, err := cloudfront.ParsePrivateKey(data)
+	if err != nil {
+		log.Fatalf("Invalid CloudFront private key: %v", err)
 	}
+	return cloudfront.NewSigner(keyPairID, key)
+}
 
-	log.Printf("Serving on: http://localhost:%s/app/\n", port)
-	log.Fatal(srv.ListenAndServe())
+// envInt reads an optional positive integer setting.
+func envInt(name string, defaultValue int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		log.Fatalf("%s must be a positive whole number", name)
+	}
+	return n
+}
+
+// envDuration reads an optional positive duration setting such as "30s".
+func envDuration(name string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		log.Fatalf("%s must be a positive duration such as \"30s\"", name)
+	}
+	return d
 }
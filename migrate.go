@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// runMigrate implements `tubely migrate up|down [n]|status|purge-orphans`.
+// The server applies pending migrations when it starts, so it's mostly
+// needed to roll back, down one migration unless told otherwise, to see
+// where a database stands, or to delete the orphaned rows a migration
+// refused to run with. It only needs DB_URL or DB_PATH.
+func runMigrate(args []string) error {
+	usage := errors.New("usage: tubely migrate up|down [n]|status|purge-orphans")
+	if len(args) == 0 {
+		return usage
+	}
+	db, err := openDatabase()
+	if err != nil {
+		return fmt.Errorf("couldn't connect to database: %w", err)
+	}
+
+	out := os.Stdout
+	switch {
+	case args[0] == "up" && len(args) == 1:
+		applied, err := db.MigrateUp()
+		printMigrations(out, "Applied", applied)
+		return err
+	case args[0] == "down" && len(args) <= 2:
+		n := 1
+		if len(args) == 2 {
+			n, err = strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				return fmt.Errorf("invalid number of migrations %q", args[1])
+			}
+		}
+		reverted, err := db.MigrateDown(n)
+		printMigrations(out, "Reverted", reverted)
+		return err
+	case args[0] == "status" && len(args) == 1:
+		migrations, err := db.MigrationStatus()
+		if err != nil {
+			return err
+		}
+		for _, m := range migrations {
+			state := "pending"
+			if m.AppliedAt != nil {
+				state = "applied " + m.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Fprintf(out, "%04d_%s\t%s\n", m.Version, m.Name, state)
+		}
+		return nil
+	case args[0] == "purge-orphans" && len(args) == 1:
+		purged, err := db.PurgeOrphanedRows()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Deleted %d orphaned rows\n", len(purged))
+		for _, row := range purged {
+			fmt.Fprintf(out, "\t%s\n", row)
+		}
+		return nil
+	}
+	return usage
+}
+
+func printMigrations(out io.Writer, verb string, migrations []database.Migration) {
+	if len(migrations) == 0 {
+		fmt.Fprintf(out, "%s no migrations\n", verb)
+		return
+	}
+	for _, m := range migrations {
+		fmt.Fprintf(out, "%s %04d_%s\n", verb, m.Version, m.Name)
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/cloudfront"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+)
+
+// videoResponse is a video as it's sent to clients.
+type videoResponse struct {
+	database.Video
+	// VideoURLHeaders have to be sent along when fetching VideoURL, e.g.
+	// the key of an SSE-C encrypted video, which opens that object only.
+	VideoURLHeaders map[string]string `json:"video_url_headers,omitempty"`
+}
+
+// presentVideo turns a video as stored into what the client making r gets to
+// see. The stored keys become URLs under the configured base URLs, except
+// that with a private bucket videos are handed out as presigned URLs, and
+// protected videos get CloudFront signed URLs. Either way they're generated
+// fresh for every response.
+func (cfg *apiConfig) presentVideo(r *http.Request, video database.Video) (videoResponse, error) {
+	video.ThumbnailURL = cfg.publicURL(thumbnailStoreName, video.ThumbnailURL)
+	if video.Thumbnails != nil {
+		// Copied, the caller's video shares the slice.
+		thumbnails := make(database.Thumbnails, len(video.Thumbnails))
+		for i, t := range video.Thumbnails {
+			t.URL = cfg.urls.URL(thumbnailStoreName, t.URL)
+			thumbnails[i] = t
+		}
+		video.Thumbnails = thumbnails
+	}
+
+	if cfg.privateVideos {
+		return cfg.presignVideo(r.Context(), video)
+	}
+	if video.Access.Protected {
+		video, err := cfg.signVideo(r, video)
+		return videoResponse{Video: video}, err
+	}
+	video.VideoURL = cfg.publicURL(videoStoreName, video.VideoURL)
+	video.HLSURL = cfg.publicURL(videoStoreName, video.HLSURL)
+	video.DASHURL = cfg.publicURL(videoStoreName, video.DASHURL)
+	return videoResponse{Video: video}, nil
+}
+
+// publiclyPlayable reports whether the video's media is served at public
+// URLs, which anyone may have, rather than presigned or signed ones.
+func (cfg *apiConfig) publiclyPlayable(video database.Video) bool {
+	return !cfg.privateVideos && !video.Access.Protected
+}
+
+func (cfg *apiConfig) presentVideos(r *http.Request, videos []database.Video) ([]videoResponse, error) {
+	presented := make([]videoResponse, 0, len(videos))
+	for _, video := range videos {
+		video, err := cfg.presentVideo(r, video)
+		if err != nil {
+			return nil, err
+		}
+		presented = append(presented, video)
+	}
+	return presented, nil
+}
+
+// presentVideoVersions turns the keys of each version into URLs. They aren't
+// presigned or signed; the history is for the owner to pick a rollback from,
+// not to play.
+func (cfg *apiConfig) presentVideoVersions(versions []database.VideoVersion) []database.VideoVersion {
+	presented := make([]database.VideoVersion, 0, len(versions))
+	for _, version := range versions {
+		version.VideoURL = cfg.publicURL(videoStoreName, version.VideoURL)
+		version.HLSURL = cfg.publicURL(videoStoreName, version.HLSURL)
+		version.DASHURL = cfg.publicURL(videoStoreName, version.DASHURL)
+		presented = append(presented, version)
+	}
+	return presented
+}
+
+// publicURL is URLBuilder.URL for optional references.
+func (cfg *apiConfig) publicURL(class string, ref *string) *string {
+	if ref == nil {
+		return nil
+	}
+	u := cfg.urls.URL(class, *ref)
+	return &u
+}
+
+func (cfg *apiConfig) presignVideo(ctx context.Context, video database.Video) (videoResponse, error) {
+	// Playlists and manifests reference their segments by relative URL,
+	// which a presigned query string doesn't carry over to, so streaming
+	// packages can't be served from a private bucket this way.
+	video.HLSURL = nil
+	video.DASHURL = nil
+	if video.VideoURL == nil {
+		return videoResponse{Video: video}, nil
+	}
+	req, err := cfg.presignVideoURL(ctx, *video.VideoURL, video.Encryption)
+	if err != nil {
+		return videoResponse{}, err
+	}
+	video.VideoURL = &req.URL
+	return videoResponse{Video: video, VideoURLHeaders: req.Header}, nil
+}
+
+// presignVideoURL presigns a reference to the video store. Anything else,
+// such as a URL outside every known base, is passed through unchanged.
+func (cfg *apiConfig) presignVideoURL(ctx context.Context, ref, encryption string) (storage.PresignedRequest, error) {
+	key, ok := cfg.urls.Key(videoStoreName, ref)
+	if !ok {
+		return storage.PresignedRequest{URL: ref}, nil
+	}
+	store, err := cfg.encryptedVideoStore(encryption)
+	if err != nil {
+		return storage.PresignedRequest{}, err
+	}
+	presigner, ok := store.(storage.Presigner)
+	if !ok {
+		return storage.PresignedRequest{}, fmt.Errorf("video store can't presign URLs")
+	}
+	return presigner.PresignGet(ctx, key, cfg.presignExpiry)
+}
+
+// accessPolicy is the CloudFront policy for a protected video, without a
+// resource.
+func (cfg *apiConfig) accessPolicy(r *http.Request, video database.Video) cloudfront.Policy {
+	expiry := cfg.cloudfront.urlExpiry
+	if video.Access.URLExpirySeconds > 0 {
+		expiry = time.Duration(video.Access.URLExpirySeconds) * time.Second
+	}
+	policy := cloudfront.Policy{Expires: time.Now().Add(expiry)}
+	if video.Access.RestrictIP {
+		policy.IPAddress = clientIP(r)
+	}
+	return policy
+}
+
+func (cfg *apiConfig) signVideo(r *http.Request, video database.Video) (database.Video, error) {
+	if cfg.cloudfront.signer == nil {
+		// Without a signer there's no safe URL to hand out.
+		video.VideoURL, video.HLSURL, video.DASHURL = nil, nil, nil
+		return video, nil
+	}
+	if video.VideoURL != nil {
+		if key, ok := cfg.urls.Key(videoStoreName, *video.VideoURL); ok {
+			signed, err := cfg.cloudfront.signer.SignURL(cfg.urls.URL(videoStoreName, key), cfg.accessPolicy(r, video))
+			if err != nil {
+				return database.Video{}, err
+			}
+			video.VideoURL = &signed
+		}
+	}
+	// HLS and DASH URLs aren't signed: the segments are authorized by the
+	// cookies from streamingCookies.
+	video.HLSURL = cfg.publicURL(videoStoreName, video.HLSURL)
+	video.DASHURL = cfg.publicURL(videoStoreName, video.DASHURL)
+	return video, nil
+}
+
+// streamingCookies returns the signed cookies that let the client play a
+// protected video's streaming packages. A signed URL can't do that, since
+// the player requests every segment by its own URL. The cookies are scoped
+// to the package's path so several videos' cookies can coexist.
+func (cfg *apiConfig) streamingCookies(r *http.Request, video database.Video) ([]*http.Cookie, error) {
+	if cfg.privateVideos || !video.Access.Protected || cfg.cloudfront.signer == nil {
+		return nil, nil
+	}
+	cookies := []*http.Cookie{}
+	for _, manifest := range []*string{video.HLSURL, video.DASHURL} {
+		if manifest == nil {
+			continue
+		}
+		key, ok := cfg.urls.Key(videoStoreName, *manifest)
+		if !ok {
+			continue
+		}
+		u, err := url.Parse(cfg.urls.URL(videoStoreName, key))
+		if err != nil {
+			return nil, err
+		}
+		dir := path.Dir(u.Path) + "/"
+		policy := cfg.accessPolicy(r, video)
+		policy.Resource = u.Scheme + "://" + u.Host + dir + "*"
+		signed, err := cfg.cloudfront.signer.SignedCookies(policy)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range signed {
+			c.Path = dir
+			c.Domain = cfg.cloudfront.cookieDomain
+			c.SameSite = http.SameSiteNoneMode
+		}
+		cookies = append(cookies, signed...)
+	}
+	return cookies, nil
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// respondWithVideo is respondWithJSON for a single video.
+func (cfg *apiConfig) respondWithVideo(w http.ResponseWriter, r *http.Request, code int, video database.Video) {
+	cookies, err := cfg.streamingCookies(r, video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign cookies", err)
+		return
+	}
+	presented, err := cfg.presentVideo(r, video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create video URL", err)
+		return
+	}
+	for _, c := range cookies {
+		http.SetCookie(w, c)
+	}
+	respondWithJSON(w, code, presented)
+}
+
+func (cfg *apiConfig) handlerVideoAccessUpdate(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.getOwnedVideo(w, r)
+	if !ok {
+		return
+	}
+
+	access := database.VideoAccess{}
+	err := json.NewDecoder(r.Body).Decode(&access)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if access.URLExpirySeconds < 0 {
+		respondWithError(w, http.StatusBadRequest, "url_expiry_seconds can't be negative", nil)
+		return
+	}
+	if access.Protected && !cfg.privateVideos && cfg.cloudfront.signer == nil {
+		respondWithError(w, http.StatusBadRequest, "Signed URLs aren't configured on this server", nil)
+		return
+	}
+
+	err = cfg.db.UpdateVideoAccess(video.ID, access)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		return
+	}
+	video.Access = access
+	cfg.respondWithVideo(w, r, http.StatusOK, video)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+var errNoVideoStream = errors.New("file has no video stream")
+
+// mediaProbe is the subset of `ffprobe -show_streams -show_format` we use.
+type mediaProbe struct {
+	Streams []probeStream `json:"streams"`
+	Format  struct {
+		FormatName string `json:"format_name"`
+		Duration   string `json:"duration"`
+		Size       string `json:"size"`
+		BitRate    string `json:"bit_rate"`
+	} `json:"format"`
+}
+
+type probeStream struct {
+	Index              int    `json:"index"`
+	CodecType          string `json:"codec_type"`
+	CodecName          string `json:"codec_name"`
+	PixFmt             string `json:"pix_fmt"`
+	Width              int    `json:"width"`
+	Height             int    `json:"height"`
+	DisplayAspectRatio string `json:"display_aspect_ratio"`
+	AvgFrameRate       string `json:"avg_frame_rate"`
+	ChannelLayout      string `json:"channel_layout"`
+	Channels           int    `json:"channels"`
+	// Phones record in the sensor's orientation and say how to turn the
+	// picture for display, in the display matrix side data or, with older
+	// ffprobes, a rotate tag.
+	SideDataList []struct {
+		SideDataType string  `json:"side_data_type"`
+		Rotation     float64 `json:"rotation"`
+	} `json:"side_data_list"`
+	Tags struct {
+		Rotate string `json:"rotate"`
+	} `json:"tags"`
+}
+
+// rotated reports whether the stream is displayed turned by a quarter, so
+// its width and height swap places. ffmpeg applies the rotation itself when
+// transcoding.
+func (s probeStream) rotated() bool {
+	rotation := 0.0
+	for _, sd := range s.SideDataList {
+		if sd.SideDataType == "Display Matrix" {
+			rotation = sd.Rotation
+		}
+	}
+	if tag, err := strconv.ParseFloat(s.Tags.Rotate, 64); err == nil && rotation == 0 {
+		rotation = tag
+	}
+	quarters := int(math.Round(rotation / 90))
+	return quarters%2 != 0
+}
+
+// displaySize is the size of the picture as it's shown.
+func (s probeStream) displaySize() (width, height int) {
+	if s.rotated() {
+		return s.Height, s.Width
+	}
+	return s.Width, s.Height
+}
+
+func probeMedia(filePath string) (mediaProbe, error) {
+	cmd := exec.Command("ffprobe", "-v", "error", "-print_format", "json", "-show_streams", "-show_format", filePath)
+	var stdoutBuff, stderrBuff bytes.Buffer
+	cmd.Stdout = &stdoutBuff
+	cmd.Stderr = &stderrBuff
+	if err := cmd.Run(); err != nil {
+		return mediaProbe{}, fmt.Errorf("%w: %s", err, strings.TrimSpace(stderrBuff.String()))
+	}
+	var out mediaProbe
+	if err := json.Unmarshal(stdoutBuff.Bytes(), &out); err != nil {
+		return mediaProbe{}, err
+	}
+	return out, nil
+}
+
+// checkUploadedVideo probes an upload before it's queued, so broken files are
+// rejected while the client is still around to hear about it. The container
+// ffprobe finds has to be allowed and, when the client declared a type, has
+// to match it.
+func (cfg *apiConfig) checkUploadedVideo(filePath, declaredType string) error {
+	probe, err := probeMedia(filePath)
+	if err != nil {
+		return fmt.Errorf("%w: couldn't read a video container: %v", errUnsupportedMediaType, err)
+	}
+	detected := probe.containerMediaTypes()
+	if declaredType != "" && !slices.Contains(detected, declaredType) {
+		return fmt.Errorf("%w: declared %s but the file is %q", errUnsupportedMediaType, declaredType, probe.Format.FormatName)
+	}
+	if !slices.ContainsFunc(detected, func(mediaType string) bool {
+		return slices.Contains(cfg.allowedVideoTypes, mediaType)
+	}) {
+		return fmt.Errorf("%w: %q isn't an accepted container", errUnsupportedMediaType, probe.Format.FormatName)
+	}
+	return probe.validate()
+}
+
+func respondWithVideoCheckError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errUnsupportedMediaType) {
+		respondWithError(w, http.StatusUnsupportedMediaType, "File content doesn't match an accepted video type", err)
+		return
+	}
+	respondWithError(w, http.StatusBadRequest, "Not a valid video file", err)
+}
+
+// videoStream returns the first video stream. Don't assume it's stream 0,
+// plenty of files lead with their audio.
+func (p mediaProbe) videoStream() (probeStream, bool) {
+	for _, s := range p.Streams {
+		// Cover art shows up as a single frame "video" stream.
+		if s.CodecType == "video" && s.Width > 0 && s.Height > 0 && s.CodecName != "mjpeg" && s.CodecName != "png" {
+			return s, true
+		}
+	}
+	return probeStream{}, false
+}
+
+func (p mediaProbe) audioStream() (probeStream, bool) {
+	for _, s := range p.Streams {
+		if s.CodecType == "audio" {
+			return s, true
+		}
+	}
+	return probeStream{}, false
+}
+
+// containerMediaTypes lists the MIME types a file in the probed container
+// could legitimately be declared as. ffprobe can't tell MP4 from QuickTime or
+// Matroska from WebM, so each family maps to all of its types.
+func (p mediaProbe) containerMediaTypes() []string {
+	mediaTypes := []string{}
+	for _, name := range strings.Split(p.Format.FormatName, ",") {
+		switch name {
+		case "mov", "mp4":
+			mediaTypes = append(mediaTypes, "video/mp4", "video/quicktime")
+		case "matroska", "webm":
+			mediaTypes = append(mediaTypes, "video/webm", "video/x-matroska")
+		case "avi":
+			mediaTypes = append(mediaTypes, "video/x-msvideo")
+		case "mpegts":
+			mediaTypes = append(mediaTypes, "video/mp2t")
+		}
+	}
+	slices.Sort(mediaTypes)
+	return slices.Compact(mediaTypes)
+}
+
+// browserCompatible reports whether the streams can be remuxed into an MP4
+// that browsers play as is, without transcoding.
+func (p mediaProbe) browserCompatible() bool {
+	v, ok := p.videoStream()
+	if !ok || v.CodecName != "h264" || (v.PixFmt != "yuv420p" && v.PixFmt != "yuvj420p") {
+		return false
+	}
+	if a, ok := p.audioStream(); ok && a.CodecName != "aac" {
+		return false
+	}
+	return true
+}
+
+func (p mediaProbe) duration() float64 {
+	d, _ := strconv.ParseFloat(p.Format.Duration, 64)
+	return d
+}
+
+// validate rejects files we can't turn into a playable video.
+func (p mediaProbe) validate() error {
+	if _, ok := p.videoStream(); !ok {
+		return errNoVideoStream
+	}
+	return nil
+}
+
+// aspectRatio is the display aspect ratio, like "16:9", after rotation.
+func (p mediaProbe) aspectRatio() string {
+	v, _ := p.videoStream()
+	width, height, ok := strings.Cut(v.DisplayAspectRatio, ":")
+	if ok && v.rotated() {
+		return height + ":" + width
+	}
+	return v.DisplayAspectRatio
+}
+
+// frameRate is the video's average frame rate, or 0 if it's unknown.
+func (p mediaProbe) frameRate() float64 {
+	v, _ := p.videoStream()
+	return parseFrameRate(v.AvgFrameRate)
+}
+
+func (p mediaProbe) metadata() database.VideoMetadata {
+	v, _ := p.videoStream()
+	a, _ := p.audioStream()
+	bitRate, _ := strconv.ParseInt(p.Format.BitRate, 10, 64)
+	size, _ := strconv.ParseInt(p.Format.Size, 10, 64)
+	width, height := v.displaySize()
+	return database.VideoMetadata{
+		DurationSeconds:    p.duration(),
+		Width:              width,
+		Height:             height,
+		VideoCodec:         v.CodecName,
+		AudioCodec:         a.CodecName,
+		BitRate:            bitRate,
+		FrameRate:          parseFrameRate(v.AvgFrameRate),
+		AudioChannelLayout: a.ChannelLayout,
+		ContainerFormat:    p.Format.FormatName,
+		FileSize:           size,
+	}
+}
+
+// parseFrameRate parses ffprobe's rational frame rates such as "30000/1001".
+func parseFrameRate(rate string) float64 {
+	num, den, found := strings.Cut(rate, "/")
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0
+	}
+	if !found {
+		return n
+	}
+	d, err := strconv.ParseFloat(den, 64)
+	if err != nil || d == 0 {
+		return 0
+	}
+	return n / d
+}
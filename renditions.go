@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"math"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// segmentSeconds is the segment length for both HLS and DASH. It's also the
+// keyframe interval, so players can switch renditions at every segment.
+const segmentSeconds = 6
+
+// streamingFormats lists the adaptive streaming packages produced for every
+// upload, on top of the faststart MP4.
+type streamingFormats struct {
+	HLS  bool
+	DASH bool
+}
+
+// parseStreamingFormats parses a comma separated list such as "hls,dash".
+// "none" turns adaptive streaming off.
+func parseStreamingFormats(value string) (streamingFormats, error) {
+	if value == "" {
+		return streamingFormats{HLS: true}, nil
+	}
+	formats := streamingFormats{}
+	for _, field := range strings.Split(value, ",") {
+		switch strings.ToLower(strings.TrimSpace(field)) {
+		case "hls":
+			formats.HLS = true
+		case "dash":
+			formats.DASH = true
+		case "none":
+		default:
+			return streamingFormats{}, fmt.Errorf("unknown streaming format %q", field)
+		}
+	}
+	return formats, nil
+}
+
+var defaultRenditionLadder = []int{1080, 720, 480, 360}
+
+// rendition is one rung of the adaptive bitrate ladder. Its size is the short
+// side of the frame, so "720" is 1280x720 for landscape and 720x1280 for
+// portrait sources.
+type rendition struct {
+	Name         string
+	Width        int
+	Height       int
+	VideoBitrate int // kbit/s
+	AudioBitrate int // kbit/s
+	// Level is the H.264 level the rendition is encoded at, times ten.
+	Level int
+}
+
+// parseRenditionLadder parses a comma separated list of sizes like
+// "1080,720,480".
+func parseRenditionLadder(value string) ([]int, error) {
+	if value == "" {
+		return defaultRenditionLadder, nil
+	}
+	ladder := []int{}
+	for _, field := range strings.Split(value, ",") {
+		size, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(field), "p"))
+		if err != nil || size < 2 {
+			return nil, fmt.Errorf("invalid rendition size %q", field)
+		}
+		ladder = append(ladder, size)
+	}
+	return ladder, nil
+}
+
+// planRenditions scales the ladder to the source's aspect ratio, dropping
+// rungs that would upscale. A source smaller than every rung gets a single
+// rendition at its own size. The source's size is its display size, see
+// probeStream.displaySize, and frameRate, if known, picks the levels.
+func planRenditions(ladder []int, srcWidth, srcHeight int, frameRate float64) []rendition {
+	shortSide := min(srcWidth, srcHeight)
+	renditions := []rendition{}
+	for _, size := range ladder {
+		if size > shortSide {
+			continue
+		}
+		renditions = append(renditions, newRendition(size, srcWidth, srcHeight, frameRate))
+	}
+	if len(renditions) == 0 {
+		renditions = append(renditions, newRendition(shortSide, srcWidth, srcHeight, frameRate))
+	}
+	return renditions
+}
+
+func newRendition(size, srcWidth, srcHeight int, frameRate float64) rendition {
+	// The short side is the source's own when it's below every rung, and
+	// H.264 4:2:0 needs both sides even.
+	size = evenDimension(size)
+	r := rendition{
+		Name:         fmt.Sprintf("%dp", size),
+		VideoBitrate: videoBitrateFor(size),
+		AudioBitrate: 128,
+	}
+	if size <= 480 {
+		r.AudioBitrate = 96
+	}
+	if srcWidth >= srcHeight {
+		r.Height = size
+		r.Width = evenDimension(srcWidth * size / srcHeight)
+	} else {
+		r.Width = size
+		r.Height = evenDimension(srcHeight * size / srcWidth)
+	}
+	r.Level = avcLevel(r.Width, r.Height, frameRate, r.VideoBitrate*107/100)
+	return r
+}
+
+// avcLevels are the H.264 levels renditions are encoded at, with the
+// largest frame (in macroblocks), macroblock rate and High profile bitrate
+// (kbit/s) each allows.
+var avcLevels = []struct {
+	level, frameSize, macroblockRate, bitrate int
+}{
+	{30, 1620, 40500, 12500},
+	{31, 3600, 108000, 17500},
+	{32, 5120, 216000, 25000},
+	{40, 8192, 245760, 25000},
+	{41, 8192, 245760, 62500},
+	{42, 8704, 522240, 62500},
+	{50, 22080, 589824, 168750},
+	{51, 36864, 983040, 300000},
+	{52, 36864, 2073600, 300000},
+}
+
+// avcLevel returns the lowest level a width x height video at frameRate and
+// maxrate kbit/s fits in. An unknown frame rate is taken to be 30.
+func avcLevel(width, height int, frameRate float64, maxrate int) int {
+	if frameRate <= 0 {
+		frameRate = 30
+	}
+	frameSize := ((width + 15) / 16) * ((height + 15) / 16)
+	macroblockRate := int(math.Ceil(float64(frameSize) * frameRate))
+	for _, l := range avcLevels {
+		if frameSize <= l.frameSize && macroblockRate <= l.macroblockRate && maxrate <= l.bitrate {
+			return l.level
+		}
+	}
+	return avcLevels[len(avcLevels)-1].level
+}
+
+// codecs is the RFC 6381 codecs string of the rendition: High profile H.264
+// at its level, plus AAC-LC if there's audio.
+func (r rendition) codecs(hasAudio bool) string {
+	codecs := fmt.Sprintf("avc1.6400%02x", r.Level)
+	if hasAudio {
+		codecs += ",mp4a.40.2"
+	}
+	return codecs
+}
+
+// videoBitrateFor follows the usual H.264 ladder and extrapolates by pixel
+// count for sizes outside it.
+func videoBitrateFor(size int) int {
+	switch size {
+	case 2160:
+		return 14000
+	case 1440:
+		return 8000
+	case 1080:
+		return 5000
+	case 720:
+		return 2800
+	case 480:
+		return 1400
+	case 360:
+		return 800
+	case 240:
+		return 400
+	}
+	return max(200, size*size*5000/(1080*1080))
+}
+
+// H.264 with 4:2:0 chroma subsampling needs even dimensions.
+func evenDimension(n int) int {
+	return max(2, n-n%2)
+}
+
+// putTree stores every file under dir in the video store, keyed by its path
+// relative to dir under keyPrefix.
+func (cfg *apiConfig) putTree(ctx context.Context, dir, keyPrefix string) error {
+	return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		key := path.Join(keyPrefix, filepath.ToSlash(rel))
+		return cfg.videoStore.Put(ctx, key, f, mime.TypeByExtension(filepath.Ext(p)))
+	})
+}
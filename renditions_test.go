@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// rotatedPhoneProbe is ffprobe's output for a portrait phone video: coded
+// landscape, displayed turned by a quarter.
+const rotatedPhoneProbe = `{
+	"streams": [
+		{
+			"index": 0,
+			"codec_type": "video",
+			"codec_name": "h264",
+			"width": 1920,
+			"height": 1080,
+			"display_aspect_ratio": "16:9",
+			"avg_frame_rate": "30/1",
+			"side_data_list": [{"side_data_type": "Display Matrix", "rotation": -90}]
+		}
+	],
+	"format": {"format_name": "mov,mp4,m4a,3gp,3g2,mj2"}
+}`
+
+func TestRotatedVideo(t *testing.T) {
+	var probe mediaProbe
+	if err := json.Unmarshal([]byte(rotatedPhoneProbe), &probe); err != nil {
+		t.Fatal(err)
+	}
+	src, ok := probe.videoStream()
+	if !ok {
+		t.Fatal("no video stream")
+	}
+	if width, height := src.displaySize(); width != 1080 || height != 1920 {
+		t.Errorf("displaySize = %dx%d, want 1080x1920", width, height)
+	}
+	if got := aspectRatioPrefix(probe); got != "portrait" {
+		t.Errorf("aspectRatioPrefix = %q, want portrait", got)
+	}
+	if m := probe.metadata(); m.Width != 1080 || m.Height != 1920 {
+		t.Errorf("metadata size = %dx%d, want 1080x1920", m.Width, m.Height)
+	}
+
+	// The older rotate tag means the same.
+	src.SideDataList = nil
+	src.Tags.Rotate = "270"
+	if width, height := src.displaySize(); width != 1080 || height != 1920 {
+		t.Errorf("displaySize with a rotate tag = %dx%d, want 1080x1920", width, height)
+	}
+	src.Tags.Rotate = "180"
+	if width, height := src.displaySize(); width != 1920 || height != 1080 {
+		t.Errorf("displaySize turned upside down = %dx%d, want 1920x1080", width, height)
+	}
+}
+
+func TestPlanRenditions(t *testing.T) {
+	renditions := planRenditions([]int{1080, 720, 360}, 1080, 1920, 30)
+	if len(renditions) != 3 {
+		t.Fatalf("planRenditions returned %d renditions, want 3", len(renditions))
+	}
+	for _, want := range []rendition{
+		{Name: "1080p", Width: 1080, Height: 1920, Level: 40},
+		{Name: "720p", Width: 720, Height: 1280, Level: 31},
+		{Name: "360p", Width: 360, Height: 640, Level: 30},
+	} {
+		found := false
+		for _, r := range renditions {
+			if r.Name == want.Name {
+				found = true
+				if r.Width != want.Width || r.Height != want.Height || r.Level != want.Level {
+					t.Errorf("%s rendition is %dx%d at level %d, want %dx%d at level %d",
+						r.Name, r.Width, r.Height, r.Level, want.Width, want.Height, want.Level)
+				}
+			}
+		}
+		if !found {
+			t.Errorf("no %s rendition", want.Name)
+		}
+	}
+
+	// Twice the frame rate needs a higher level.
+	if r := planRenditions([]int{1080}, 1920, 1080, 60)[0]; r.Level != 42 {
+		t.Errorf("1080p60 is at level %d, want 42", r.Level)
+	}
+
+	// A source below every rung keeps its own size, rounded down to even
+	// sides whichever way it's turned.
+	for _, src := range [][2]int{{199, 101}, {101, 199}} {
+		renditions := planRenditions([]int{360}, src[0], src[1], 30)
+		if len(renditions) != 1 {
+			t.Fatalf("%dx%d got %d renditions, want 1", src[0], src[1], len(renditions))
+		}
+		r := renditions[0]
+		if r.Width%2 != 0 || r.Height%2 != 0 || min(r.Width, r.Height) != 100 || r.Name != "100p" {
+			t.Errorf("%dx%d source got a %s rendition of %dx%d, want even sides with 100 the short one",
+				src[0], src[1], r.Name, r.Width, r.Height)
+		}
+	}
+}
+
+func TestHLSMasterPlaylist(t *testing.T) {
+	renditions := planRenditions([]int{720}, 1280, 720, 30)
+	withAudio := hlsMasterPlaylist(renditions, true)
+	if !strings.Contains(withAudio, `CODECS="avc1.64001f,mp4a.40.2"`) {
+		t.Errorf("playlist with audio:\n%s", withAudio)
+	}
+	withoutAudio := hlsMasterPlaylist(renditions, false)
+	if !strings.Contains(withoutAudio, `CODECS="avc1.64001f"`) || !strings.Contains(withoutAudio, "BANDWIDTH=2800000,") {
+		t.Errorf("playlist without audio:\n%s", withoutAudio)
+	}
+}
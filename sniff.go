@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+)
+
+// errUnsupportedMediaType marks uploads whose content isn't what the client
+// declared, or isn't something we accept at all. Handlers answer it with a
+// 415 instead of a 400.
+var errUnsupportedMediaType = errors.New("unsupported media type")
+
+// sniffImageType identifies an image from its magic bytes, returning "" for
+// anything that isn't PNG, JPEG, GIF or WebP.
+func sniffImageType(header []byte) string {
+	switch {
+	case bytes.HasPrefix(header, []byte("\x89PNG\r\n\x1a\n")):
+		return "image/png"
+	case bytes.HasPrefix(header, []byte("\xff\xd8\xff")):
+		return "image/jpeg"
+	case bytes.HasPrefix(header, []byte("GIF87a")), bytes.HasPrefix(header, []byte("GIF89a")):
+		return "image/gif"
+	case len(header) >= 12 && bytes.Equal(header[:4], []byte("RIFF")) && bytes.Equal(header[8:12], []byte("WEBP")):
+		return "image/webp"
+	}
+	return ""
+}
+
+// sniffImage detects the type of the image in r without consuming it: the
+// returned reader yields the full content, header included.
+func sniffImage(r io.Reader) (string, io.Reader, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(12)
+	if err != nil && err != io.EOF {
+		return "", nil, err
+	}
+	return sniffImageType(header), br, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSniffImageType(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{"PNG", "\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR", "image/png"},
+		{"JPEG", "\xff\xd8\xff\xe0\x00\x10JFIF\x00", "image/jpeg"},
+		{"GIF87a", "GIF87a\x01\x00\x01\x00", "image/gif"},
+		{"GIF89a", "GIF89a\x01\x00\x01\x00", "image/gif"},
+		{"WebP", "RIFF\x24\x00\x00\x00WEBPVP8 ", "image/webp"},
+		{"WAV", "RIFF\x24\x00\x00\x00WAVEfmt ", ""},
+		{"PDF", "%PDF-1.7\n%\xe2\xe3\xcf\xd3", ""},
+		{"SVG", `<svg xmlns="http://www.w3.org/2000/svg">`, ""},
+		{"MP4", "\x00\x00\x00\x20ftypisom", ""},
+		{"truncated PNG", "\x89PNG", ""},
+		{"truncated WebP", "RIFF\x24\x00\x00\x00WEB", ""},
+		{"empty", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sniffImageType([]byte(tt.header)); got != tt.want {
+				t.Errorf("sniffImageType = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSniffImage(t *testing.T) {
+	for _, data := range [][]byte{testPNG(t), []byte("GIF89a"), nil} {
+		mediaType, r, err := sniffImage(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := sniffImageType(data); mediaType != want {
+			t.Errorf("sniffImage = %q, want %q", mediaType, want)
+		}
+		// Sniffing doesn't consume the header.
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("read back %d bytes, want the %d sniffed", len(got), len(data))
+		}
+	}
+}
+
+func TestCheckUploadedVideo(t *testing.T) {
+	mp4 := testVideoFile(t)
+	api := newTestAPI(t)
+
+	tests := []struct {
+		name     string
+		data     []byte
+		declared string
+		// wantErr is errUnsupportedMediaType for a 415, any other error
+		// for a 400, nil to accept the file.
+		wantErr error
+	}{
+		{"MP4", mp4, "video/mp4", nil},
+		// MP4 and QuickTime are the same container to ffprobe.
+		{"MP4 declared as QuickTime", mp4, "video/quicktime", nil},
+		{"MP4 without a declared type", mp4, "", nil},
+		{"MP4 declared as WebM", mp4, "video/webm", errUnsupportedMediaType},
+		// Cut inside the moov box, which faststart puts up front.
+		{"truncated MP4", mp4[:len(mp4)/50], "video/mp4", errUnsupportedMediaType},
+		{"PDF renamed to MP4", []byte("%PDF-1.7\n1 0 obj\n<< /Type /Catalog >>\nendobj\n"), "video/mp4", errUnsupportedMediaType},
+		{"PNG", testPNG(t), "video/mp4", errUnsupportedMediaType},
+		{"empty", nil, "video/mp4", errUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "upload")
+			if err := os.WriteFile(path, tt.data, 0o600); err != nil {
+				t.Fatal(err)
+			}
+			err := api.cfg.checkUploadedVideo(path, tt.declared)
+			if tt.wantErr == nil && err != nil {
+				t.Errorf("checkUploadedVideo rejected the file: %v", err)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("checkUploadedVideo = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
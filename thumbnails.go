@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+const (
+	maxThumbnailSize     = 20 << 20
+	thumbnailJPEGQuality = 82
+	thumbnailWebPQuality = 80
+	// maxThumbnailPixels guards against decompression bombs: a small file
+	// that decodes to an enormous bitmap.
+	maxThumbnailPixels = 50_000_000
+)
+
+var defaultThumbnailWidths = []int{320, 640, 1280}
+
+var errInvalidImage = errors.New("invalid image")
+
+// parseThumbnailWidths parses a comma separated list of widths like
+// "320,640,1280".
+func parseThumbnailWidths(value string) ([]int, error) {
+	if value == "" {
+		return defaultThumbnailWidths, nil
+	}
+	widths := []int{}
+	for _, field := range strings.Split(value, ",") {
+		width, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(field), "w"))
+		if err != nil || width < 1 {
+			return nil, fmt.Errorf("invalid thumbnail width %q", field)
+		}
+		widths = append(widths, width)
+	}
+	return widths, nil
+}
+
+// encodedThumbnail is one generated variant, ready to be stored.
+type encodedThumbnail struct {
+	database.ThumbnailVariant
+	ext  string
+	data []byte
+}
+
+// renderThumbnails decodes an uploaded image and re-encodes it as JPEG and
+// WebP at every configured width that doesn't upscale it. Only pixels survive
+// the round trip, so EXIF data such as GPS coordinates is dropped; the EXIF
+// orientation is applied first so portrait photos stay upright.
+func renderThumbnails(ctx context.Context, data []byte, mediaType string, widths []int) ([]encodedThumbnail, error) {
+	img, err := decodeThumbnail(ctx, data, mediaType)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidImage, err)
+	}
+
+	srcWidth := img.Bounds().Dx()
+	targets := []int{}
+	for _, width := range widths {
+		if width <= srcWidth {
+			targets = append(targets, width)
+		}
+	}
+	if len(targets) == 0 {
+		targets = append(targets, srcWidth)
+	}
+
+	variants := []encodedThumbnail{}
+	for _, width := range targets {
+		resized := resizeImage(img, width)
+		height := resized.Bounds().Dy()
+
+		var jpegBuf bytes.Buffer
+		if err := jpeg.Encode(&jpegBuf, resized, &jpeg.Options{Quality: thumbnailJPEGQuality}); err != nil {
+			return nil, err
+		}
+		webpData, err := encodeWebP(ctx, resized)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't encode WebP: %w", err)
+		}
+
+		variants = append(variants,
+			encodedThumbnail{
+				ThumbnailVariant: database.ThumbnailVariant{Width: width, Height: height, MediaType: "image/jpeg"},
+				ext:              ".jpg",
+				data:             jpegBuf.Bytes(),
+			},
+			encodedThumbnail{
+				ThumbnailVariant: database.ThumbnailVariant{Width: width, Height: height, MediaType: "image/webp"},
+				ext:              ".webp",
+				data:             webpData,
+			},
+		)
+	}
+	return variants, nil
+}
+
+func decodeThumbnail(ctx context.Context, data []byte, mediaType string) (*image.RGBA, error) {
+	if mediaType == "image/webp" {
+		// The standard library can't decode WebP, so let ffmpeg turn it
+		// into a PNG first.
+		converted, err := runFFmpegPipe(ctx, bytes.NewReader(data), "-f", "webp_pipe", "-i", "pipe:0", "-frames:v", "1", "-f", "image2pipe", "-c:v", "png", "pipe:1")
+		if err != nil {
+			return nil, fmt.Errorf("couldn't decode WebP: %w", err)
+		}
+		data = converted
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if config.Width*config.Height > maxThumbnailPixels {
+		return nil, fmt.Errorf("image is too large: %dx%d", config.Width, config.Height)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	rgba := image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, img.Bounds().Min, draw.Src)
+	if mediaType == "image/jpeg" {
+		rgba = applyOrientation(rgba, jpegOrientation(data))
+	}
+	return rgba, nil
+}
+
+// resizeImage scales src down to width, keeping its aspect ratio, by
+// averaging the source pixels that fall under each destination pixel.
+func resizeImage(src *image.RGBA, width int) *image.RGBA {
+	sw, sh := src.Bounds().Dx(), src.Bounds().Dy()
+	height := max(1, (sh*width+sw/2)/sw)
+	if width == sw {
+		return src
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0, y1 := y*sh/height, max((y+1)*sh/height, y*sh/height+1)
+		for x := 0; x < width; x++ {
+			x0, x1 := x*sw/width, max((x+1)*sw/width, x*sw/width+1)
+			var r, g, b, a, n uint32
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					p := row[sx*4 : sx*4+4]
+					r += uint32(p[0])
+					g += uint32(p[1])
+					b += uint32(p[2])
+					a += uint32(p[3])
+					n++
+				}
+			}
+			d := dst.Pix[y*dst.Stride+x*4:]
+			d[0], d[1], d[2], d[3] = uint8(r/n), uint8(g/n), uint8(b/n), uint8(a/n)
+		}
+	}
+	return dst
+}
+
+func encodeWebP(ctx context.Context, img image.Image) ([]byte, error) {
+	var pngBuf bytes.Buffer
+	if err := png.Encode(&pngBuf, img); err != nil {
+		return nil, err
+	}
+	return runFFmpegPipe(ctx, &pngBuf,
+		"-f", "png_pipe", "-i", "pipe:0",
+		"-c:v", "libwebp", "-quality", strconv.Itoa(thumbnailWebPQuality),
+		"-f", "webp", "pipe:1",
+	)
+}
+
+func runFFmpegPipe(ctx context.Context, stdin io.Reader, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "ffmpeg", append([]string{"-v", "error"}, args...)...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdin = stdin
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// jpegOrientation returns the EXIF orientation (1-8) of a JPEG, or 1 when it
+// has none.
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+	pos := 2
+	for pos+4 <= len(data) && data[pos] == 0xFF {
+		marker := data[pos+1]
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if marker == 0xDA || length < 2 || pos+2+length > len(data) {
+			// Image data starts at SOS; EXIF always comes before it.
+			break
+		}
+		segment := data[pos+4 : pos+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+		pos += 2 + length
+	}
+	return 1
+}
+
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			o := int(order.Uint16(tiff[entry+8:]))
+			if o >= 1 && o <= 8 {
+				return o
+			}
+			break
+		}
+	}
+	return 1
+}
+
+// applyOrientation rotates and flips img so that EXIF orientation o becomes
+// the normal orientation.
+func applyOrientation(img *image.RGBA, o int) *image.RGBA {
+	if o <= 1 || o > 8 {
+		return img
+	}
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	dw, dh := w, h
+	if o >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch o {
+			case 2: // mirrored
+				dx, dy = w-1-x, y
+			case 3: // rotated 180°
+				dx, dy = w-1-x, h-1-y
+			case 4: // mirrored vertically
+				dx, dy = x, h-1-y
+			case 5: // mirrored along the main diagonal
+				dx, dy = y, x
+			case 6: // rotated 90° clockwise
+				dx, dy = h-1-y, x
+			case 7: // mirrored along the anti-diagonal
+				dx, dy = h-1-y, w-1-x
+			case 8: // rotated 90° counter-clockwise
+				dx, dy = y, w-1-x
+			}
+			copy(dst.Pix[dy*dst.Stride+dx*4:dy*dst.Stride+dx*4+4], img.Pix[y*img.Stride+x*4:y*img.Stride+x*4+4])
+		}
+	}
+	return dst
+}
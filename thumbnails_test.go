@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+var (
+	red   = color.RGBA{255, 0, 0, 255}
+	green = color.RGBA{0, 255, 0, 255}
+	blue  = color.RGBA{0, 0, 255, 255}
+	white = color.RGBA{255, 255, 255, 255}
+)
+
+// quadrants is a w by h image that's red, green, blue and white from top
+// left to bottom right, so every rotation and flip looks different.
+func quadrants(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := red
+			switch {
+			case x >= w/2 && y < h/2:
+				c = green
+			case x < w/2 && y >= h/2:
+				c = blue
+			case x >= w/2 && y >= h/2:
+				c = white
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+// corners names the colors at the center of each quadrant, top left to
+// bottom right, as in "RGBW". JPEG blurs the edges, so only the centers are
+// looked at, and colors only have to be close.
+func corners(img image.Image) string {
+	b := img.Bounds()
+	names := ""
+	for _, p := range []image.Point{
+		{b.Dx() / 4, b.Dy() / 4},
+		{b.Dx() * 3 / 4, b.Dy() / 4},
+		{b.Dx() / 4, b.Dy() * 3 / 4},
+		{b.Dx() * 3 / 4, b.Dy() * 3 / 4},
+	} {
+		r, g, bl, _ := img.At(b.Min.X+p.X, b.Min.Y+p.Y).RGBA()
+		name := "?"
+		for n, c := range map[string]color.RGBA{"R": red, "G": green, "B": blue, "W": white} {
+			if near(r>>8, c.R) && near(g>>8, c.G) && near(bl>>8, c.B) {
+				name = n
+			}
+		}
+		names += name
+	}
+	return names
+}
+
+func near(got uint32, want uint8) bool {
+	d := int(got) - int(want)
+	return d > -48 && d < 48
+}
+
+// exifSegment is an APP1 segment with an EXIF orientation tag, followed by
+// something that shouldn't leak into thumbnails.
+func exifSegment(order binary.ByteOrder, orientation int) []byte {
+	tiff := make([]byte, 8+2+12+4)
+	copy(tiff, "MM")
+	if order == binary.LittleEndian {
+		copy(tiff, "II")
+	}
+	order.PutUint16(tiff[2:], 42)
+	order.PutUint32(tiff[4:], 8)
+	order.PutUint16(tiff[8:], 1)
+	order.PutUint16(tiff[10:], 0x0112)
+	order.PutUint16(tiff[12:], 3) // SHORT
+	order.PutUint32(tiff[14:], 1)
+	order.PutUint16(tiff[18:], uint16(orientation))
+	tiff = append(tiff, "GPS 48.8584N 2.2945E"...)
+
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+	segment := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	return append(segment, payload...)
+}
+
+// testJPEG encodes img with the EXIF orientation, if it isn't 0.
+func testJPEG(t *testing.T, img image.Image, order binary.ByteOrder, orientation int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	if orientation == 0 {
+		return data
+	}
+	// Right after SOI, where cameras put it.
+	return append(append(data[:2:2], exifSegment(order, orientation)...), data[2:]...)
+}
+
+func TestJPEGOrientation(t *testing.T) {
+	img := quadrants(32, 16)
+	tests := []struct {
+		name string
+		data []byte
+		want int
+	}{
+		{"no EXIF", testJPEG(t, img, nil, 0), 1},
+		{"big endian", testJPEG(t, img, binary.BigEndian, 6), 6},
+		{"little endian", testJPEG(t, img, binary.LittleEndian, 8), 8},
+		{"out of range", testJPEG(t, img, binary.BigEndian, 9), 1},
+		{"truncated", testJPEG(t, img, binary.BigEndian, 6)[:30], 1},
+		{"PNG", testPNG(t), 1},
+		{"empty", nil, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := jpegOrientation(tt.data); got != tt.want {
+				t.Errorf("jpegOrientation = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestDecodeThumbnailOrientation decodes a landscape photo tagged with each
+// orientation and checks it comes out the way it's meant to be seen.
+func TestDecodeThumbnailOrientation(t *testing.T) {
+	src := quadrants(64, 32)
+	tests := []struct {
+		orientation   int
+		width, height int
+		corners       string
+	}{
+		{1, 64, 32, "RGBW"},
+		{2, 64, 32, "GRWB"},
+		{3, 64, 32, "WBGR"},
+		{4, 64, 32, "BWRG"},
+		{5, 32, 64, "RBGW"},
+		{6, 32, 64, "BRWG"},
+		{7, 32, 64, "WGBR"},
+		{8, 32, 64, "GWRB"},
+	}
+	for _, tt := range tests {
+		data := testJPEG(t, src, binary.BigEndian, tt.orientation)
+		if got := jpegOrientation(data); got != tt.orientation {
+			t.Errorf("orientation %d: jpegOrientation = %d", tt.orientation, got)
+		}
+		img, err := decodeThumbnail(context.Background(), data, "image/jpeg")
+		if err != nil {
+			t.Fatalf("orientation %d: %v", tt.orientation, err)
+		}
+		if img.Bounds().Dx() != tt.width || img.Bounds().Dy() != tt.height {
+			t.Errorf("orientation %d: decoded %v, want %dx%d", tt.orientation, img.Bounds().Size(), tt.width, tt.height)
+		}
+		if got := corners(img); got != tt.corners {
+			t.Errorf("orientation %d: corners %s, want %s", tt.orientation, got, tt.corners)
+		}
+	}
+
+	// Only JPEGs carry an orientation.
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, src); err != nil {
+		t.Fatal(err)
+	}
+	img, err := decodeThumbnail(context.Background(), buf.Bytes(), "image/png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := corners(img); got != "RGBW" {
+		t.Errorf("PNG corners %s, want RGBW", got)
+	}
+}
+
+func TestApplyOrientationExact(t *testing.T) {
+	// 3x2, every pixel different.
+	src := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	for i := 0; i < 6; i++ {
+		src.SetRGBA(i%3, i/3, color.RGBA{uint8(i), 0, 0, 255})
+	}
+	pixels := func(img *image.RGBA) []uint8 {
+		var p []uint8
+		for y := 0; y < img.Bounds().Dy(); y++ {
+			for x := 0; x < img.Bounds().Dx(); x++ {
+				p = append(p, img.RGBAAt(x, y).R)
+			}
+		}
+		return p
+	}
+	tests := []struct {
+		orientation int
+		want        []uint8
+	}{
+		{1, []uint8{0, 1, 2, 3, 4, 5}},
+		{2, []uint8{2, 1, 0, 5, 4, 3}},
+		{3, []uint8{5, 4, 3, 2, 1, 0}},
+		{4, []uint8{3, 4, 5, 0, 1, 2}},
+		{5, []uint8{0, 3, 1, 4, 2, 5}},
+		{6, []uint8{3, 0, 4, 1, 5, 2}},
+		{7, []uint8{5, 2, 4, 1, 3, 0}},
+		{8, []uint8{2, 5, 1, 4, 0, 3}},
+	}
+	for _, tt := range tests {
+		got := applyOrientation(src, tt.orientation)
+		if !bytes.Equal(pixels(got), tt.want) {
+			t.Errorf("orientation %d: pixels %v, want %v", tt.orientation, pixels(got), tt.want)
+		}
+	}
+}
+
+func TestResizeImage(t *testing.T) {
+	src := quadrants(640, 360)
+	if got := resizeImage(src, 640); got != src {
+		t.Errorf("resizing to the same width made a copy")
+	}
+	got := resizeImage(src, 320)
+	if got.Bounds().Dx() != 320 || got.Bounds().Dy() != 180 {
+		t.Errorf("resized to %v, want 320x180", got.Bounds().Size())
+	}
+	if c := corners(got); c != "RGBW" {
+		t.Errorf("resized corners %s, want RGBW", c)
+	}
+
+	// Each destination pixel averages the 2x2 block under it.
+	small := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	copy(small.Pix, []uint8{
+		0, 0, 0, 255, 100, 0, 0, 255, 10, 20, 30, 255, 10, 20, 30, 255,
+		200, 0, 0, 255, 100, 0, 0, 0, 30, 40, 50, 255, 30, 40, 50, 255,
+	})
+	half := resizeImage(small, 2)
+	want := []uint8{100, 0, 0, 191, 20, 30, 40, 255}
+	if !bytes.Equal(half.Pix, want) {
+		t.Errorf("averaged %v, want %v", half.Pix, want)
+	}
+
+	tests := []struct {
+		srcWidth, srcHeight, width, height int
+	}{
+		{1000, 333, 320, 107},
+		{1000, 1, 10, 1},
+		{360, 640, 180, 320},
+	}
+	for _, tt := range tests {
+		got := resizeImage(image.NewRGBA(image.Rect(0, 0, tt.srcWidth, tt.srcHeight)), tt.width)
+		if got.Bounds().Dx() != tt.width || got.Bounds().Dy() != tt.height {
+			t.Errorf("%dx%d resized to %d wide is %v, want %dx%d",
+				tt.srcWidth, tt.srcHeight, tt.width, got.Bounds().Size(), tt.width, tt.height)
+		}
+	}
+}
+
+func TestDecodeThumbnailTooLarge(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatal(err)
+	}
+	// Claim 10000x10000 in IHDR, which follows the 8 byte signature.
+	data := buf.Bytes()
+	ihdr := data[8:]
+	binary.BigEndian.PutUint32(ihdr[8:], 10000)
+	binary.BigEndian.PutUint32(ihdr[12:], 10000)
+	binary.BigEndian.PutUint32(ihdr[21:], crc32.ChecksumIEEE(ihdr[4:21]))
+
+	if _, err := decodeThumbnail(context.Background(), data, "image/png"); err == nil {
+		t.Errorf("decoded a %d pixel image", 10000*10000)
+	}
+}
+
+func TestRenderThumbnails(t *testing.T) {
+	requireFFmpeg(t)
+	// A portrait photo taken sideways, with EXIF that has to go.
+	data := testJPEG(t, quadrants(1280, 720), binary.LittleEndian, 6)
+
+	variants, err := renderThumbnails(context.Background(), data, "image/jpeg", []int{320, 640, 1280})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Upright it's 720 wide, too narrow for 1280.
+	want := []struct {
+		width, height int
+		mediaType     string
+	}{
+		{320, 569, "image/jpeg"},
+		{320, 569, "image/webp"},
+		{640, 1138, "image/jpeg"},
+		{640, 1138, "image/webp"},
+	}
+	if len(variants) != len(want) {
+		t.Fatalf("rendered %d variants, want %d", len(variants), len(want))
+	}
+	for i, v := range variants {
+		w := want[i]
+		if v.Width != w.width || v.Height != w.height || v.MediaType != w.mediaType {
+			t.Errorf("variant %d is %dx%d %s, want %dx%d %s", i, v.Width, v.Height, v.MediaType, w.width, w.height, w.mediaType)
+		}
+		if got := sniffImageType(v.data); got != v.MediaType {
+			t.Errorf("%dw %s variant holds %q", v.Width, v.MediaType, got)
+		}
+		if bytes.Contains(v.data, []byte("Exif")) || bytes.Contains(v.data, []byte("GPS")) {
+			t.Errorf("%dw %s variant kept the EXIF data", v.Width, v.MediaType)
+		}
+		if v.MediaType != "image/jpeg" {
+			continue
+		}
+		img, err := jpeg.Decode(bytes.NewReader(v.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := corners(img); got != "BRWG" {
+			t.Errorf("%dw JPEG corners %s, want the photo upright, BRWG", v.Width, got)
+		}
+	}
+
+	_, err = renderThumbnails(context.Background(), []byte("not an image"), "image/png", defaultThumbnailWidths)
+	if !errors.Is(err, errInvalidImage) {
+		t.Errorf("rendering garbage: %v, want errInvalidImage", err)
+	}
+}